@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/downloader"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	BatchStatusOk        = `ok`
+	BatchStatusFailed    = `failed`
+	BatchStatusSkipped   = `skipped` // the output exists already, e.g. the batch is run again
+	BatchStatusCancelled = `cancelled`
+)
+
+// batchResult is the outcome of a job in the report.
+type batchResult struct {
+	Line     int     `json:"line"`
+	Url      string  `json:"url"`
+	Filename string  `json:"filename"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Segments int     `json:"segments"`
+	Bytes    int64   `json:"bytes"`
+	Elapsed  float64 `json:"elapsed"` // seconds
+
+	running      bool
+	rate         float64
+	segmentNum   int
+	segmentTotal int
+}
+
+type batchReport struct {
+	JobFile   string        `json:"job_file"`
+	Started   time.Time     `json:"started"`
+	Finished  time.Time     `json:"finished"`
+	Ok        int           `json:"ok"`
+	Failed    int           `json:"failed"`
+	Skipped   int           `json:"skipped"`
+	Cancelled int           `json:"cancelled"`
+	ExitCode  int           `json:"exit_code"`
+	Jobs      []batchResult `json:"jobs"`
+}
+
+// batch runs the jobs with the common options and keeps their results.
+type batch struct {
+	Concurrency      int
+	Config           *downloader.Config
+	FilenameTemplate string // of the jobs without filenames
+	OutputDir        string
+	Manifest         bool
+	PropagateQuery   bool
+	RateLimiter      *downloader.RateLimiter // shared by the jobs
+	Retries          int
+	SinkName         string
+	SinkFallback     string
+	FfmpegProfile    string
+	HeaderOptions    *headerFlags
+	Rewriter         *downloader.Rewriter
+
+	mu          sync.Mutex
+	results     []batchResult
+	downloaders map[int]*downloader.Downloader // running ones by job index
+	cancelled   bool
+}
+
+// outputExt is the extension of the output of the sink.
+func outputExt(sinkName, ffmpegProfile string) string {
+	switch sinkName {
+	case `ffmpeg`:
+		if profile, err := downloader.GetFfmpegProfile(ffmpegProfile); err == nil {
+			return profile.Ext
+		}
+	case `file`:
+		return `.ts`
+	case `dir`, `store`:
+		return ``
+	case `m4a`, `aac`:
+		return `.` + sinkName
+	}
+	return `.mp4`
+}
+
+// outputFilename is the filename of the job in OutputDir: as given (with the extension added if it has none) or
+// made of FilenameTemplate.
+func (b *batch) outputFilename(index int, job batchJob) string {
+	ext := outputExt(b.SinkName, b.FfmpegProfile)
+	filename := job.Filename
+	if filename == `` {
+		filename = downloader.ExpandFilenameTemplate(b.FilenameTemplate, job.Url, index+1, ext)
+	} else if filepath.Ext(filename) == `` {
+		filename = filename + ext
+	}
+	if filepath.IsAbs(filename) {
+		return filepath.Clean(filename)
+	}
+	return filepath.Join(b.OutputDir, filename)
+}
+
+// checkOutputs returns an error if two jobs of the job file write the same output or one writes into the output
+// directory of another: a failed job removes its output, the one of the other job with it.
+func (b *batch) checkOutputs(filename string, jobs []batchJob) error {
+	type output struct {
+		filename string
+		line     int
+	}
+	outputs := make([]output, 0, len(jobs))
+	for i, job := range jobs {
+		o := output{filename: b.outputFilename(i, job), line: job.Line}
+		for _, other := range outputs {
+			if o.filename == other.filename ||
+				strings.HasPrefix(o.filename, other.filename+string(filepath.Separator)) ||
+				strings.HasPrefix(other.filename, o.filename+string(filepath.Separator)) {
+				return jobFileError(filename, o.line, fmt.Sprintf("output %s overlaps %s of the job of line %d",
+					o.filename, other.filename, other.line))
+			}
+		}
+		outputs = append(outputs, o)
+	}
+	return nil
+}
+
+func (b *batch) setResult(index int, update func(result *batchResult)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	update(&b.results[index])
+}
+
+// run downloads the job, the result is kept in results.
+func (b *batch) run(index int, job batchJob) {
+	started := time.Now()
+	result := &b.results[index]
+	created := false // the job has started writing the output
+	finish := func(status string, err error) {
+		if err != nil && created {
+			// the output didn't exist before the job, and an incomplete one would be skipped when the batch is run
+			// again; it is a directory of the dir and store sinks, no other job writes into it (see checkOutputs)
+			os.RemoveAll(result.Filename)
+		}
+		b.setResult(index, func(result *batchResult) {
+			result.Status, result.running = status, false
+			result.Elapsed = time.Since(started).Seconds()
+			if err != nil {
+				result.Error = err.Error()
+			}
+			delete(b.downloaders, index)
+		})
+	}
+	if _, err := os.Stat(result.Filename); err == nil {
+		finish(BatchStatusSkipped, nil)
+		return
+	}
+	requestHeaders, err := b.HeaderOptions.requestHeaders(job.Url)
+	if err != nil {
+		finish(BatchStatusFailed, err)
+		return
+	}
+	for k, v := range job.Headers {
+		requestHeaders[http.CanonicalHeaderKey(k)] = v
+	}
+	d := b.Config.NewDownloader()
+	d.Rewriter = b.Rewriter
+	d.Retries = b.Retries
+	d.PropagateQuery = b.PropagateQuery
+	d.SinkName, d.SinkFallback = b.SinkName, b.SinkFallback
+	d.SinkOptions.FfmpegProfile = b.FfmpegProfile
+	d.RateLimiter = downloader.NewRateLimiter(0, 0, b.RateLimiter)
+	if b.Manifest {
+		d.ManifestFilename = downloader.ManifestFor(result.Filename)
+	}
+	b.mu.Lock()
+	if b.cancelled {
+		b.mu.Unlock()
+		finish(BatchStatusCancelled, downloader.ErrCancelled)
+		return
+	}
+	b.downloaders[index] = d
+	result.running = true
+	b.mu.Unlock()
+	if dir := filepath.Dir(result.Filename); dir != `` {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			finish(BatchStatusFailed, err)
+			return
+		}
+	}
+	created = true
+	events, err := d.Download(job.Url, result.Filename, requestHeaders)
+	if err != nil {
+		finish(BatchStatusFailed, err)
+		return
+	}
+	for event := range events {
+		b.setResult(index, func(result *batchResult) {
+			result.Segments, result.Bytes, result.rate = event.SegmentNum, event.Bytes, event.MovingRate
+			result.segmentNum, result.segmentTotal = event.SegmentNum, event.TotalSegments
+		})
+		err = event.Error
+	}
+	switch {
+	case err == downloader.ErrCancelled:
+		finish(BatchStatusCancelled, err)
+	case err != nil:
+		finish(BatchStatusFailed, err)
+	default:
+		finish(BatchStatusOk, nil)
+	}
+}
+
+// Cancel cancels the running jobs, the pending ones aren't started.
+func (b *batch) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cancelled = true
+	for _, d := range b.downloaders {
+		d.Cancel()
+	}
+}
+
+// progress writes the aggregate progress line of the jobs.
+func (b *batch) progress(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	done, running, failed, segments, totalSegments := 0, 0, 0, 0, 0
+	var bytes int64
+	var rate float64
+	for _, result := range b.results {
+		switch {
+		case result.running:
+			running++
+			rate = rate + result.rate
+		case result.Status != ``:
+			done++
+		}
+		if result.Status == BatchStatusFailed {
+			failed++
+		}
+		segments, totalSegments = segments+result.segmentNum, totalSegments+result.segmentTotal
+		bytes = bytes + result.Bytes
+	}
+	fmt.Fprintf(w, "\r[jobs %d / %d, %d running, %d failed] [segments %d / %d] [%.1f Mb] [%.2f Mb/s]\t",
+		done, len(b.results), running, failed, segments, totalSegments, float64(bytes)/1024/1024, rate/1024/1024)
+}
+
+// Run runs the jobs, Concurrency at a time, and returns the report. Failed jobs don't stop the others.
+func (b *batch) Run(jobs []batchJob, progress io.Writer) *batchReport {
+	report := batchReport{Started: time.Now()}
+	b.results = make([]batchResult, len(jobs))
+	b.downloaders = make(map[int]*downloader.Downloader)
+	for i, job := range jobs {
+		b.results[i] = batchResult{Line: job.Line, Url: job.Url, Filename: b.outputFilename(i, job)}
+	}
+	indexes := make(chan int, len(jobs))
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
+	workers := sync.WaitGroup{}
+	for i := 0; i < max(b.Concurrency, 1); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for index := range indexes {
+				b.run(index, jobs[index])
+				b.mu.Lock()
+				result := b.results[index]
+				b.mu.Unlock()
+				if result.Status != BatchStatusOk && result.Status != BatchStatusSkipped {
+					ErrorLog.Printf("Job %d (line %d) %s\n", index+1, result.Line, result.Status)
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-time.After(time.Second):
+		}
+		b.progress(progress)
+	}
+	fmt.Fprintln(progress)
+	report.Finished = time.Now()
+	report.Jobs = b.results
+	for _, result := range b.results {
+		switch result.Status {
+		case BatchStatusOk:
+			report.Ok++
+		case BatchStatusFailed:
+			report.Failed++
+		case BatchStatusSkipped:
+			report.Skipped++
+		case BatchStatusCancelled:
+			report.Cancelled++
+		}
+	}
+	if report.Failed > 0 || report.Cancelled > 0 {
+		report.ExitCode = 1
+	}
+	return &report
+}
+
+func printBatchReport(w io.Writer, report *batchReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tSTATUS\tSEGMENTS\tSIZE\tTIME\tFILENAME\tERROR")
+	for _, result := range report.Jobs {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\t%s\t%s\n", result.Line, strings.ToUpper(result.Status), result.Segments,
+			formatSize(result.Bytes), time.Duration(result.Elapsed*float64(time.Second)).Round(time.Second),
+			result.Filename, strings.ReplaceAll(result.Error, "\n", ` `))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d ok, %d failed, %d skipped, %d cancelled in %s\n", report.Ok, report.Failed, report.Skipped,
+		report.Cancelled, report.Finished.Sub(report.Started).Round(time.Second))
+}
+
+// batchCommand downloads the jobs of the job file and prints the summary. It returns the exit code: 0 if every job
+// succeeded (or was skipped), 1 otherwise, 2 on bad arguments or job file.
+func batchCommand(args []string) int {
+	config := loadConfig(args)
+	if config == nil {
+		return 2
+	}
+	flags := flag.NewFlagSet(`batch`, flag.ExitOnError)
+	configFlag(flags, config)
+	concurrency := flags.Int("j", config.Concurrency, "jobs to run at once")
+	outputDir := flags.String("o", config.OutputDir, "directory of the outputs with relative or no filenames")
+	reportFilename := flags.String("report", "", "write the JSON report of the jobs into the file")
+	sinkName := flags.String("sink", config.Sink, "output sink: "+strings.Join(downloader.SinkNames(), ", "))
+	sinkFallback := flags.String("sink-fallback", config.SinkFallback, "sink to use if the -sink one can't be opened (empty - fail)")
+	ffmpegProfile := flags.String("ffmpeg-profile", config.FfmpegProfile, "ffmpeg output profile: "+strings.Join(downloader.FfmpegProfileNames(), ", "))
+	retries := flags.Int("retries", config.Retries, "retries of a failed or invalid segment")
+	propagateQuery := flags.Bool("propagate-query", config.Http.PropagateQuery, "add playlist URL query parameters (e.g. signed tokens) to segment URLs")
+	rateLimit := flags.String("ratelimit", config.RateLimit.Rate, "download rate limit of all the jobs together in bytes/sec (K, M suffixes allowed)")
+	manifest := flags.Bool("manifest", false, "write the JSON manifest next to every output")
+	headerOptions := newHeaderFlags(flags, config)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s batch [options] <job file>\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "The job file has lines of 'url [filename] [Name: value]...' or is a JSON (.json) or YAML (.yaml)")
+		fmt.Fprintln(flags.Output(), "list of {url, filename, headers} objects.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	jobs, err := readJobs(flags.Arg(0))
+	if err != nil {
+		return 2
+	}
+	if _, err := downloader.GetFfmpegProfile(*ffmpegProfile); err != nil {
+		return 2
+	}
+	if *sinkName == `stdout` {
+		ErrorLog.Println(`stdout sink can't be used in a batch`)
+		return 2
+	}
+	rate, err := downloader.ParseRate(*rateLimit)
+	if err != nil {
+		return 2
+	}
+	_, burst := config.RateLimits()
+	rewriter, err := downloader.ParseRewriteRules(config.Rewrite)
+	if err != nil {
+		return 2
+	}
+	filenameTemplate := config.FilenameTemplate
+	if filenameTemplate == `` {
+		filenameTemplate = `{n}-{name}{ext}`
+	}
+	b := batch{
+		Concurrency:      *concurrency,
+		Config:           config,
+		FilenameTemplate: filenameTemplate,
+		OutputDir:        *outputDir,
+		Manifest:         *manifest,
+		PropagateQuery:   *propagateQuery,
+		RateLimiter:      downloader.NewRateLimiter(rate, burst, nil),
+		Retries:          *retries,
+		SinkName:         *sinkName,
+		SinkFallback:     *sinkFallback,
+		FfmpegProfile:    *ffmpegProfile,
+		HeaderOptions:    headerOptions,
+		Rewriter:         rewriter,
+	}
+	if err := b.checkOutputs(flags.Arg(0), jobs); err != nil {
+		return 2
+	}
+	// the aggregate progress line replaces the debug output of the jobs
+	downloader.DebugLog.SetOutput(io.Discard)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nCancelling...")
+		b.Cancel()
+		<-signals
+		os.Exit(130)
+	}()
+	report := b.Run(jobs, os.Stdout)
+	report.JobFile = flags.Arg(0)
+	printBatchReport(os.Stdout, report)
+	if *reportFilename != `` {
+		data, err := json.MarshalIndent(report, ``, `  `)
+		if err == nil {
+			err = os.WriteFile(*reportFilename, data, 0644)
+		}
+		if err != nil {
+			ErrorLog.Println(err.Error())
+			return 1
+		}
+	}
+	return report.ExitCode
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckOutputs(t *testing.T) {
+	tests := []struct {
+		name  string
+		sink  string
+		jobs  []batchJob
+		error string
+	}{
+		{`distinct`, `ffmpeg`, []batchJob{{1, `http://a/1.m3u8`, ``, nil}, {2, `http://a/1.m3u8`, ``, nil},
+			{3, `http://a/2.m3u8`, `two`, nil}, {4, `http://a/3.m3u8`, `two/three.mp4`, nil}}, ``},
+		{`same filename`, `ffmpeg`, []batchJob{{1, `http://a/1.m3u8`, `out.mp4`, nil},
+			{2, `http://a/2.m3u8`, `x/../out`, nil}}, "jobs:2: output /out/out.mp4 overlaps /out/out.mp4 of the job of line 1"},
+		{`absolute`, `ffmpeg`, []batchJob{{1, `http://a/1.m3u8`, `/out//a.mp4`, nil},
+			{2, `http://a/2.m3u8`, `a.mp4`, nil}}, "jobs:2: output /out/a.mp4 overlaps /out/a.mp4 of the job of line 1"},
+		{`inside a directory`, `dir`, []batchJob{{1, `http://a/1.m3u8`, `video`, nil},
+			{2, `http://a/2.m3u8`, `video/1`, nil}}, "jobs:2: output /out/video/1 overlaps /out/video of the job of line 1"},
+		{`around a directory`, `dir`, []batchJob{{1, `http://a/1.m3u8`, `video/1`, nil},
+			{2, `http://a/2.m3u8`, `video`, nil}}, "jobs:2: output /out/video overlaps /out/video/1 of the job of line 1"},
+	}
+	for _, test := range tests {
+		b := batch{FilenameTemplate: `{n}-{name}{ext}`, OutputDir: `/out`, SinkName: test.sink}
+		err := b.checkOutputs(`jobs`, test.jobs)
+		if test.error == `` {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrJobFile) || !strings.HasSuffix(err.Error(), test.error) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.error)
+		}
+	}
+}
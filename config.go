@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/downloader"
+	"os"
+)
+
+// loadConfig reads the config of the command line arguments (see downloader.ConfigFilename), nil on error.
+func loadConfig(args []string) *downloader.Config {
+	config, err := downloader.LoadConfig(downloader.ConfigFilename(args))
+	if err != nil {
+		return nil
+	}
+	downloader.FfmpegPath = config.FfmpegPath
+	return config
+}
+
+// configFlag adds -config, which is read by loadConfig before the flags are parsed.
+func configFlag(flags *flag.FlagSet, config *downloader.Config) {
+	flags.String("config", config.Filename, "TOML config file (default "+downloader.DefaultConfigFile()+
+		" if it exists, or $"+downloader.ConfigEnvPrefix+"CONFIG), "+downloader.ConfigEnvPrefix+"<KEY> variables override it")
+}
+
+// configCommand prints the effective config: the defaults, the config file and the environment variables.
+func configCommand(args []string) int {
+	flags := flag.NewFlagSet(`config`, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s config [-config <file>]\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Print the effective configuration as TOML.")
+		flags.PrintDefaults()
+	}
+	config := loadConfig(args)
+	if config == nil {
+		return 2
+	}
+	configFlag(flags, config)
+	flags.Parse(args)
+	if config.Filename != `` {
+		fmt.Printf("# %s\n", config.Filename)
+	} else {
+		fmt.Println(`# defaults, no config file`)
+	}
+	if err := config.WriteToml(os.Stdout); err != nil {
+		ErrorLog.Println(err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/remux"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrAudioOutput = errors.New(`unknown audio-only output format`)
+	ErrNoAudio     = errors.New(`no AAC audio in the stream`)
+
+	// AudioOutputs are the ffmpeg profile and the native sink (empty if there is none) of audio-only output by the
+	// extension of the output file.
+	AudioOutputs = map[string]AudioOutput{
+		`.m4a`: {FfmpegProfile: `audio-only-m4a`, Sink: `m4a`},
+		`.aac`: {FfmpegProfile: `audio-only-aac`, Sink: `aac`},
+		`.mp3`: {FfmpegProfile: `audio-only-mp3`},
+	}
+)
+
+type AudioOutput struct {
+	FfmpegProfile string
+	Sink          string
+}
+
+// GetAudioOutput returns the audio-only output of the file by its extension.
+func GetAudioOutput(outputFilename string) (AudioOutput, error) {
+	output, ok := AudioOutputs[strings.ToLower(filepath.Ext(outputFilename))]
+	if !ok {
+		extensions := make([]string, 0, len(AudioOutputs))
+		for ext := range AudioOutputs {
+			extensions = append(extensions, ext)
+		}
+		sort.Strings(extensions)
+		err := errors.Join(ErrAudioOutput, errors.New(fmt.Sprintf("'%s' (known: %s)", outputFilename,
+			strings.Join(extensions, `, `))))
+		ErrorLog.Println(err.Error())
+		return AudioOutput{}, err
+	}
+	return output, nil
+}
+
+// skipId3 returns the data after the ID3 tag packed audio segments start with (with the timestamp).
+func skipId3(data []byte) []byte {
+	if len(data) < 10 || string(data[:3]) != `ID3` {
+		return data
+	}
+	size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+	if 10+size >= len(data) {
+		return nil
+	}
+	return data[10+size:]
+}
+
+// AdtsSink writes the AAC audio as raw ADTS natively: extracted from the PES of the first AAC stream of MPEG-TS
+// segments, or packed audio segments as they are without the ID3 tag. Fragmented MP4 has no ADTS, use m4a for it.
+type AdtsSink struct {
+	w       io.Writer
+	file    *os.File
+	demuxer *remux.TsDemuxer
+	pid     int
+	written int64
+}
+
+func (sink *AdtsSink) WriteSegment(info SegmentInfo, data []byte) error {
+	switch {
+	case info.IsMap || IsBmff(data):
+		err := errors.Join(ErrNoAudio, errors.New(fmt.Sprintf("%s: fragmented MP4 can't be written as ADTS, use m4a",
+			info.Url)))
+		ErrorLog.Println(err.Error())
+		return err
+	case IsTs(data):
+		if _, err := sink.demuxer.Write(data); err != nil {
+			ErrorLog.Printf("%s: %s\n", info.Url, err.Error())
+			return err
+		}
+		return nil
+	}
+	data = skipId3(data)
+	if _, err := remux.ParseAdtsHeader(data); err != nil {
+		err = errors.Join(ErrNoAudio, err, errors.New(info.Url))
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	n, err := sink.w.Write(data)
+	sink.written = sink.written + int64(n)
+	return err
+}
+
+func (sink *AdtsSink) onPmt(streams map[uint16]byte) error {
+	if sink.pid >= 0 {
+		return nil
+	}
+	pids := make([]int, 0, len(streams))
+	for pid, streamType := range streams {
+		if streamType == remux.StreamTypeAAC {
+			pids = append(pids, int(pid))
+		}
+	}
+	if len(pids) > 0 {
+		sort.Ints(pids)
+		sink.pid = pids[0]
+	}
+	return nil
+}
+
+func (sink *AdtsSink) onPes(pes *remux.PES) error {
+	if int(pes.Pid) != sink.pid {
+		return nil
+	}
+	n, err := sink.w.Write(pes.Data)
+	sink.written = sink.written + int64(n)
+	return err
+}
+
+func (sink *AdtsSink) Close() error {
+	err := sink.demuxer.Flush()
+	if err == nil && sink.written == 0 {
+		err = ErrNoAudio
+	}
+	if err != nil {
+		ErrorLog.Println(err.Error())
+	}
+	if sink.file != nil {
+		if closeErr := sink.file.Close(); closeErr != nil && err == nil {
+			ErrorLog.Println(closeErr.Error())
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// NewAacSink writes raw ADTS AAC into the file or to stdout if the filename is '-'.
+func NewAacSink(options SinkOptions) (Sink, error) {
+	sink := AdtsSink{w: os.Stdout, demuxer: remux.NewTsDemuxer(), pid: -1}
+	if options.Filename != `-` {
+		f, err := os.Create(options.Filename)
+		if err != nil {
+			ErrorLog.Println(err.Error())
+			return nil, err
+		}
+		sink.w, sink.file = f, f
+	}
+	sink.demuxer.OnPmt, sink.demuxer.OnPes = sink.onPmt, sink.onPes
+	return &sink, nil
+}
+
+// NewM4aSink remuxes the audio natively into progressive MP4 without the video tracks, or fragmented MP4 to stdout
+// if the filename is '-'.
+func NewM4aSink(options SinkOptions) (Sink, error) {
+	var sink Sink
+	var err error
+	if options.Filename == `-` {
+		sink, err = NewFragmentedMp4Sink(options)
+	} else {
+		sink, err = NewMp4Sink(options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sink.(*RemuxSink).remuxer.AudioOnly = true
+	sink.(*RemuxSink).audioOnly = true
+	return sink, nil
+}
@@ -0,0 +1,146 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrClipRange      = errors.New(`clip end must be after its start`)
+	ErrClipOutOfRange = errors.New(`clip range is out of the playlist`)
+	ErrClipLive       = errors.New(`live playlist can't be clipped`) // its offsets move with the window
+)
+
+// ParseClipTime parses a time offset: seconds ('90', '90.5'), [hh:]mm:ss[.fff] or Go duration ('1h10m').
+func ParseClipTime(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == `` {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	parts := strings.Split(s, `:`)
+	if len(parts) > 3 {
+		err := errors.New(fmt.Sprintf("can't parse time '%s'", s))
+		ErrorLog.Println(err.Error())
+		return 0, err
+	}
+	seconds := 0.0
+	for _, part := range parts {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil || f < 0 {
+			err := errors.New(fmt.Sprintf("can't parse time '%s'", s))
+			ErrorLog.Println(err.Error())
+			return 0, err
+		}
+		seconds = seconds*60 + f
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// segmentList is a segment source of already selected segments.
+type segmentList struct {
+	segments []*playlist.Segment
+}
+
+func (list *segmentList) GetSegment() (*playlist.Segment, error) {
+	if len(list.segments) == 0 {
+		return nil, nil
+	}
+	segment := list.segments[0]
+	list.segments = list.segments[1:]
+	return segment, nil
+}
+
+// clipEnd returns the end of the clip, 0 if it lasts till the end of the playlist.
+func (downloader *Downloader) clipEnd() (time.Duration, error) {
+	end := downloader.ClipEnd
+	if downloader.ClipDuration > 0 {
+		end = downloader.ClipStart + downloader.ClipDuration
+	}
+	if end != 0 && end <= downloader.ClipStart {
+		ErrorLog.Println(ErrClipRange.Error())
+		return 0, ErrClipRange
+	}
+	return end, nil
+}
+
+func (downloader *Downloader) isClip() bool {
+	return downloader.ClipStart > 0 || downloader.ClipEnd > 0 || downloader.ClipDuration > 0
+}
+
+// selectSegments reads the whole playlist and selects the minimal set of segments covering the clip by cumulative
+// EXTINF durations. It returns the clip start and duration relative to the start of the first selected segment for
+// precise trimming. Only a VOD playlist (with EXT-X-ENDLIST) can be clipped, the times of a live one would be
+// offsets in its current window.
+func (downloader *Downloader) selectSegments(mediaPlaylist *playlist.Playlist) (*segmentList, time.Duration, time.Duration, error) {
+	end, err := downloader.clipEnd()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	list := segmentList{segments: make([]*playlist.Segment, 0)}
+	position, first := time.Duration(0), time.Duration(-1)
+	for {
+		segment, err := mediaPlaylist.GetSegment()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if segment == nil {
+			break
+		}
+		duration := time.Duration(float64(segment.Duration) * float64(time.Second))
+		if position+duration > downloader.ClipStart && (end == 0 || position < end) {
+			if first < 0 {
+				first = position
+			}
+			list.segments = append(list.segments, segment)
+			downloader.clipSegmentsCount++
+			downloader.clipSegmentsDuration = downloader.clipSegmentsDuration + segment.Duration
+		}
+		position = position + duration
+	}
+	// the playlist is read till its end, so EndList is known here
+	if !mediaPlaylist.EndList {
+		ErrorLog.Println(ErrClipLive.Error())
+		return nil, 0, 0, ErrClipLive
+	}
+	if len(list.segments) == 0 {
+		err := errors.Join(ErrClipOutOfRange, errors.New(fmt.Sprintf("the playlist is %s long", position)))
+		ErrorLog.Println(err.Error())
+		return nil, 0, 0, err
+	}
+	trimDuration := time.Duration(0)
+	if end != 0 {
+		trimDuration = end - downloader.ClipStart
+	}
+	return &list, max(downloader.ClipStart-first, 0), trimDuration, nil
+}
+
+// TotalSegments is the number of segments to download: of the clip or of the whole playlist.
+func (downloader *Downloader) TotalSegments() int {
+	if downloader.isClip() {
+		return downloader.clipSegmentsCount
+	}
+	if downloader.Playlist == nil {
+		return 0
+	}
+	count, _ := downloader.Playlist.Totals()
+	return count
+}
+
+// TotalDuration is the duration of the segments to download (seconds).
+func (downloader *Downloader) TotalDuration() float32 {
+	if downloader.isClip() {
+		return downloader.clipSegmentsDuration
+	}
+	if downloader.Playlist == nil {
+		return 0
+	}
+	_, duration := downloader.Playlist.Totals()
+	return duration
+}
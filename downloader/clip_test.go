@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"errors"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectSegments(t *testing.T) {
+	const segments = "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:10\n" +
+		"#EXTINF:4.0,\n10.ts\n#EXTINF:4.0,\n11.ts\n#EXTINF:4.0,\n12.ts\n#EXTINF:2.0,\n13.ts\n"
+	tests := []struct {
+		name      string
+		data      string
+		start     time.Duration
+		end       time.Duration
+		sequences []int
+		trimStart time.Duration
+		err       error
+	}{
+		{`vod`, segments + "#EXT-X-ENDLIST\n", 5 * time.Second, 9 * time.Second, []int{11, 12}, time.Second, nil},
+		{`vod till the end`, segments + "#EXT-X-ENDLIST\n", 12 * time.Second, 0, []int{13}, 0, nil},
+		{`vod out of range`, segments + "#EXT-X-ENDLIST\n", 20 * time.Second, 0, nil, 0, ErrClipOutOfRange},
+		{`live`, segments, 5 * time.Second, 9 * time.Second, nil, 0, ErrClipLive},
+	}
+	for _, test := range tests {
+		downloader := NewDownloader()
+		downloader.ClipStart, downloader.ClipEnd = test.start, test.end
+		list, trimStart, _, err := downloader.selectSegments(playlist.Parse(io.NopCloser(strings.NewReader(test.data))))
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("%s: error = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		sequences := make([]int, 0)
+		for _, segment := range list.segments {
+			sequences = append(sequences, segment.Sequence)
+		}
+		if !reflect.DeepEqual(sequences, test.sequences) || trimStart != test.trimStart {
+			t.Errorf("%s: segments %v, trim start %s; want %v, %s", test.name, sequences, trimStart,
+				test.sequences, test.trimStart)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ConfigEnvPrefix = `HLSDL_`
+
+var (
+	ErrConfig = errors.New(`bad config`)
+
+	regexpUnsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// Config is the configuration shared by the CLI and the server, read from a TOML file (see ParseToml for the subset
+// supported) with the environment variables over it. Sizes and rates take K, M and G suffixes, durations are like
+// "30s". Command line options override it.
+type Config struct {
+	OutputDir          string            `json:"output_dir"`
+	FilenameTemplate   string            `json:"filename_template"` // see ExpandFilenameTemplate, empty - the built-in names
+	Sink               string            `json:"sink"`
+	SinkFallback       string            `json:"sink_fallback"`
+	FfmpegPath         string            `json:"ffmpeg_path"`
+	FfmpegProfile      string            `json:"ffmpeg_profile"`
+	Retries            int               `json:"retries"`
+	Concurrency        int               `json:"concurrency"` // jobs of a batch at once
+	Http               HttpConfig        `json:"http"`
+	RateLimit          RateLimitConfig   `json:"ratelimit"` // of a download, of all the jobs of a batch or the tasks of the server
+	Server             ServerConfig      `json:"server"`
+	Headers            map[string]string `json:"headers"` // of every request, under the profile and the given ones
+	HeaderProfilesFile string            `json:"header_profiles_file"`
+	HeaderProfiles     HeaderProfiles    `json:"header_profiles"` // over the ones of HeaderProfilesFile
+	Rewrite            []string          `json:"rewrite"`         // inline rules and rule files, before the given ones
+
+	// the file the config is read from, empty - none
+	Filename string `json:"-"`
+
+	connectTimeout  time.Duration
+	responseTimeout time.Duration
+	proxy           *url.URL
+	rate            int64
+	burst           int64
+	splitThreshold  int64
+	transport       *http.Transport
+}
+
+type HttpConfig struct {
+	ConnectTimeout     string `json:"connect_timeout"`
+	ResponseTimeout    string `json:"response_timeout"`
+	Proxy              string `json:"proxy"` // empty - from the environment (HTTP_PROXY etc.)
+	UserAgent          string `json:"user_agent"`
+	MaxHostConnections int    `json:"max_host_connections"`
+	SplitParts         int    `json:"split_parts"`
+	SplitThreshold     string `json:"split_threshold"`
+	PropagateQuery     bool   `json:"propagate_query"`
+}
+
+type ServerConfig struct {
+	Listen   string `json:"listen"`
+	MaxTasks int    `json:"max_tasks"` // running at once, 0 - unlimited
+}
+
+type RateLimitConfig struct {
+	Rate  string `json:"rate"`
+	Burst string `json:"burst"`
+}
+
+// DefaultConfig has the defaults of the command line options.
+func DefaultConfig() *Config {
+	return &Config{
+		OutputDir:     `.`,
+		Sink:          `ffmpeg`,
+		SinkFallback:  `mp4`,
+		FfmpegPath:    `ffmpeg`,
+		FfmpegProfile: DefaultFfmpegProfile,
+		Retries:       3,
+		Concurrency:   2,
+		Http:          HttpConfig{SplitParts: 4},
+		Server:        ServerConfig{Listen: `:80`},
+		Headers:       make(map[string]string),
+	}
+}
+
+// DefaultConfigFile is the file the config is read from if no other one is given.
+func DefaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ``
+	}
+	return filepath.Join(dir, configDir, `config.toml`)
+}
+
+// ConfigFilename returns the config file of the command line: the value of -config (or --config), $HLSDL_CONFIG or
+// DefaultConfigFile if it exists. Empty - none.
+func ConfigFilename(args []string) string {
+	for i, arg := range args {
+		if arg == `--` {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, `-`), `-`), `=`)
+		if !strings.HasPrefix(arg, `-`) || name != `config` {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	if filename := os.Getenv(ConfigEnvPrefix + `CONFIG`); filename != `` {
+		return filename
+	}
+	if _, err := os.Stat(DefaultConfigFile()); err == nil {
+		return DefaultConfigFile()
+	}
+	return ``
+}
+
+// LoadConfig reads the defaults, the file (if filename isn't empty) and the environment variables over them, in
+// this order.
+func LoadConfig(filename string) (*Config, error) {
+	config := DefaultConfig()
+	if filename != `` {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			ErrorLog.Println(err.Error())
+			return nil, err
+		}
+		if err := config.parse(data); err != nil {
+			err = errors.Join(ErrConfig, errors.New(filename), err)
+			ErrorLog.Println(err.Error())
+			return nil, err
+		}
+		config.Filename = filename
+	}
+	if err := config.applyEnv(os.Environ()); err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	if err := config.check(); err != nil {
+		if filename != `` {
+			err = errors.Join(err, errors.New(filename))
+		}
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return config, nil
+}
+
+// parse decodes the TOML through JSON, so the keys are the json tags and unknown ones are rejected.
+func (config *Config) parse(data []byte) error {
+	values, err := ParseToml(data)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(config)
+}
+
+// applyEnv sets the fields from the HLSDL_<KEY> variables, e.g. HLSDL_OUTPUT_DIR or HLSDL_HTTP_PROXY. A list is a
+// JSON array or a single value. Tables (headers and profiles) are file only.
+func (config *Config) applyEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, variable := range environ {
+		if name, value, ok := strings.Cut(variable, `=`); ok && strings.HasPrefix(name, ConfigEnvPrefix) {
+			env[name] = value
+		}
+	}
+	return applyEnv(reflect.ValueOf(config).Elem(), ConfigEnvPrefix, env)
+}
+
+func applyEnv(v reflect.Value, prefix string, env map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get(`json`), `,`)
+		if tag == `` || tag == `-` {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name+`_`, env); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			var n int64
+			if n, err = strconv.ParseInt(value, 10, 64); err == nil {
+				field.SetInt(n)
+			}
+		case reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(value); err == nil {
+				field.SetBool(b)
+			}
+		case reflect.Slice:
+			values := []string{value}
+			if strings.HasPrefix(strings.TrimSpace(value), `[`) {
+				err = json.Unmarshal([]byte(value), &values)
+			}
+			field.Set(reflect.ValueOf(values))
+		default:
+			continue
+		}
+		if err != nil {
+			return errors.Join(ErrConfig, errors.New(fmt.Sprintf("%s: %s", name, err.Error())))
+		}
+	}
+	return nil
+}
+
+// check validates the values and keeps the parsed ones.
+func (config *Config) check() error {
+	var err error
+	fail := func(key string, e error) error {
+		return errors.Join(ErrConfig, errors.New(key), e)
+	}
+	if _, err = GetFfmpegProfile(config.FfmpegProfile); err != nil {
+		return fail(`ffmpeg_profile`, err)
+	}
+	if config.Sink != `` && Sinks[config.Sink] == nil {
+		return fail(`sink`, errors.New(fmt.Sprintf("unknown sink '%s'", config.Sink)))
+	}
+	if config.SinkFallback != `` && Sinks[config.SinkFallback] == nil {
+		return fail(`sink_fallback`, errors.New(fmt.Sprintf("unknown sink '%s'", config.SinkFallback)))
+	}
+	if config.Http.ConnectTimeout != `` {
+		if config.connectTimeout, err = time.ParseDuration(config.Http.ConnectTimeout); err != nil {
+			return fail(`http.connect_timeout`, err)
+		}
+	}
+	if config.Http.ResponseTimeout != `` {
+		if config.responseTimeout, err = time.ParseDuration(config.Http.ResponseTimeout); err != nil {
+			return fail(`http.response_timeout`, err)
+		}
+	}
+	if config.Http.Proxy != `` {
+		if config.proxy, err = url.Parse(config.Http.Proxy); err != nil {
+			return fail(`http.proxy`, err)
+		}
+	}
+	if config.splitThreshold, err = ParseRate(config.Http.SplitThreshold); err != nil {
+		return fail(`http.split_threshold`, err)
+	}
+	if config.rate, err = ParseRate(config.RateLimit.Rate); err != nil {
+		return fail(`ratelimit.rate`, err)
+	}
+	if config.burst, err = ParseRate(config.RateLimit.Burst); err != nil {
+		return fail(`ratelimit.burst`, err)
+	}
+	if config.Headers == nil {
+		config.Headers = make(map[string]string)
+	}
+	for name, value := range config.Headers {
+		if _, _, err := ParseHeader(name + `: ` + value); err != nil {
+			return fail(`headers`, err)
+		}
+	}
+	if err := config.HeaderProfiles.compile(`header_profiles`); err != nil {
+		return errors.Join(ErrConfig, err)
+	}
+	if _, err := ParseRewriteRules(config.Rewrite); err != nil {
+		return fail(`rewrite`, err)
+	}
+	config.transport = newTransport(config.Http.MaxHostConnections, config.HttpOptions())
+	return nil
+}
+
+// RequestHeaders are the headers of every request: Headers with the User-Agent.
+func (config *Config) RequestHeaders() map[string]string {
+	headers := make(map[string]string)
+	if config.Http.UserAgent != `` {
+		headers[`User-Agent`] = config.Http.UserAgent
+	}
+	for name, value := range config.Headers {
+		name, value, _ := ParseHeader(name + `: ` + value)
+		headers[name] = value
+	}
+	return headers
+}
+
+// LoadHeaderProfiles reads HeaderProfilesFile (or the DefaultHeaderProfilesFile if it exists) with HeaderProfiles
+// over its ones.
+func (config *Config) LoadHeaderProfiles() (HeaderProfiles, error) {
+	filename := config.HeaderProfilesFile
+	if filename == `` {
+		if _, err := os.Stat(DefaultHeaderProfilesFile()); err == nil {
+			filename = DefaultHeaderProfilesFile()
+		}
+	}
+	profiles := make(HeaderProfiles)
+	if filename != `` {
+		var err error
+		if profiles, err = LoadHeaderProfiles(filename); err != nil {
+			return nil, err
+		}
+	}
+	for name, profile := range config.HeaderProfiles {
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// RateLimits returns the parsed rate and burst of RateLimit.
+func (config *Config) RateLimits() (int64, int64) {
+	return config.rate, config.burst
+}
+
+// SplitThreshold returns the parsed Http.SplitThreshold.
+func (config *Config) SplitThreshold() int64 {
+	return config.splitThreshold
+}
+
+// HttpOptions returns the HTTP client options of Http.
+func (config *Config) HttpOptions() HttpOptions {
+	return HttpOptions{
+		ConnectTimeout:  config.connectTimeout,
+		ResponseTimeout: config.responseTimeout,
+		Proxy:           config.proxy,
+	}
+}
+
+// NewDownloader makes a downloader with the settings of the config. The rate limiter, the rewriter and the headers
+// are up to the caller. The downloaders of a loaded config share its HTTP transport, so http.max_host_connections
+// limits all of them together.
+func (config *Config) NewDownloader() *Downloader {
+	downloader := NewDownloader()
+	downloader.Retries = config.Retries
+	downloader.SinkName = config.Sink
+	downloader.SinkFallback = config.SinkFallback
+	downloader.SinkOptions.FfmpegProfile = config.FfmpegProfile
+	downloader.MaxHostConnections = config.Http.MaxHostConnections
+	downloader.SplitParts = config.Http.SplitParts
+	downloader.SplitThreshold = config.splitThreshold
+	downloader.PropagateQuery = config.Http.PropagateQuery
+	downloader.HttpOptions = config.HttpOptions()
+	downloader.transport = config.transport
+	return downloader
+}
+
+// OutputPath joins a relative output filename with OutputDir, '-' (stdout) and absolute ones are kept.
+func (config *Config) OutputPath(filename string) string {
+	if filename == `-` || filename == `` || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(config.OutputDir, filename)
+}
+
+// WriteToml writes the config as TOML.
+func (config *Config) WriteToml(w io.Writer) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]any)
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	return WriteToml(w, values)
+}
+
+// ExpandFilenameTemplate makes an output filename of the template: {name} is the base name of the playlist URL path
+// without the extension, {host} the host of the URL, {date} and {time} the local date (2006-01-02) and time (150405),
+// {unix} the Unix time, {n} the number of the job (001) and {ext} the extension of the output format.
+func ExpandFilenameTemplate(template, playlistUrl string, n int, ext string) string {
+	name, host := `playlist`, ``
+	if u, err := url.Parse(playlistUrl); err == nil {
+		if base := path.Base(u.Path); base != `/` && base != `.` {
+			name = strings.TrimSuffix(base, path.Ext(base))
+		}
+		host = u.Hostname()
+	}
+	now := time.Now()
+	return strings.NewReplacer(
+		`{name}`, regexpUnsafeFilename.ReplaceAllString(name, `_`),
+		`{host}`, regexpUnsafeFilename.ReplaceAllString(host, `_`),
+		`{date}`, now.Format(`2006-01-02`),
+		`{time}`, now.Format(`150405`),
+		`{unix}`, strconv.FormatInt(now.Unix(), 10),
+		`{n}`, fmt.Sprintf(`%03d`, n),
+		`{ext}`, ext,
+	).Replace(template)
+}
@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigApplyEnv(t *testing.T) {
+	config := DefaultConfig()
+	err := config.applyEnv([]string{`HLSDL_OUTPUT_DIR=/tmp/out=1`, `HLSDL_RETRIES=5`, `HLSDL_HTTP_PROXY=http://proxy:3128`,
+		`HLSDL_HTTP_PROPAGATE_QUERY=true`, `HLSDL_RATELIMIT_RATE=1M`, `HLSDL_SERVER_MAX_TASKS=2`,
+		`HLSDL_REWRITE=["host:a.com => b.com", "rules.json"]`, `HLSDL_HEADERS=X-Token: t`, `HLSDL_UNKNOWN=1`,
+		`OUTPUT_DIR=/ignored`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.OutputDir = `/tmp/out=1`
+	want.Retries = 5
+	want.Http.Proxy = `http://proxy:3128`
+	want.Http.PropagateQuery = true
+	want.RateLimit.Rate = `1M`
+	want.Server.MaxTasks = 2
+	want.Rewrite = []string{`host:a.com => b.com`, `rules.json`}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("applyEnv() = %+v, want %+v", config, want)
+	}
+
+	if err := config.applyEnv([]string{`HLSDL_REWRITE=host:c.com => d.com`}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Rewrite, []string{`host:c.com => d.com`}) {
+		t.Errorf("Rewrite = %q", config.Rewrite)
+	}
+	for _, variable := range []string{`HLSDL_RETRIES=many`, `HLSDL_HTTP_PROPAGATE_QUERY=yes`, `HLSDL_REWRITE=[1]`} {
+		if err := DefaultConfig().applyEnv([]string{variable}); !errors.Is(err, ErrConfig) {
+			t.Errorf("applyEnv(%s) = %v, want %v", variable, err, ErrConfig)
+		}
+	}
+}
+
+// loadWritten writes the config to a file and loads it back.
+func loadWritten(t *testing.T, config *Config) *Config {
+	output := bytes.Buffer{}
+	if err := config.WriteToml(&output); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), `config.toml`)
+	if err := os.WriteFile(filename, output.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output.String())
+	}
+	if loaded.Filename != filename {
+		t.Errorf("Filename = %s, want %s", loaded.Filename, filename)
+	}
+	return loaded
+}
+
+func TestConfigWriteLoad(t *testing.T) {
+	config := DefaultConfig()
+	config.OutputDir = `C:\Videos\"new"`
+	config.FilenameTemplate = `{host}/{name}-{n}.{ext}`
+	config.Http.ConnectTimeout = `5s`
+	config.Http.UserAgent = "Test\t1.0 \u00e9"
+	config.Http.SplitThreshold = `8M`
+	config.RateLimit = RateLimitConfig{Rate: `512K`, Burst: `1M`}
+	config.Server.MaxTasks = 3
+	config.Headers = map[string]string{`Referer`: `https://example.com/`, `X-Token`: `a "b" \c`}
+	config.HeaderProfiles = HeaderProfiles{`my site`: &HeaderProfile{Host: `(.+\.)?example\.com`,
+		Headers: map[string]string{`Origin`: `https://example.com`}}}
+	config.Rewrite = []string{`host:a.com => b.com`, `^http://(.+)$ => https://$1`}
+	for _, config := range []*Config{DefaultConfig(), config} {
+		loaded := loadWritten(t, config)
+		data, _ := json.Marshal(config)
+		loadedData, _ := json.Marshal(loaded)
+		if !bytes.Equal(loadedData, data) {
+			t.Errorf("LoadConfig() = %s, want %s", loadedData, data)
+		}
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv(`HLSDL_RETRIES`, `9`)
+	t.Setenv(`HLSDL_HTTP_CONNECT_TIMEOUT`, `2s`)
+	config := DefaultConfig()
+	config.Retries = 1
+	config.Http.ConnectTimeout = `10s`
+	loaded := loadWritten(t, config)
+	if loaded.Retries != 9 || loaded.Http.ConnectTimeout != `2s` || loaded.HttpOptions().ConnectTimeout.Seconds() != 2 {
+		t.Errorf("LoadConfig() = %+v, want the environment over the file", loaded)
+	}
+
+	t.Setenv(`HLSDL_RATELIMIT_RATE`, `fast`)
+	filename := filepath.Join(t.TempDir(), `config.toml`)
+	if err := os.WriteFile(filename, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(filename); !errors.Is(err, ErrConfig) {
+		t.Errorf("LoadConfig() with a bad rate = %v, want %v", err, ErrConfig)
+	}
+}
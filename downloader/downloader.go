@@ -1,16 +1,41 @@
 package downloader
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/vvampirius/hls-downloader/playlist"
+	"github.com/vvampirius/hls-downloader/webvtt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+var (
+	ErrCancelled  = errors.New(`cancelled`)
+	ErrHttpStatus = errors.New(`unexpected HTTP status`)
+)
+
+// segmentSource gives segments one by one, nil when there are no more.
+type segmentSource interface {
+	GetSegment() (*playlist.Segment, error)
+}
+
 type Downloader struct {
+	AlternateHosts []string // hosts serving the same URLs to fail over to
+	AudioOnly      bool     // download an audio-only variant or rendition, or the lowest bandwidth variant with audio
+	BaseUrl        string   // URIs are resolved against it instead of the playlist URL (a URL or a directory)
+	ClipDuration   time.Duration
+	ClipEnd        time.Duration
+	ClipPrecise    bool
+	ClipStart      time.Duration
 	CurrentSegment struct {
 		Num      int
 		GotBytes int64
@@ -20,46 +45,175 @@ type Downloader struct {
 	DownloadedDuration float32
 	Error              error
 	Finished           bool
+	Fmp4               bool
 	GotBytes           int64
+	HttpOptions        HttpOptions
+	ManifestFilename   string // the manifest of a successful Download is written there, empty - none
+	MaxHostConnections int    // per host, 0 - unlimited
+	MirrorVariants     bool
+	OnProgress         func(event ProgressEvent) // called from its own goroutine, intermediate events may be skipped
 	Playlist           *playlist.Playlist
+	ProbeSamples       int // segments Probe requests the size of to estimate the size of the stream, 0 - none
+	PropagateQuery     bool
+	Refresher          Refresher // called on 401 and 403 for fresh URLs or headers, nil - none
+	RateLimiter        *RateLimiter
+	Retries            int
+	RetryDelay         time.Duration
+	Rewriter           *Rewriter
+	SinkFallback       string
+	SinkName           string
+	SinkOptions        SinkOptions
+	SizeTolerance      float64
+	SplitParts         int   // a segment of SplitThreshold bytes or larger is downloaded in this many parallel ranges
+	SplitThreshold     int64 // 0 - segments aren't split
 	Started            bool
+	Subtitles          string // subtitle rendition to download: LANGUAGE, NAME, 'default' or a playlist URL; empty - none
+	SubtitlesFilename  string // the subtitles file kept next to the output, set when the download is finished
+	SubtitlesFormat    string // vtt (default) or srt
+	SubtitlesMux       bool   // mux the subtitles into the output with ffmpeg instead of keeping the file
+	Validate           bool
+
+	attempt              int
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	client               *http.Client
+	clientOnce           sync.Once
+	failover             *failover
+	firstPts             int64 // of the first media segment, for the subtitles
+	clipSegmentsCount    int
+	clipSegmentsDuration float32
+	lastInit             []byte
+	local                bool          // file:// URLs are allowed
+	outputDuration       time.Duration // of the output timeline in the playlist one, 0 - till the end
+	outputFilename       string
+	outputStart          time.Duration
+	outputTrim           time.Duration // cut from the first segment by the sink
+	phase                Phase
+	playlistUrl          string
+	progress             *progressNotifier
+	retries              int
+	sinkFallbackError    error  // why SinkName couldn't be opened if SinkFallback is used
+	sinkUsed             string // SinkName or SinkFallback
+	startedAt            time.Time
+	subtitlesLanguage    string
+	subtitlesUrl         string
+	transport            *http.Transport // shared with the other downloads (see Config.NewDownloader), nil - its own
+	rateMeter            rateMeter
+	receivedBytes        int64 // including the bytes of failed attempts
+	refreshedHeaders     map[string]string
+	refreshedQuery       string
+	refreshedSegments    map[int]string // media sequence number - segment URL
+	requestHeaders       map[string]string
+	segmentStats         segmentStatsList
+	validatedBytes       int64
+	validatedDuration    float32
+	variant              *playlist.Variant
+	variantUrl           string // the media playlist
+}
+
+// httpClient returns the client shared by the requests of the download, so MaxHostConnections is kept. A local
+// download gets its own transport even if there is a shared one, as only it may read file:// URLs.
+func (downloader *Downloader) httpClient() *http.Client {
+	downloader.clientOnce.Do(func() {
+		if downloader.transport != nil && !downloader.local {
+			downloader.client = &http.Client{Transport: downloader.transport}
+			return
+		}
+		downloader.client = newHttpClient(downloader.local, downloader.MaxHostConnections, downloader.HttpOptions)
+	})
+	return downloader.client
 }
 
-func (downloader *Downloader) downloadChunk(notifyChan chan *Downloader, chunkUrl string, requestHeaders map[string]string, output io.Writer) error {
-	request, err := http.NewRequest(http.MethodGet, chunkUrl, nil)
+func (downloader *Downloader) get(chunkUrl string, requestHeaders map[string]string) (*http.Response, error) {
+	return downloader.getWithContext(downloader.ctx, chunkUrl, requestHeaders)
+}
+
+func (downloader *Downloader) getWithContext(ctx context.Context, chunkUrl string,
+	requestHeaders map[string]string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, chunkUrl, nil)
 	if err != nil {
 		ErrorLog.Println(err.Error())
-		return err
-	}
-	if requestHeaders != nil {
-		for k, v := range requestHeaders {
-			request.Header.Set(k, v)
-		}
+		return nil, err
 	}
-	client := http.Client{}
-	response, err := client.Do(request)
+	downloader.setHeaders(request, requestHeaders)
+	response, err := downloader.httpClient().Do(request)
 	if err != nil {
 		ErrorLog.Println(err)
-		return err
+		return nil, err
 	}
-	defer response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		err := errors.New(fmt.Sprintf("%s %s", chunkUrl, response.Status))
+	return response, nil
+}
+
+// downloadChunk downloads the resource and returns it with its Content-Type and the response header. If the
+// connection drops and the server accepts ranges, the download is resumed from the last received byte (up to Retries
+// times).
+func (downloader *Downloader) downloadChunk(chunkUrl string, requestHeaders map[string]string,
+	stats *SegmentStats) ([]byte, string, http.Header, error) {
+	started := time.Now()
+	response, err := downloader.get(chunkUrl, requestHeaders)
+	if err != nil {
+		return nil, ``, nil, err
+	}
+	stats.Ttfb = time.Since(started)
+	stats.Status = response.StatusCode
+	stats.Response = responseMetadata(response.Header)
+	if response.StatusCode != http.StatusOK && !(response.StatusCode == http.StatusPartialContent &&
+		requestHeaders[`Range`] != ``) {
+		response.Body.Close()
+		err := errors.Join(ErrHttpStatus, errors.New(fmt.Sprintf("%s %s", chunkUrl, response.Status)))
 		ErrorLog.Println(err.Error())
-		return err
+		return nil, ``, nil, err
 	}
+	downloader.CurrentSegment.Size = 0
 	if contentLength := response.Header.Get(`Content-Length`); contentLength != `` {
 		if n, err := strconv.ParseInt(contentLength, 10, 64); err == nil {
 			downloader.CurrentSegment.Size = n
 		}
 	}
-	copyErrChan := make(chan error, 0)
+	contentType := response.Header.Get(`Content-Type`)
+	if err := ValidateContentType(contentType); err != nil {
+		response.Body.Close()
+		return nil, contentType, nil, err
+	}
+	output := bytes.NewBuffer(make([]byte, 0, downloader.CurrentSegment.Size))
+	first := response
+	for {
+		err := downloader.readBody(response.Body, output)
+		response.Body.Close()
+		if err == nil {
+			break
+		}
+		if downloader.ctx.Err() != nil || output.Len() == 0 || stats.Resumes >= downloader.Retries ||
+			first.Header.Get(`Accept-Ranges`) != `bytes` {
+			return nil, contentType, nil, err
+		}
+		ErrorLog.Printf("Resuming %s from byte %d: %s\n", chunkUrl, output.Len(), err.Error())
+		stats.Resumes++
+		if response, err = downloader.resume(chunkUrl, requestHeaders, first, int64(output.Len())); err != nil {
+			return nil, contentType, nil, err
+		}
+	}
+	if size := downloader.CurrentSegment.Size; size > 0 && int64(output.Len()) != size {
+		return nil, contentType, nil, errors.Join(ErrTruncatedSegment,
+			errors.New(fmt.Sprintf("got %d of %d bytes", output.Len(), size)))
+	}
+	return output.Bytes(), contentType, first.Header, nil
+}
+
+// readBody reads the body into the output till its end.
+func (downloader *Downloader) readBody(r io.Reader, output *bytes.Buffer) error {
+	body := downloader.RateLimiter.Reader(downloader.ctx, r)
+	// the body is read in another goroutine to notify about the progress while it stalls, the counters are updated
+	// here only
+	type copyResult struct {
+		n   int64
+		err error
+	}
+	copyChan := make(chan copyResult, 0)
 	go func() {
 		for {
-			n, err := io.CopyN(output, response.Body, 1048576)
-			downloader.CurrentSegment.GotBytes = downloader.CurrentSegment.GotBytes + n
-			downloader.GotBytes = downloader.GotBytes + n
-			copyErrChan <- err
+			n, err := io.CopyN(output, body, 1048576)
+			copyChan <- copyResult{n: n, err: err}
 			if err != nil {
 				return
 			}
@@ -67,83 +221,541 @@ func (downloader *Downloader) downloadChunk(notifyChan chan *Downloader, chunkUr
 	}()
 	for {
 		select {
-		case err := <-copyErrChan:
-			if err == nil {
-				notifyChan <- downloader
-			} else if err == io.EOF {
-				notifyChan <- downloader
+		case result := <-copyChan:
+			downloader.CurrentSegment.GotBytes = downloader.CurrentSegment.GotBytes + result.n
+			downloader.GotBytes = downloader.GotBytes + result.n
+			downloader.receivedBytes = downloader.receivedBytes + result.n
+			downloader.notify()
+			if result.err == io.EOF {
 				return nil
-			} else {
-				return err
+			}
+			if result.err != nil {
+				return result.err
 			}
 		case <-time.After(time.Second):
-			notifyChan <- downloader
+			downloader.notify()
 		}
 	}
 }
 
-func (downloader *Downloader) downloadRoutine(notifyChan chan *Downloader, playlist *playlist.Playlist, output io.WriteCloser,
-	baseUrl string, requestHeaders map[string]string) {
-	defer close(notifyChan)
-	defer output.Close()
+// downloadSegment downloads and validates the segment (or the byteRange of it), retrying on any failure. Only
+// complete segments are returned, so a broken attempt never gets into the output. The container of an encrypted one
+// isn't validated. The sequence is the media sequence number of the segment (of the one the init section is for if
+// isInit), -1 for other resources.
+func (downloader *Downloader) downloadSegment(chunkUrl string, sequence int, isInit bool, byteRange *playlist.ByteRange,
+	duration float32, encrypted bool, requestHeaders map[string]string) ([]byte, error) {
+	if byteRange != nil {
+		headers := make(map[string]string)
+		for k, v := range requestHeaders {
+			headers[k] = v
+		}
+		headers[`Range`] = byteRange.Header()
+		requestHeaders = headers
+	}
+	stats := SegmentStats{Num: downloader.CurrentSegment.Num, Url: chunkUrl, Duration: duration, Started: time.Now()}
+	defer func() {
+		downloader.segmentStats.add(stats)
+	}()
+	var err error
+	refreshed := false
+	// every source is tried at least once, the next source at once and the same one after the delay
+	attempts := max(downloader.Retries+1, downloader.failover.Count())
+	startSource := downloader.failover.Index()
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if downloader.ctx.Err() != nil {
+				stats.Error = downloader.ctx.Err().Error()
+				return nil, downloader.ctx.Err()
+			}
+			ErrorLog.Printf("Retry %d/%d of %s\n", attempt, attempts-1, chunkUrl)
+			downloader.retries++
+			downloader.phase = PhaseRetry
+			if downloader.failover.Index() == startSource {
+				select {
+				case <-time.After(downloader.RetryDelay * time.Duration(attempt)):
+				case <-downloader.ctx.Done():
+					stats.Error = downloader.ctx.Err().Error()
+					return nil, downloader.ctx.Err()
+				}
+			}
+		}
+		stats.Attempts = attempt + 1
+		stats.Status, stats.Ttfb, stats.Resumes, stats.Parts, stats.Response = 0, 0, 0, 0, nil
+		attemptStarted := time.Now()
+		downloader.GotBytes = downloader.GotBytes - downloader.CurrentSegment.GotBytes
+		downloader.CurrentSegment.GotBytes = 0
+		downloader.attempt = attempt
+		downloader.notify()
+		var data []byte
+		var contentType string
+		attemptUrl, e := downloader.sourceUrl(chunkUrl, sequence, isInit, requestHeaders)
+		if e == nil {
+			stats.Url = attemptUrl
+			data, contentType, e = downloader.fetch(attemptUrl, byteRange, requestHeaders, &stats)
+		}
+		stats.Elapsed = time.Since(attemptStarted)
+		stats.Size = int64(len(data))
+		if e == nil && byteRange != nil && int64(len(data)) != byteRange.Length {
+			e = errors.Join(ErrTruncatedSegment, errors.New(fmt.Sprintf("got %d bytes of %s range", len(data),
+				byteRange.String())))
+		}
+		if e == nil && downloader.Validate {
+			e = ValidateSegment(data, contentType, encrypted)
+			if e == nil && duration > 0 {
+				e = downloader.validateSize(len(data), duration)
+			}
+		}
+		if e != nil {
+			err = &SegmentError{Url: attemptUrl, Err: e}
+			ErrorLog.Println(err.Error())
+			stats.Error = e.Error()
+			if downloader.ctx.Err() == nil && downloader.Refresher != nil && !refreshed &&
+				(stats.Status == http.StatusUnauthorized || stats.Status == http.StatusForbidden) {
+				// the URLs (or tokens) have probably expired, the attempt is repeated with the fresh ones
+				refreshed = true
+				if downloader.refresh(attemptUrl, resourceSequence(sequence, isInit), stats.Status,
+					requestHeaders) == nil {
+					attempt--
+					continue
+				}
+			}
+			if downloader.ctx.Err() == nil {
+				downloader.failover.Failed()
+			}
+			continue
+		}
+		stats.Error = ``
+		stats.Sha256 = sha256Hex(data)
+		return data, nil
+	}
+	downloader.GotBytes = downloader.GotBytes - downloader.CurrentSegment.GotBytes
+	return nil, err
+}
+
+// writeInit writes the init section to the sink unless it is the same as the one written last.
+func (downloader *Downloader) writeInit(sink Sink, info SegmentInfo, data []byte) error {
+	if bytes.Equal(data, downloader.lastInit) {
+		return nil
+	}
+	info.IsMap = true
+	if err := sink.WriteSegment(info, data); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	downloader.lastInit = data
+	return nil
+}
+
+// writeSegment writes the media segment to the sink, the init section first if the segment carries its own one.
+func (downloader *Downloader) writeSegment(sink Sink, info SegmentInfo, data []byte) error {
+	if init, media := SplitInit(data); init != nil {
+		downloader.Fmp4 = true
+		if err := downloader.writeInit(sink, info, init); err != nil {
+			return err
+		}
+		data = media
+	}
+	if err := sink.WriteSegment(info, data); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	downloader.validatedBytes = downloader.validatedBytes + int64(len(data))
+	downloader.validatedDuration = downloader.validatedDuration + info.Duration
+	return nil
+}
+
+// validateSize compares the segment size with the average bytes per second of media of the segments so far.
+func (downloader *Downloader) validateSize(size int, duration float32) error {
+	if downloader.SizeTolerance <= 0 || duration <= 0 || downloader.validatedDuration <= 0 {
+		return nil
+	}
+	expected := float64(downloader.validatedBytes) / float64(downloader.validatedDuration) * float64(duration)
+	if deviation := math.Abs(float64(size)-expected) / expected; deviation > downloader.SizeTolerance {
+		return errors.Join(ErrSegmentSize, errors.New(fmt.Sprintf("got %d bytes but expect about %.0f", size, expected)))
+	}
+	return nil
+}
+
+// finish closes the sink and reports the final state. A failed Close (e.g. ffmpeg exited with an error or the
+// remuxer couldn't finalize the file) is an error of the whole download. A cancelled download aborts the sink if
+// it can be aborted.
+func (downloader *Downloader) finish(sink Sink, err error) {
+	aborter, abortable := sink.(Aborter)
+	if downloader.ctx.Err() != nil {
+		err = ErrCancelled
+	}
+	if err == ErrCancelled && abortable {
+		aborter.Abort()
+	} else if closeErr := sink.Close(); closeErr != nil {
+		ErrorLog.Println(closeErr.Error())
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil && downloader.subtitlesUrl != `` {
+		err = downloader.downloadSubtitles()
+	}
+	if err == nil && downloader.ManifestFilename != `` {
+		err = downloader.writeManifest()
+	}
+	downloader.setResult(err)
+	downloader.cancel()
+	downloader.progress.close()
+}
+
+func (downloader *Downloader) downloadRoutine(segments segmentSource, sink Sink,
+	baseUrl *url.URL, requestHeaders map[string]string) {
+	if aborter, ok := sink.(Aborter); ok {
+		// a write to the sink may block (e.g. on a slow ffmpeg), so it is aborted right on cancel
+		go func() {
+			<-downloader.ctx.Done()
+			if !downloader.Progress().Done() {
+				aborter.Abort()
+			}
+		}()
+	}
+	var lastMap *playlist.Map
 	for {
-		segment, err := playlist.GetSegment()
+		if downloader.ctx.Err() != nil {
+			downloader.finish(sink, ErrCancelled)
+			return
+		}
+		segment, err := segments.GetSegment()
 		if err != nil {
-			downloader.Error = err
-			notifyChan <- downloader
+			downloader.finish(sink, err)
 			return
 		}
 		if segment == nil {
-			downloader.Finished = true
-			notifyChan <- downloader
+			downloader.finish(sink, nil)
 			return
 		}
-		if !segment.IsMap {
-			downloader.CurrentSegment.Num++
+		if segment.Map != nil && !segment.Map.Equal(lastMap) {
+			downloader.Fmp4 = true
+			downloader.CurrentSegment.GotBytes = 0
+			downloader.CurrentSegment.Url = segment.Map.Uri
+			downloader.phase = PhaseInit
+			downloader.notify()
+			mapUrl, err := MakeChunkUrl(baseUrl, segment.Map.Uri, downloader.PropagateQuery)
+			if err != nil {
+				downloader.finish(sink, err)
+				return
+			}
+			mapUrl = downloader.Rewriter.Rewrite(mapUrl)
+			data, err := downloader.downloadSegment(mapUrl, segment.Sequence, true, segment.Map.ByteRange, 0,
+				segment.Key.Encrypted(),
+				requestHeaders)
+			if err != nil {
+				downloader.finish(sink, err)
+				return
+			}
+			info := SegmentInfo{Num: downloader.CurrentSegment.Num, Url: mapUrl}
+			if err := downloader.writeInit(sink, info, data); err != nil {
+				downloader.finish(sink, err)
+				return
+			}
+			lastMap = segment.Map
 		}
+		downloader.CurrentSegment.Num++
 		downloader.CurrentSegment.GotBytes = 0
 		downloader.CurrentSegment.Url = segment.Uri
-		notifyChan <- downloader
-		chunkUrl, err := MakeChunkUrl(baseUrl, segment.Uri)
+		downloader.phase = PhaseSegment
+		downloader.notify()
+		chunkUrl, err := MakeChunkUrl(baseUrl, segment.Uri, downloader.PropagateQuery)
 		if err != nil {
-			downloader.Finished = true
-			notifyChan <- downloader
+			downloader.finish(sink, err)
 			return
 		}
-		if err := downloader.downloadChunk(notifyChan, chunkUrl, requestHeaders, output); err != nil {
-			downloader.Error = err
-			notifyChan <- downloader
+		chunkUrl = downloader.Rewriter.Rewrite(chunkUrl)
+		data, err := downloader.downloadSegment(chunkUrl, segment.Sequence, false, segment.ByteRange, segment.Duration,
+			segment.Key.Encrypted(), requestHeaders)
+		if err != nil {
+			downloader.finish(sink, err)
+			return
+		}
+		info := SegmentInfo{Num: downloader.CurrentSegment.Num, Url: chunkUrl, Duration: segment.Duration}
+		if downloader.CurrentSegment.Num == 1 && downloader.subtitlesUrl != `` {
+			downloader.firstPts = firstPts(data)
+		}
+		if err := downloader.writeSegment(sink, info, data); err != nil {
+			downloader.finish(sink, err)
 			return
 		}
 		downloader.DownloadedDuration = downloader.DownloadedDuration + segment.Duration
 	}
 }
 
-func (downloader *Downloader) Download(playlistUrl, outputFilename string, useFfmpeg bool, requestHeaders map[string]string) (chan *Downloader, error) {
-	if downloader.Started {
-		err := errors.New(`already started`)
-		ErrorLog.Println(err.Error())
+// openSink opens the SinkName sink, or the SinkFallback one if that fails. The fallback is reported by the
+// progress events.
+func (downloader *Downloader) openSink(outputFilename string) (Sink, error) {
+	options := downloader.SinkOptions
+	options.Filename = outputFilename
+	if options.FfmpegProgress == nil {
+		options.FfmpegProgress = downloader.progress.setFfmpeg
+	}
+	sink, err := NewSink(downloader.SinkName, options)
+	if err == nil {
+		downloader.sinkUsed = downloader.SinkName
+		return sink, nil
+	}
+	if downloader.SinkFallback == `` || downloader.SinkFallback == downloader.SinkName {
 		return nil, err
 	}
-	downloader.Started = true
-	output, err := GetOutput(outputFilename, useFfmpeg)
-	if err != nil {
+	sink, fallbackErr := NewSink(downloader.SinkFallback, options)
+	if fallbackErr != nil {
+		return nil, errors.Join(err, fallbackErr)
+	}
+	downloader.sinkUsed = downloader.SinkFallback
+	downloader.sinkFallbackError = err
+	return sink, nil
+}
+
+// Download downloads the playlist into the sink in its own goroutine. The progress events are sent to the returned
+// channel (closed after the final event) and to OnProgress; a slow consumer misses intermediate events but never
+// stalls the download.
+func (downloader *Downloader) Download(playlistUrl, outputFilename string, requestHeaders map[string]string) (chan ProgressEvent, error) {
+	if err := downloader.start(); err != nil {
+		return nil, err
+	}
+	if err := downloader.checkSubtitles(outputFilename); err != nil {
+		downloader.stop(err)
 		return nil, err
 	}
-	baseUrl, err := GetBaseURL(playlistUrl)
+	sink, err := downloader.openSink(outputFilename)
 	if err != nil {
+		downloader.stop(err)
 		return nil, err
 	}
-	playlist, err := GetPlaylistByUrl(playlistUrl, requestHeaders)
+	downloader.local = IsLocal(playlistUrl) || (downloader.BaseUrl != `` && IsLocal(downloader.BaseUrl))
+	downloader.playlistUrl, downloader.outputFilename = playlistUrl, outputFilename
+	downloader.requestHeaders = requestHeaders
+	playlist, baseUrl, err := downloader.loadPlaylist(playlistUrl, requestHeaders)
 	if err != nil {
+		if aborter, ok := sink.(Aborter); ok {
+			aborter.Abort()
+		} else {
+			sink.Close()
+		}
+		downloader.stop(err)
 		return nil, err
 	}
 	downloader.Playlist = playlist
-	notifyChan := make(chan *Downloader, 1)
-	go downloader.downloadRoutine(notifyChan, playlist, output, baseUrl, requestHeaders)
-	return notifyChan, nil
+	var segments segmentSource = playlist
+	if downloader.isClip() {
+		list, trimStart, trimDuration, err := downloader.selectSegments(playlist)
+		if err != nil {
+			if aborter, ok := sink.(Aborter); ok {
+				aborter.Abort()
+			} else {
+				sink.Close()
+			}
+			downloader.stop(err)
+			return nil, err
+		}
+		segments = list
+		downloader.outputStart = downloader.ClipStart - trimStart
+		downloader.outputDuration = time.Duration(float64(downloader.clipSegmentsDuration) * float64(time.Second))
+		if trimmer, ok := sink.(Trimmer); ok && downloader.ClipPrecise {
+			trimmer.Trim(trimStart, trimDuration)
+			downloader.outputStart, downloader.outputDuration = downloader.ClipStart, trimDuration
+			downloader.outputTrim = trimStart
+		} else if downloader.ClipPrecise {
+			DebugLog.Printf("'%s' sink can't trim, the clip is cut by segments\n", downloader.sinkUsed)
+		}
+	}
+	downloader.phase = PhaseStarted
+	downloader.notify()
+	go downloader.downloadRoutine(segments, sink, baseUrl, requestHeaders)
+	return downloader.progress.events, nil
+}
+
+// fetchPlaylist downloads the playlist text and returns the URL it was finally served from.
+func (downloader *Downloader) fetchPlaylist(playlistUrl string, requestHeaders map[string]string) ([]byte, *url.URL, error) {
+	playlistUrl = downloader.Rewriter.Rewrite(playlistUrl)
+	if playlistUrl == `-` {
+		ErrorLog.Println(ErrStdinPlaylist.Error())
+		return nil, nil, ErrStdinPlaylist
+	}
+	if IsLocal(playlistUrl) {
+		u, err := LocalUrl(playlistUrl)
+		if err != nil {
+			return nil, nil, err
+		}
+		playlistUrl = u.String()
+	}
+	request, err := http.NewRequestWithContext(downloader.ctx, http.MethodGet, playlistUrl, nil)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, nil, err
+	}
+	downloader.setHeaders(request, requestHeaders)
+	response, err := downloader.httpClient().Do(request)
+	if err != nil {
+		ErrorLog.Println(err)
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err := errors.Join(ErrHttpStatus, errors.New(fmt.Sprintf("%s %s", playlistUrl, response.Status)))
+		ErrorLog.Println(err.Error())
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte(`#EXTM3U`)) {
+		return nil, nil, playlist.ErrNoEXTM3U
+	}
+	if downloader.BaseUrl != `` {
+		baseUrl, err := downloader.baseUrl()
+		return data, baseUrl, err
+	}
+	return data, response.Request.URL, nil
+}
+
+// loadPlaylist loads the media playlist. Of a master playlist the variant with the highest bandwidth is taken, its
+// redundant variants (the same stream from other locations) are tried if it fails to load and become failover
+// sources for the segments.
+func (downloader *Downloader) loadPlaylist(playlistUrl string, requestHeaders map[string]string) (*playlist.Playlist, *url.URL, error) {
+	var data []byte
+	var baseUrl *url.URL
+	var err error
+	downloader.variantUrl = playlistUrl
+	if playlistUrl == `-` {
+		if data, err = io.ReadAll(os.Stdin); err != nil {
+			ErrorLog.Println(err.Error())
+			return nil, nil, err
+		}
+		if downloader.BaseUrl != `` {
+			baseUrl, err = downloader.baseUrl()
+		} else {
+			baseUrl, err = stdinBaseUrl()
+		}
+	} else {
+		data, baseUrl, err = downloader.fetchPlaylist(playlistUrl, requestHeaders)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	redundant := make([]string, 0)
+	if downloader.Subtitles != `` && !playlist.IsMaster(data) && !strings.Contains(downloader.Subtitles, `://`) {
+		err := errors.Join(ErrNoSubtitles, errors.New(`not a master playlist, give the subtitle playlist URL`))
+		ErrorLog.Println(err.Error())
+		return nil, nil, err
+	}
+	if playlist.IsMaster(data) {
+		masterData, masterBaseUrl := data, baseUrl
+		group := downloader.variantGroup(data)
+		if group == nil {
+			ErrorLog.Println(playlist.ErrNoSegments.Error())
+			return nil, nil, playlist.ErrNoSegments
+		}
+		variantUrls := make([]string, 0, len(group))
+		for _, variant := range group {
+			variantUrl, err := MakeChunkUrl(baseUrl, variant.Uri, downloader.PropagateQuery)
+			if err != nil {
+				return nil, nil, err
+			}
+			variantUrls = append(variantUrls, variantUrl)
+		}
+		var errs error
+		for i, variantUrl := range variantUrls {
+			variantData, variantBaseUrl, err := downloader.fetchPlaylist(variantUrl, requestHeaders)
+			if err != nil {
+				errs = errors.Join(errs, err)
+				continue
+			}
+			DebugLog.Printf("Variant %s (%d bps), %d redundant\n", variantUrl, group[i].Bandwidth, len(variantUrls)-1)
+			data, baseUrl = variantData, variantBaseUrl
+			downloader.variantUrl, downloader.variant = variantUrl, &group[i]
+			redundant = append(append(redundant, variantUrls[i+1:]...), variantUrls[:i]...)
+			errs = nil
+			break
+		}
+		if errs != nil {
+			return nil, nil, errs
+		}
+		if downloader.Subtitles != `` {
+			if err := downloader.selectSubtitles(masterData, masterBaseUrl); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else if downloader.Subtitles != `` {
+		downloader.subtitlesUrl = downloader.Subtitles
+	}
+	if downloader.failover, err = newFailover(redundant, downloader.AlternateHosts); err != nil {
+		return nil, nil, err
+	}
+	return playlist.Parse(io.NopCloser(bytes.NewReader(data))), baseUrl, nil
+}
+
+// baseUrl parses BaseUrl.
+func (downloader *Downloader) baseUrl() (*url.URL, error) {
+	if IsLocal(downloader.BaseUrl) {
+		return LocalUrl(downloader.BaseUrl)
+	}
+	baseUrl, err := url.Parse(downloader.BaseUrl)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return baseUrl, nil
+}
+
+func (downloader *Downloader) start() error {
+	if downloader.Started {
+		err := errors.New(`already started`)
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	downloader.Started = true
+	downloader.startedAt = time.Now()
+	downloader.firstPts = webvtt.NoTimestamp
+	downloader.progress = newProgressNotifier(downloader.OnProgress)
+	downloader.ctx, downloader.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// stop ends the download that couldn't be started.
+func (downloader *Downloader) stop(err error) {
+	downloader.setResult(err)
+	downloader.cancel()
+	downloader.progress.close()
+}
+
+// setResult publishes the final event.
+func (downloader *Downloader) setResult(err error) {
+	switch {
+	case err == ErrCancelled:
+		downloader.phase = PhaseCancelled
+	case err != nil:
+		downloader.phase = PhaseFailed
+	default:
+		downloader.phase = PhaseFinished
+	}
+	if err != nil {
+		downloader.Error = err
+	} else {
+		downloader.Finished = true
+	}
+	downloader.notify()
+}
+
+// Cancel stops the download: the current request is interrupted, the sink is aborted (ffmpeg is killed) and Error
+// becomes ErrCancelled.
+func (downloader *Downloader) Cancel() {
+	if downloader.cancel != nil {
+		downloader.cancel()
+	}
 }
 
 func NewDownloader() *Downloader {
-	return &Downloader{}
+	return &Downloader{
+		ProbeSamples: ProbeSampleSegments,
+		Retries:      3,
+		RetryDelay:   time.Second,
+		SinkName:     `ffmpeg`,
+		Validate:     true,
+	}
 }
@@ -0,0 +1,244 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"io"
+	"net/url"
+	"strings"
+)
+
+var ErrNoAlternateSegment = errors.New(`no such segment in the redundant playlist`)
+
+// failoverSource is a location to download the segments from: the same URLs on another host, or a redundant variant
+// playlist whose segments are matched by the media sequence number.
+type failoverSource struct {
+	Host     string // scheme://host[:port], empty - as is
+	Playlist string
+
+	segments map[int]string // media sequence number - segment URL
+	inits    map[int]string // media sequence number - URL of the init section of the segment
+	loaded   bool
+	Failures int
+}
+
+func (source *failoverSource) String() string {
+	if source.Playlist != `` {
+		return source.Playlist
+	}
+	if source.Host == `` {
+		return `primary`
+	}
+	return source.Host
+}
+
+// failover switches the download to the next source when the current one fails, the healthy source is kept for the
+// next segments.
+type failover struct {
+	sources   []*failoverSource
+	current   int
+	Failovers int
+}
+
+func (failover *failover) Current() *failoverSource {
+	return failover.sources[failover.current]
+}
+
+// Index returns the index of the current source.
+func (failover *failover) Index() int {
+	if failover == nil {
+		return 0
+	}
+	return failover.current
+}
+
+// Count returns the number of the sources, so a segment is tried at each of them at least.
+func (failover *failover) Count() int {
+	if failover == nil {
+		return 1
+	}
+	return len(failover.sources)
+}
+
+// Failed marks the current source failed and switches to the next one.
+func (failover *failover) Failed() {
+	if failover == nil || len(failover.sources) < 2 {
+		return
+	}
+	source := failover.Current()
+	source.Failures++
+	failover.current = (failover.current + 1) % len(failover.sources)
+	failover.Failovers++
+	ErrorLog.Printf("Failover from %s to %s\n", source, failover.Current())
+}
+
+// normalizeHost makes scheme://host from 'host' or a URL.
+func normalizeHost(host string) (string, error) {
+	if !strings.Contains(host, `://`) {
+		host = `https://` + host
+	}
+	u, err := url.Parse(host)
+	if err != nil || u.Host == `` {
+		err = errors.New(fmt.Sprintf("bad host '%s'", host))
+		ErrorLog.Println(err.Error())
+		return ``, err
+	}
+	return u.Scheme + `://` + u.Host, nil
+}
+
+// replaceHost returns the URL on the host (scheme://host).
+func replaceHost(resourceUrl, host string) (string, error) {
+	u, err := url.Parse(resourceUrl)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return ``, err
+	}
+	h, err := url.Parse(host)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return ``, err
+	}
+	u.Scheme, u.Host = h.Scheme, h.Host
+	return u.String(), nil
+}
+
+// newFailover makes the sources: the primary one, the redundant variant playlists and the alternate hosts. It is
+// nil if there are no alternatives.
+func newFailover(redundant []string, alternateHosts []string) (*failover, error) {
+	if len(redundant) == 0 && len(alternateHosts) == 0 {
+		return nil, nil
+	}
+	sources := []*failoverSource{{}}
+	for _, playlistUrl := range redundant {
+		sources = append(sources, &failoverSource{Playlist: playlistUrl})
+	}
+	seen := make(map[string]bool)
+	for _, host := range alternateHosts {
+		host, err := normalizeHost(host)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[host] {
+			seen[host] = true
+			sources = append(sources, &failoverSource{Host: host})
+		}
+	}
+	return &failover{sources: sources}, nil
+}
+
+// variantGroup chooses the variant of the master playlist to download with its redundant ones: the highest bandwidth
+// one, or for AudioOnly the highest bandwidth audio-only variant, the DEFAULT (or the first) audio rendition or the
+// lowest bandwidth variant with audio, whichever is found first. A rendition is returned as a variant with its URI.
+func (downloader *Downloader) variantGroup(data []byte) []playlist.Variant {
+	variants := playlist.ParseMaster(data)
+	if !downloader.AudioOnly {
+		return playlist.BestGroup(playlist.GroupRedundant(variants))
+	}
+	audioOnly, withAudio := make([]playlist.Variant, 0), make([]playlist.Variant, 0)
+	for _, variant := range variants {
+		if variant.IsAudioOnly() {
+			audioOnly = append(audioOnly, variant)
+		}
+		if variant.HasAudio() {
+			withAudio = append(withAudio, variant)
+		}
+	}
+	if group := playlist.BestGroup(playlist.GroupRedundant(audioOnly)); group != nil {
+		DebugLog.Printf("Audio-only variant %s\n", group[0].Uri)
+		return group
+	}
+	var rendition *playlist.Rendition
+	for _, r := range playlist.ParseRenditions(data) {
+		if r.Type == `AUDIO` && r.Uri != `` && (rendition == nil || (r.Default && !rendition.Default)) {
+			rendition = &r
+		}
+	}
+	if rendition != nil {
+		DebugLog.Printf("Audio rendition '%s' (%s) %s\n", rendition.Name, rendition.Language, rendition.Uri)
+		return []playlist.Variant{{Uri: rendition.Uri, Codecs: rendition.Attributes[`CODECS`],
+			Attributes: rendition.Attributes}}
+	}
+	group := playlist.WorstGroup(playlist.GroupRedundant(withAudio))
+	if group != nil {
+		DebugLog.Printf("The lowest bandwidth variant with audio %s\n", group[0].Uri)
+	}
+	return group
+}
+
+// loadRedundant reads the segments of the redundant playlist. It is read again after a failure, so a transient
+// error doesn't take the source out for the rest of the download.
+func (downloader *Downloader) loadRedundant(source *failoverSource, requestHeaders map[string]string) error {
+	if source.loaded {
+		return nil
+	}
+	data, baseUrl, err := downloader.fetchPlaylist(source.Playlist, requestHeaders)
+	if err != nil {
+		return err
+	}
+	segments, inits := make(map[int]string), make(map[int]string)
+	p := playlist.Parse(io.NopCloser(bytes.NewReader(data)))
+	for {
+		segment, err := p.GetSegment()
+		if err != nil {
+			return err
+		}
+		if segment == nil {
+			break
+		}
+		segmentUrl, err := MakeChunkUrl(baseUrl, segment.Uri, downloader.PropagateQuery)
+		if err != nil {
+			return err
+		}
+		segments[segment.Sequence] = downloader.Rewriter.Rewrite(segmentUrl)
+		if segment.Map != nil {
+			initUrl, err := MakeChunkUrl(baseUrl, segment.Map.Uri, downloader.PropagateQuery)
+			if err != nil {
+				return err
+			}
+			inits[segment.Sequence] = downloader.Rewriter.Rewrite(initUrl)
+		}
+	}
+	source.segments, source.inits, source.loaded = segments, inits, true
+	return nil
+}
+
+// resourceSequence is the sequence of the resource for the refresh: -1 for an init section.
+func resourceSequence(sequence int, isInit bool) int {
+	if isInit {
+		return -1
+	}
+	return sequence
+}
+
+// sourceUrl returns the URL of the resource on the current source. The sequence is the media sequence number of
+// the segment (of the one the init section is for if isInit), -1 for other resources. A redundant playlist gives
+// its own URLs of the segments and their init sections, other resources are taken from the primary source.
+func (downloader *Downloader) sourceUrl(resourceUrl string, sequence int, isInit bool,
+	requestHeaders map[string]string) (string, error) {
+	resourceUrl = downloader.refreshedUrl(resourceUrl, resourceSequence(sequence, isInit))
+	if downloader.failover == nil {
+		return resourceUrl, nil
+	}
+	source := downloader.failover.Current()
+	switch {
+	case source.Playlist != `` && sequence >= 0:
+		if err := downloader.loadRedundant(source, requestHeaders); err != nil {
+			return ``, err
+		}
+		urls, name := source.segments, `segment`
+		if isInit {
+			urls, name = source.inits, `init section of`
+		}
+		sourceUrl, ok := urls[sequence]
+		if !ok {
+			return ``, errors.Join(ErrNoAlternateSegment, errors.New(fmt.Sprintf("%s %d in %s", name, sequence,
+				source.Playlist)))
+		}
+		return sourceUrl, nil
+	case source.Host != ``:
+		return replaceHost(resourceUrl, source.Host)
+	}
+	return resourceUrl, nil
+}
@@ -0,0 +1,65 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSourceUrlRedundant(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != `/backup/stream.m3u8` {
+			http.NotFound(w, r)
+			return
+		}
+		// the first load fails for a moment
+		if requests++; requests == 1 {
+			http.Error(w, `busy`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:7\n#EXT-X-MAP:URI=\"hd/init-v2.mp4\"\n" +
+			"#EXTINF:4.0,\nhd/seg7.m4s\n#EXT-X-MAP:URI=\"/shared/init-v3.mp4\"\n#EXTINF:4.0,\nhd/seg8.m4s\n" +
+			"#EXT-X-ENDLIST\n"))
+	}))
+	defer server.Close()
+	downloader := NewDownloader()
+	downloader.ctx = context.Background()
+	downloader.Retries = 0
+	failover, err := newFailover([]string{server.URL + `/backup/stream.m3u8`}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloader.failover = failover
+	failover.Failed()
+
+	if _, err := downloader.sourceUrl(`https://primary.example.com/v/7.m4s`, 7, false, nil); err == nil {
+		t.Fatal(`sourceUrl() with the backup playlist unavailable succeeded`)
+	}
+	tests := []struct {
+		resourceUrl string
+		sequence    int
+		isInit      bool
+		want        string
+	}{
+		{`https://primary.example.com/v/7.m4s`, 7, false, server.URL + `/backup/hd/seg7.m4s`},
+		{`https://primary.example.com/v/init.mp4`, 7, true, server.URL + `/backup/hd/init-v2.mp4`},
+		{`https://primary.example.com/v/init2.mp4`, 8, true, server.URL + `/shared/init-v3.mp4`},
+		// not a resource of the redundant playlist
+		{`https://primary.example.com/subs/0.vtt`, -1, false, `https://primary.example.com/subs/0.vtt`},
+	}
+	for _, test := range tests {
+		u, err := downloader.sourceUrl(test.resourceUrl, test.sequence, test.isInit, nil)
+		if err != nil || u != test.want {
+			t.Errorf("sourceUrl(%s, %d, %t) = %s, %v; want %s", test.resourceUrl, test.sequence, test.isInit, u, err,
+				test.want)
+		}
+	}
+	if _, err := downloader.sourceUrl(`https://primary.example.com/v/9.m4s`, 9, false, nil); err == nil {
+		t.Error(`sourceUrl() of a segment missing in the redundant playlist succeeded`)
+	}
+	if requests != 2 {
+		t.Errorf("the redundant playlist is requested %d times, want 2", requests)
+	}
+}
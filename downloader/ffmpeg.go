@@ -0,0 +1,381 @@
+package downloader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFfmpegProfile = `copy-to-mp4`
+	ffmpegStderrLines    = 20
+)
+
+var (
+	ErrFfmpegKilled         = errors.New(`ffmpeg was killed`)
+	ErrFfmpegNoInput        = errors.New(`nothing was written to ffmpeg`)
+	ErrUnknownFfmpegProfile = errors.New(`unknown ffmpeg profile`)
+
+	FfmpegPath = `ffmpeg` // the executable, looked up in PATH if it has no slashes
+
+	FfmpegProfiles = map[string]FfmpegProfile{
+		`copy-to-mp4`: {
+			Description: `copy streams into MP4`,
+			Ext:         `.mp4`,
+			Args:        []string{`-map`, `0:v?`, `-map`, `0:a?`, `-c`, `copy`, `-f`, `mp4`},
+		},
+		`copy-to-mkv`: {
+			Description: `copy all streams into Matroska`,
+			Ext:         `.mkv`,
+			Args:        []string{`-map`, `0`, `-c`, `copy`, `-f`, `matroska`},
+		},
+		`audio-only-m4a`: {
+			Description: `copy the audio stream into M4A`,
+			Ext:         `.m4a`,
+			Args:        []string{`-map`, `0:a:0`, `-vn`, `-c:a`, `copy`, `-f`, `ipod`},
+		},
+		`audio-only-aac`: {
+			Description: `copy the audio stream into raw ADTS AAC`,
+			Ext:         `.aac`,
+			Args:        []string{`-map`, `0:a:0`, `-vn`, `-c:a`, `copy`, `-f`, `adts`},
+		},
+		`audio-only-mp3`: {
+			Description: `transcode the audio stream to MP3`,
+			Ext:         `.mp3`,
+			Args:        []string{`-map`, `0:a:0`, `-vn`, `-c:a`, `libmp3lame`, `-q:a`, `2`, `-f`, `mp3`},
+		},
+		`transcode-h264-720p`: {
+			Description: `transcode to H.264/AAC no larger than 720p`,
+			Ext:         `.mp4`,
+			Args: []string{`-map`, `0:v:0?`, `-map`, `0:a:0?`, `-vf`, `scale=-2:'min(720,ih)'`, `-c:v`, `libx264`,
+				`-preset`, `veryfast`, `-crf`, `23`, `-c:a`, `aac`, `-b:a`, `128k`, `-movflags`, `+faststart`, `-f`, `mp4`},
+		},
+		`faststart`: {
+			Description: `copy streams into MP4 with the index at the beginning (for progressive playback)`,
+			Ext:         `.mp4`,
+			Args:        []string{`-map`, `0:v?`, `-map`, `0:a?`, `-c`, `copy`, `-movflags`, `+faststart`, `-f`, `mp4`},
+		},
+	}
+)
+
+// FfmpegProfile is a set of ffmpeg output options.
+type FfmpegProfile struct {
+	Description string
+	Ext         string
+	Args        []string
+}
+
+func FfmpegProfileNames() []string {
+	names := make([]string, 0, len(FfmpegProfiles))
+	for name := range FfmpegProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func GetFfmpegProfile(name string) (FfmpegProfile, error) {
+	if name == `` {
+		name = DefaultFfmpegProfile
+	}
+	profile, ok := FfmpegProfiles[name]
+	if !ok {
+		err := errors.Join(ErrUnknownFfmpegProfile, errors.New(fmt.Sprintf("'%s' (known: %s)", name,
+			strings.Join(FfmpegProfileNames(), `, `))))
+		ErrorLog.Println(err.Error())
+		return FfmpegProfile{}, err
+	}
+	return profile, nil
+}
+
+// DetectInputFormat returns the ffmpeg input format of the segment, or an empty string if ffmpeg has to probe it.
+func DetectInputFormat(data []byte) string {
+	data = skipId3(data)
+	switch {
+	case IsTs(data):
+		return `mpegts`
+	case IsBmff(data):
+		return `mp4`
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xF6 == 0xF0:
+		return `aac`
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0:
+		return `mp3`
+	case len(data) >= 2 && data[0] == 0x0B && data[1] == 0x77:
+		return `ac3`
+	}
+	return ``
+}
+
+// FfmpegError is a failure of the ffmpeg process with the last lines it wrote to stderr.
+type FfmpegError struct {
+	ExitCode int
+	Stderr   []string
+	Err      error
+}
+
+func (err *FfmpegError) Error() string {
+	message := fmt.Sprintf("ffmpeg exited with status %d", err.ExitCode)
+	if err.Err != nil {
+		message = fmt.Sprintf("ffmpeg: %s", err.Err.Error())
+	}
+	if len(err.Stderr) > 0 {
+		message = message + `: ` + strings.Join(err.Stderr, ` | `)
+	}
+	return message
+}
+
+func (err *FfmpegError) Unwrap() error {
+	return err.Err
+}
+
+// FfmpegProgress is parsed from 'ffmpeg -progress' output.
+type FfmpegProgress struct {
+	Frame     int64
+	Fps       float64
+	Bitrate   string
+	TotalSize int64
+	OutTime   time.Duration
+	Speed     string
+	Finished  bool
+}
+
+// FfmpegSink feeds segments to ffmpeg stdin and supervises the process: Close waits for it to exit and turns a
+// failure into FfmpegError, Abort kills it. OnProgress is called on every ffmpeg progress report.
+// ffmpeg is started on the first segment, so the input format can be detected from it if InputFormat is empty.
+type FfmpegSink struct {
+	InputFormat string
+	OnProgress  func(progress FfmpegProgress)
+	OutputArgs  []string
+
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	done     chan struct{}
+	waitErr  error
+	mu       sync.Mutex
+	stderr   []string
+	progress FfmpegProgress
+	killed   bool
+}
+
+func (sink *FfmpegSink) readStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` {
+			continue
+		}
+		sink.mu.Lock()
+		sink.stderr = append(sink.stderr, line)
+		if len(sink.stderr) > ffmpegStderrLines {
+			sink.stderr = sink.stderr[len(sink.stderr)-ffmpegStderrLines:]
+		}
+		sink.mu.Unlock()
+	}
+}
+
+func (sink *FfmpegSink) readProgress(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	progress := FfmpegProgress{}
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), `=`, 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case `frame`:
+			progress.Frame, _ = strconv.ParseInt(kv[1], 10, 64)
+		case `fps`:
+			progress.Fps, _ = strconv.ParseFloat(kv[1], 64)
+		case `bitrate`:
+			progress.Bitrate = kv[1]
+		case `total_size`:
+			progress.TotalSize, _ = strconv.ParseInt(kv[1], 10, 64)
+		case `out_time_us`:
+			if us, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+				progress.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case `speed`:
+			progress.Speed = strings.TrimSpace(kv[1])
+		case `progress`:
+			progress.Finished = kv[1] == `end`
+			sink.mu.Lock()
+			sink.progress = progress
+			sink.mu.Unlock()
+			if sink.OnProgress != nil {
+				sink.OnProgress(progress)
+			}
+		}
+	}
+}
+
+func (sink *FfmpegSink) Progress() FfmpegProgress {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.progress
+}
+
+// error makes FfmpegError of the exited process, nil if it exited successfully.
+func (sink *FfmpegSink) error() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.waitErr == nil {
+		return nil
+	}
+	err := FfmpegError{
+		ExitCode: sink.cmd.ProcessState.ExitCode(),
+		Stderr:   append([]string{}, sink.stderr...),
+	}
+	if sink.killed {
+		err.Err = ErrFfmpegKilled
+	} else if exitErr := (*exec.ExitError)(nil); !errors.As(sink.waitErr, &exitErr) {
+		err.Err = sink.waitErr
+	}
+	return &err
+}
+
+func (sink *FfmpegSink) WriteSegment(info SegmentInfo, data []byte) error {
+	if sink.cmd == nil {
+		if sink.InputFormat == `` {
+			sink.InputFormat = DetectInputFormat(data)
+		}
+		if err := sink.start(); err != nil {
+			return err
+		}
+	}
+	if _, err := sink.stdin.Write(data); err != nil {
+		// most likely ffmpeg died, its own error is more helpful than EPIPE
+		select {
+		case <-sink.done:
+			if ffmpegErr := sink.error(); ffmpegErr != nil {
+				return ffmpegErr
+			}
+		case <-time.After(time.Second):
+		}
+		return err
+	}
+	return nil
+}
+
+// Trim adds -ss/-t output options before the output filename. It has effect before the first segment only.
+func (sink *FfmpegSink) Trim(start, duration time.Duration) {
+	n := len(sink.OutputArgs) - 2 // -n <filename>
+	args := append([]string{}, sink.OutputArgs[:n]...)
+	if start > 0 {
+		args = append(args, `-ss`, fmt.Sprintf("%.3f", start.Seconds()))
+	}
+	if duration > 0 {
+		args = append(args, `-t`, fmt.Sprintf("%.3f", duration.Seconds()))
+	}
+	sink.OutputArgs = append(args, sink.OutputArgs[n:]...)
+}
+
+func (sink *FfmpegSink) Close() error {
+	if sink.cmd == nil {
+		ErrorLog.Println(ErrFfmpegNoInput.Error())
+		return ErrFfmpegNoInput
+	}
+	sink.stdin.Close()
+	<-sink.done
+	if err := sink.error(); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// Abort kills ffmpeg and waits for it to exit.
+func (sink *FfmpegSink) Abort() error {
+	sink.mu.Lock()
+	sink.killed = true
+	started := sink.cmd != nil
+	sink.mu.Unlock()
+	if !started {
+		return nil
+	}
+	sink.cmd.Process.Kill()
+	sink.stdin.Close()
+	<-sink.done
+	return sink.error()
+}
+
+func (sink *FfmpegSink) start() error {
+	args := []string{`-hide_banner`, `-nostats`, `-loglevel`, `warning`, `-progress`, `pipe:1`}
+	if sink.InputFormat != `` {
+		args = append(args, `-f`, sink.InputFormat)
+	}
+	args = append(append(args, `-i`, `-`), sink.OutputArgs...)
+	cmd := exec.Command(FfmpegPath, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.killed {
+		return ErrFfmpegKilled
+	}
+	if err := cmd.Start(); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	DebugLog.Println(cmd.String())
+	sink.cmd, sink.stdin, sink.done = cmd, stdin, make(chan struct{})
+	outputs := sync.WaitGroup{}
+	outputs.Add(2)
+	go func() {
+		sink.readProgress(stdout)
+		outputs.Done()
+	}()
+	go func() {
+		sink.readStderr(stderr)
+		outputs.Done()
+	}()
+	go func() {
+		outputs.Wait() // pipes must be read to the end before Wait
+		err := cmd.Wait()
+		sink.mu.Lock()
+		sink.waitErr = err
+		sink.mu.Unlock()
+		close(sink.done)
+	}()
+	return nil
+}
+
+// NewFfmpegSink makes the sink with the FfmpegProfile output options, or with FfmpegArgs if they are set.
+func NewFfmpegSink(options SinkOptions) (Sink, error) {
+	if _, err := exec.LookPath(FfmpegPath); err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	args := options.FfmpegArgs
+	if len(args) == 0 {
+		profile, err := GetFfmpegProfile(options.FfmpegProfile)
+		if err != nil {
+			return nil, err
+		}
+		args = profile.Args
+	}
+	sink := FfmpegSink{
+		OnProgress: options.FfmpegProgress,
+		OutputArgs: append(append([]string{}, args...), `-n`, options.Filename),
+	}
+	return &sink, nil
+}
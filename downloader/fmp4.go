@@ -0,0 +1,35 @@
+package downloader
+
+import (
+	"encoding/binary"
+)
+
+// SplitInit splits the fragmented MP4 segment that carries its own init section (ftyp/moov before the fragments,
+// as some streams without EXT-X-MAP do) into the init section and the media part. init is nil if there is no moov.
+func SplitInit(data []byte) (init, media []byte) {
+	if !IsBmff(data) {
+		return nil, data
+	}
+	offset, moovEnd := 0, -1
+	for len(data)-offset >= 8 {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		boxType := string(data[offset+4 : offset+8])
+		if size == 1 && len(data)-offset >= 16 {
+			size = int(binary.BigEndian.Uint64(data[offset+8:]))
+		}
+		if size < 8 || size > len(data)-offset {
+			break
+		}
+		if boxType == `moof` || boxType == `styp` || boxType == `sidx` || boxType == `mdat` {
+			break
+		}
+		offset = offset + size
+		if boxType == `moov` {
+			moovEnd = offset
+		}
+	}
+	if moovEnd < 0 {
+		return nil, data
+	}
+	return data[:moovEnd], data[moovEnd:]
+}
@@ -0,0 +1,93 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func testBox(boxType string, payload ...byte) []byte {
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(8+len(payload))), boxType...), payload...)
+}
+
+func joinBoxes(boxes ...[]byte) []byte {
+	return bytes.Join(boxes, nil)
+}
+
+func TestSplitInit(t *testing.T) {
+	ftyp := testBox(`ftyp`, []byte(`iso6iso6`)...)
+	moov := testBox(`moov`, testBox(`mvhd`, 1, 2, 3)...)
+	fragment := joinBoxes(testBox(`moof`, testBox(`mfhd`, 0, 0, 0, 1)...), testBox(`mdat`, 1, 2, 3, 4))
+	styp := testBox(`styp`, []byte(`msdh`)...)
+	tests := []struct {
+		name  string
+		data  []byte
+		init  []byte
+		media []byte
+	}{
+		{`ftyp moov moof mdat`, joinBoxes(ftyp, moov, fragment), joinBoxes(ftyp, moov), fragment},
+		{`moov styp moof mdat`, joinBoxes(moov, styp, fragment), moov, joinBoxes(styp, fragment)},
+		{`init only`, joinBoxes(ftyp, moov), joinBoxes(ftyp, moov), []byte{}},
+		{`moof only`, fragment, nil, fragment},
+		{`styp moof mdat`, joinBoxes(styp, fragment), nil, joinBoxes(styp, fragment)},
+		{`ftyp without moov`, joinBoxes(ftyp, fragment), nil, joinBoxes(ftyp, fragment)},
+		{`moov after moof`, joinBoxes(fragment, moov), nil, joinBoxes(fragment, moov)},
+		{`truncated moov`, joinBoxes(ftyp, moov[:len(moov)-1]), nil, joinBoxes(ftyp, moov[:len(moov)-1])},
+		{`ts`, joinBoxes([]byte{0x47, 0x40, 0, 0x10}, make([]byte, 184)), nil, joinBoxes([]byte{0x47, 0x40, 0, 0x10},
+			make([]byte, 184))},
+	}
+	for _, test := range tests {
+		init, media := SplitInit(test.data)
+		if !bytes.Equal(init, test.init) || (init == nil) != (test.init == nil) || !bytes.Equal(media, test.media) {
+			t.Errorf("%s: SplitInit() = %x, %x; want %x, %x", test.name, init, media, test.init, test.media)
+		}
+	}
+}
+
+type testSink struct {
+	segments []SegmentInfo
+	data     [][]byte
+}
+
+func (sink *testSink) WriteSegment(info SegmentInfo, data []byte) error {
+	sink.segments = append(sink.segments, info)
+	sink.data = append(sink.data, data)
+	return nil
+}
+
+func (sink *testSink) Close() error {
+	return nil
+}
+
+// TestWriteSegmentInit checks that an init section is written once while it's the same, and again when it changes
+// (e.g. on an EXT-X-MAP switch).
+func TestWriteSegmentInit(t *testing.T) {
+	ftyp := testBox(`ftyp`, []byte(`iso6iso6`)...)
+	init := joinBoxes(ftyp, testBox(`moov`, testBox(`trak`, 1)...))
+	changed := joinBoxes(ftyp, testBox(`moov`, testBox(`trak`, 2)...))
+	fragment := joinBoxes(testBox(`moof`, testBox(`mfhd`, 0, 0, 0, 1)...), testBox(`mdat`, 1, 2, 3, 4))
+	downloader := Downloader{}
+	sink := testSink{}
+	for i, data := range [][]byte{joinBoxes(init, fragment), joinBoxes(init, fragment), fragment, joinBoxes(changed, fragment)} {
+		if err := downloader.writeSegment(&sink, SegmentInfo{Num: i}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []struct {
+		num   int
+		isMap bool
+		data  []byte
+	}{{0, true, init}, {0, false, fragment}, {1, false, fragment}, {2, false, fragment}, {3, true, changed},
+		{3, false, fragment}}
+	if len(sink.segments) != len(want) {
+		t.Fatalf("%d writes, want %d: %+v", len(sink.segments), len(want), sink.segments)
+	}
+	for i, w := range want {
+		if sink.segments[i].Num != w.num || sink.segments[i].IsMap != w.isMap || !bytes.Equal(sink.data[i], w.data) {
+			t.Errorf("write %d = %+v %x, want %+v", i, sink.segments[i], sink.data[i], w)
+		}
+	}
+	if !downloader.Fmp4 {
+		t.Error(`Fmp4 isn't set`)
+	}
+}
@@ -3,4 +3,8 @@ module github.com/vvampirius/hls-downloader/downloader
 go 1.22.4
 
 replace github.com/vvampirius/hls-downloader/playlist => ../playlist
+replace github.com/vvampirius/hls-downloader/remux => ../remux
+replace github.com/vvampirius/hls-downloader/webvtt => ../webvtt
 require github.com/vvampirius/hls-downloader/playlist v0.0.0-00010101000000-000000000000
+require github.com/vvampirius/hls-downloader/remux v0.0.0-00010101000000-000000000000
+require github.com/vvampirius/hls-downloader/webvtt v0.0.0-00010101000000-000000000000
@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrBadHeader     = errors.New(`bad header, expect 'Name: value'`)
+	ErrHeaderProfile = errors.New(`no such header profile`)
+	configDir        = `hls-downloader`
+)
+
+// ParseHeader parses 'Name: value'. The name is canonicalized.
+func ParseHeader(s string) (string, string, error) {
+	name, value, found := strings.Cut(s, `:`)
+	name = strings.TrimSpace(name)
+	if !found || name == `` || strings.ContainsAny(name, " \t") {
+		err := errors.Join(ErrBadHeader, errors.New(s))
+		ErrorLog.Println(err.Error())
+		return ``, ``, err
+	}
+	return http.CanonicalHeaderKey(name), strings.TrimSpace(value), nil
+}
+
+// ParseHeaders parses the headers into the map, later ones override earlier ones.
+func ParseHeaders(values []string, headers map[string]string) error {
+	for _, value := range values {
+		name, v, err := ParseHeader(value)
+		if err != nil {
+			return err
+		}
+		headers[name] = v
+	}
+	return nil
+}
+
+// ReadHeadersFile reads 'Name: value' lines, empty lines and lines starting with '#' are skipped.
+func ReadHeadersFile(filename string, headers map[string]string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		if err := ParseHeaders([]string{line}, headers); err != nil {
+			return errors.Join(err, errors.New(filename))
+		}
+	}
+	return nil
+}
+
+// HeaderProfile is a named set of headers (e.g. the Referer and Origin a site checks). Host is a regexp matched
+// against the whole host name of the playlist URL to apply the profile without naming it.
+type HeaderProfile struct {
+	Host    string            `json:"host,omitempty"`
+	Headers map[string]string `json:"headers"`
+
+	re *regexp.Regexp
+}
+
+// HeaderProfiles are the profiles by names.
+type HeaderProfiles map[string]*HeaderProfile
+
+// DefaultHeaderProfilesFile is the file the profiles are read from if no other one is given.
+func DefaultHeaderProfilesFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ``
+	}
+	return filepath.Join(dir, configDir, `headers.json`)
+}
+
+// LoadHeaderProfiles reads a JSON object of profiles, e.g.
+// {"example": {"host": "(.+\\.)?example\\.com", "headers": {"Referer": "https://example.com/"}}}
+func LoadHeaderProfiles(filename string) (HeaderProfiles, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	profiles := make(HeaderProfiles)
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		ErrorLog.Printf("%s: %s\n", filename, err.Error())
+		return nil, err
+	}
+	if err := profiles.compile(filename); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// compile compiles the Host regexps, source is the file the profiles are read from.
+func (profiles HeaderProfiles) compile(source string) error {
+	for name, profile := range profiles {
+		if profile == nil {
+			err := errors.New(fmt.Sprintf("%s: profile '%s' is empty", source, name))
+			ErrorLog.Println(err.Error())
+			return err
+		}
+		if profile.Host == `` {
+			continue
+		}
+		var err error
+		if profile.re, err = regexp.Compile(`^(?:` + profile.Host + `)$`); err != nil {
+			ErrorLog.Printf("%s: profile '%s': %s\n", source, name, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// Names returns the sorted names of the profiles.
+func (profiles HeaderProfiles) Names() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Headers returns the headers of the named profile or, if the name is empty, of the first profile (by name) whose
+// Host matches the host of the URL. It is an empty map if there is no such profile.
+func (profiles HeaderProfiles) Headers(name, rawUrl string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if name != `` {
+		profile, ok := profiles[name]
+		if !ok {
+			err := errors.Join(ErrHeaderProfile, errors.New(name))
+			ErrorLog.Println(err.Error())
+			return nil, err
+		}
+		for k, v := range profile.Headers {
+			headers[http.CanonicalHeaderKey(k)] = v
+		}
+		return headers, nil
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == `` {
+		return headers, nil
+	}
+	for _, name := range profiles.Names() {
+		if profile := profiles[name]; profile.re != nil && profile.re.MatchString(u.Hostname()) {
+			DebugLog.Printf("Header profile '%s' for %s\n", name, u.Hostname())
+			for k, v := range profile.Headers {
+				headers[http.CanonicalHeaderKey(k)] = v
+			}
+			break
+		}
+	}
+	return headers, nil
+}
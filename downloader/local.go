@@ -0,0 +1,150 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrStdinPlaylist = errors.New(`the playlist from stdin can be read only once`)
+
+	regexpRange = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+)
+
+// IsLocal tells if the playlist (or base URL) is a local one: '-' (stdin), a file:// URL or a path.
+func IsLocal(s string) bool {
+	return s == `-` || strings.HasPrefix(s, `file://`) || !strings.Contains(s, `://`)
+}
+
+// LocalUrl makes a file:// URL from the path or the file:// URL. The URL of a directory ends with '/', so URIs are
+// resolved inside it.
+func LocalUrl(s string) (*url.URL, error) {
+	if strings.HasPrefix(s, `file://`) {
+		u, err := url.Parse(s)
+		if err != nil {
+			ErrorLog.Println(err.Error())
+			return nil, err
+		}
+		s = u.Path
+	}
+	path, err := filepath.Abs(s)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() && !strings.HasSuffix(path, string(filepath.Separator)) {
+		path = path + string(filepath.Separator)
+	}
+	return &url.URL{Scheme: `file`, Path: filepath.ToSlash(path)}, nil
+}
+
+// fileTransport serves file:// URLs, with a single byte range if requested.
+type fileTransport struct{}
+
+func (fileTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	f, err := os.Open(filepath.FromSlash(request.URL.Path))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, errors.New(fmt.Sprintf("%s is a directory", request.URL.Path))
+	}
+	response := http.Response{
+		Status:        `200 OK`,
+		StatusCode:    http.StatusOK,
+		Proto:         `HTTP/1.0`,
+		ProtoMajor:    1,
+		Header:        make(http.Header),
+		Body:          f,
+		ContentLength: info.Size(),
+		Request:       request,
+	}
+	if match := regexpRange.FindStringSubmatch(request.Header.Get(`Range`)); match != nil {
+		start, _ := strconv.ParseInt(match[1], 10, 64)
+		end := info.Size() - 1
+		if match[2] != `` {
+			end, _ = strconv.ParseInt(match[2], 10, 64)
+		}
+		if start >= info.Size() || end < start {
+			f.Close()
+			response.Status, response.StatusCode = `416 Requested Range Not Satisfiable`, http.StatusRequestedRangeNotSatisfiable
+			response.Body, response.ContentLength = http.NoBody, 0
+			return &response, nil
+		}
+		end = min(end, info.Size()-1)
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		response.Status, response.StatusCode = `206 Partial Content`, http.StatusPartialContent
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, end-start+1), f}
+		response.ContentLength = end - start + 1
+	}
+	response.Header.Set(`Content-Length`, strconv.FormatInt(response.ContentLength, 10))
+	return &response, nil
+}
+
+// HttpOptions are the settings of the HTTP client of a download.
+type HttpOptions struct {
+	ConnectTimeout  time.Duration // 0 - the default one
+	ResponseTimeout time.Duration // waiting for the response headers, 0 - unlimited
+	Proxy           *url.URL      // nil - from the environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY)
+}
+
+// newTransport returns the transport of the options. maxConnsPerHost limits the connections to a host, 0 - unlimited.
+func newTransport(maxConnsPerHost int, options HttpOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = max(maxConnsPerHost, 0)
+	if options.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = options.ConnectTimeout
+	}
+	transport.ResponseHeaderTimeout = options.ResponseTimeout
+	if options.Proxy != nil {
+		transport.Proxy = http.ProxyURL(options.Proxy)
+	}
+	return transport
+}
+
+// newHttpClient returns the client that reads file:// URLs too if local is set. Only a local playlist may refer to
+// local files, so a remote one can't get them into the output. maxConnsPerHost limits the connections to a host,
+// 0 - unlimited.
+func newHttpClient(local bool, maxConnsPerHost int, options HttpOptions) *http.Client {
+	if !local && maxConnsPerHost <= 0 && options == (HttpOptions{}) {
+		return &http.Client{}
+	}
+	transport := newTransport(maxConnsPerHost, options)
+	if local {
+		transport.RegisterProtocol(`file`, fileTransport{})
+	}
+	return &http.Client{Transport: transport}
+}
+
+// stdinBaseUrl is the current directory the URIs of the playlist from stdin are resolved against.
+func stdinBaseUrl() (*url.URL, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return LocalUrl(dir)
+}
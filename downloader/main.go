@@ -3,106 +3,54 @@ package downloader
 import (
 	"errors"
 	"fmt"
-	"github.com/vvampirius/hls-downloader/playlist"
-	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
-	"regexp"
 	"strings"
 )
 
 var (
-	ErrorLog        = log.New(os.Stderr, `error#`, log.Lshortfile)
-	DebugLog        = log.New(os.Stdout, `debug#`, log.Lshortfile)
-	BaseUrlRegexp   = regexp.MustCompile(`/[^/]*$`)
-	SchemeUrlRegexp = regexp.MustCompile(`^https?://`)
+	ErrorLog = log.New(os.Stderr, `error#`, log.Lshortfile)
+	DebugLog = log.New(os.Stdout, `debug#`, log.Lshortfile)
 )
 
-func GetBaseURL(playlistUrl string) (string, error) {
-	return string(BaseUrlRegexp.ReplaceAll([]byte(playlistUrl), []byte(""))), nil
-}
-
-func GetFfmpegOutput(outputFilename string) (io.WriteCloser, error) {
-	cmd := exec.Command(`ffmpeg`, `-f`, `mpegts`, `-vcodec`, `h264`, `-i`, `-`, `-codec`, `copy`, outputFilename)
-	output, err := cmd.StdinPipe()
-	if err != nil {
+// MakeChunkUrl resolves segmentUri against the playlist URL as RFC 3986 reference. With propagateQuery the playlist
+// query parameters (usually signed tokens) are added to the segment URL unless it has parameters with the same names.
+// They aren't sent to another scheme or host.
+func MakeChunkUrl(baseUrl *url.URL, segmentUri string, propagateQuery bool) (string, error) {
+	if baseUrl == nil || segmentUri == `` {
+		err := errors.New(fmt.Sprintf("baseUrl: '%v', segmentUrl: '%s'", baseUrl, segmentUri))
 		ErrorLog.Println(err.Error())
-		return nil, err
+		return ``, err
 	}
-	err = cmd.Start()
+	ref, err := url.Parse(segmentUri)
 	if err != nil {
 		ErrorLog.Println(err.Error())
-		return nil, err
+		return ``, err
 	}
-	return output, nil
-}
-
-func GetOutput(outputFilename string, useFfmpeg bool) (io.WriteCloser, error) {
-	if useFfmpeg {
-		output, err := GetFfmpegOutput(outputFilename)
-		if err == nil {
-			return output, nil
-		} else {
-			ErrorLog.Println(err.Error())
-			ErrorLog.Println(`Can't use ffmpeg! Trying to save to file as-is...`)
+	chunkUrl := baseUrl.ResolveReference(ref)
+	sameOrigin := chunkUrl.Scheme == baseUrl.Scheme && strings.EqualFold(chunkUrl.Host, baseUrl.Host)
+	if propagateQuery && baseUrl.RawQuery != `` && sameOrigin {
+		// the query of the segment is kept as it is (a signature covers its exact form), the missing parameters of
+		// the playlist are appended as they are in its URL
+		query := chunkUrl.Query()
+		pairs := make([]string, 0)
+		if chunkUrl.RawQuery != `` {
+			pairs = append(pairs, chunkUrl.RawQuery)
 		}
-	}
-	output, err := os.Create(outputFilename)
-	if err != nil {
-		ErrorLog.Println(err.Error())
-		return nil, err
-	}
-	return output, nil
-}
-
-func GetPlaylistByUrl(playlistUrl string, requestHeaders map[string]string) (*playlist.Playlist, error) {
-	request, err := http.NewRequest(http.MethodGet, playlistUrl, nil)
-	if err != nil {
-		ErrorLog.Println(err.Error())
-		return nil, err
-	}
-	if requestHeaders != nil {
-		for k, v := range requestHeaders {
-			request.Header.Set(k, v)
+		for _, pair := range strings.Split(baseUrl.RawQuery, `&`) {
+			if name, ok := queryPairName(pair); ok && !query.Has(name) {
+				pairs = append(pairs, pair)
+			}
 		}
+		chunkUrl.RawQuery = strings.Join(pairs, `&`)
 	}
-	client := http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		ErrorLog.Println(err)
-		return nil, err
-	}
-	if response.StatusCode != http.StatusOK {
-		DebugLog.Println(playlistUrl, response.Status)
-	}
-	return playlist.Parse(response.Body), nil
+	return chunkUrl.String(), nil
 }
 
-func MakeChunkUrl(baseUrl, segmentUri string) (string, error) {
-	if baseUrl == `` || segmentUri == `` {
-		err := errors.New(fmt.Sprintf("baseUrl: '%s', segmentUrl: '%s'", baseUrl, segmentUri))
-		ErrorLog.Println(err.Error())
-		return ``, err
-	}
-
-	segmentUri = strings.Replace(segmentUri, `vh74.vhcdn.com`, `2lfkbh0yxg.a.trbcdn.net`, 1) // TODO: fix hardcode
-
-	if SchemeUrlRegexp.MatchString(segmentUri) {
-		return segmentUri, nil
-	}
-
-	if string([]rune(segmentUri)[0]) != `/` {
-		return baseUrl + `/` + segmentUri, nil
-	}
-
-	baseUrlParsed, err := url.Parse(baseUrl)
-	if err != nil {
-		ErrorLog.Println(err.Error())
-		return "", err
-	}
-	chunkUrl := fmt.Sprintf("%s://%s%s", baseUrlParsed.Scheme, baseUrlParsed.Host, segmentUri)
-	return chunkUrl, nil
+// queryPairName returns the unescaped name of the raw 'name=value' pair of a query.
+func queryPairName(pair string) (string, bool) {
+	rawName, _, _ := strings.Cut(pair, `=`)
+	name, err := url.QueryUnescape(rawName)
+	return name, pair != `` && err == nil
 }
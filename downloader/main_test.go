@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMakeChunkUrl(t *testing.T) {
+	tests := []struct {
+		playlist       string
+		segment        string
+		propagateQuery bool
+		want           string
+	}{
+		{`https://cdn.example.com/a/index.m3u8`, `0.ts`, false, `https://cdn.example.com/a/0.ts`},
+		{`https://cdn.example.com/a/index.m3u8`, `/b/0.ts`, false, `https://cdn.example.com/b/0.ts`},
+		{`https://cdn.example.com/a/index.m3u8?token=x`, `0.ts`, false, `https://cdn.example.com/a/0.ts`},
+		{`https://cdn.example.com/a/index.m3u8?token=x`, `0.ts`, true, `https://cdn.example.com/a/0.ts?token=x`},
+		// the signed query of the segment is kept byte for byte, in its order and escaping
+		{`https://cdn.example.com/a/index.m3u8`, `0.ts?Signature=a%2Bb~c&Expires=1&Key-Pair-Id=K`, true,
+			`https://cdn.example.com/a/0.ts?Signature=a%2Bb~c&Expires=1&Key-Pair-Id=K`},
+		{`https://cdn.example.com/a/index.m3u8?token=x`, `0.ts?z=1&a=%7E`, true,
+			`https://cdn.example.com/a/0.ts?z=1&a=%7E&token=x`},
+		// the parameters of the segment win, the missing ones keep the playlist form
+		{`https://cdn.example.com/a/index.m3u8?token=x&hdnts=exp%3D1~hmac%3Dab&b=1&b=2`, `0.ts?token=y`, true,
+			`https://cdn.example.com/a/0.ts?token=y&hdnts=exp%3D1~hmac%3Dab&b=1&b=2`},
+		// the token isn't leaked to another host or scheme
+		{`https://cdn.example.com/a/index.m3u8?token=x`, `https://other.example.com/0.ts`, true,
+			`https://other.example.com/0.ts`},
+		{`https://cdn.example.com/a/index.m3u8?token=x`, `http://cdn.example.com/0.ts`, true,
+			`http://cdn.example.com/0.ts`},
+		{`https://cdn.example.com/a/index.m3u8?token=x`, `https://CDN.example.com/0.ts`, true,
+			`https://CDN.example.com/0.ts?token=x`},
+	}
+	for _, test := range tests {
+		baseUrl, err := url.Parse(test.playlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := MakeChunkUrl(baseUrl, test.segment, test.propagateQuery)
+		if err != nil {
+			t.Errorf("MakeChunkUrl(%s, %s): %s", test.playlist, test.segment, err.Error())
+			continue
+		}
+		if got != test.want {
+			t.Errorf("MakeChunkUrl(%s, %s, %t) = %s, want %s", test.playlist, test.segment, test.propagateQuery,
+				got, test.want)
+		}
+	}
+}
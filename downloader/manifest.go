@@ -0,0 +1,207 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const ManifestExt = `.manifest.json`
+
+var (
+	ErrManifestMismatch = errors.New(`the output doesn't match the manifest`)
+	ErrManifestNoOutput = errors.New(`the manifest has no output file hash`)
+
+	// manifestResponseHeaders are the response headers kept in the manifest.
+	manifestResponseHeaders = []string{`Age`, `Content-Type`, `Date`, `ETag`, `Last-Modified`, `Server`, `Via`,
+		`X-Cache`}
+	// secretHeaderWords mark request headers whose values aren't written to the manifest.
+	secretHeaderWords = []string{`auth`, `cookie`, `key`, `secret`, `session`, `signature`, `token`}
+)
+
+// ManifestSegment is a resource (a media segment or an init section) got into the output.
+type ManifestSegment struct {
+	Num      int               `json:"num"`
+	Url      string            `json:"url"`
+	Size     int64             `json:"size"`
+	Sha256   string            `json:"sha256"`
+	Time     time.Time         `json:"time"`
+	Status   int               `json:"status"`
+	Response map[string]string `json:"response,omitempty"`
+}
+
+// Manifest is the record of a finished download to prove what was downloaded. Output is relative to the manifest
+// file, so they may be moved together.
+type Manifest struct {
+	Source         string            `json:"source"`
+	Variant        string            `json:"variant"`
+	RequestHeaders map[string]string `json:"request_headers,omitempty"`
+	Sink           string            `json:"sink"`
+	Output         string            `json:"output"`
+	OutputSize     int64             `json:"output_size,omitempty"`
+	OutputSha256   string            `json:"output_sha256,omitempty"`
+	Started        time.Time         `json:"started"`
+	Finished       time.Time         `json:"finished"`
+	Segments       []ManifestSegment `json:"segments"`
+}
+
+// RedactHeaders returns the headers with the values of the secret ones (credentials, cookies, tokens) replaced.
+func RedactHeaders(headers map[string]string) map[string]string {
+	redacted := make(map[string]string)
+	for name, value := range headers {
+		lower := strings.ToLower(name)
+		for _, word := range secretHeaderWords {
+			if strings.Contains(lower, word) {
+				value = `<redacted>`
+				break
+			}
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+// responseMetadata picks the manifestResponseHeaders of the response.
+func responseMetadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for _, name := range manifestResponseHeaders {
+		if value := header.Get(name); value != `` {
+			metadata[name] = value
+		}
+	}
+	return metadata
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HashFile returns the SHA-256 and the size of the file.
+func HashFile(filename string) (string, int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return ``, 0, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return ``, 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+// ManifestFor is the name of the manifest next to the output.
+func ManifestFor(outputFilename string) string {
+	return outputFilename + ManifestExt
+}
+
+// writeManifest writes the manifest of the successful download. The output is hashed if it is a regular file (not
+// a directory of the dir sink, an object store or stdout).
+func (downloader *Downloader) writeManifest() error {
+	manifest := Manifest{
+		Source:         downloader.playlistUrl,
+		Variant:        downloader.variantUrl,
+		RequestHeaders: RedactHeaders(downloader.requestHeaders),
+		Sink:           downloader.sinkUsed,
+		Output:         downloader.outputFilename,
+		Started:        downloader.startedAt,
+		Finished:       time.Now(),
+		Segments:       make([]ManifestSegment, 0),
+	}
+	if output, err := filepath.Abs(downloader.outputFilename); err == nil {
+		if dir, err := filepath.Abs(filepath.Dir(downloader.ManifestFilename)); err == nil {
+			if rel, err := filepath.Rel(dir, output); err == nil {
+				manifest.Output = rel
+			}
+		}
+	}
+	if info, err := os.Stat(downloader.outputFilename); err == nil && info.Mode().IsRegular() {
+		if manifest.OutputSha256, manifest.OutputSize, err = HashFile(downloader.outputFilename); err != nil {
+			return err
+		}
+	}
+	for _, stats := range downloader.SegmentStats() {
+		if stats.Error != `` {
+			continue
+		}
+		manifest.Segments = append(manifest.Segments, ManifestSegment{
+			Num:      stats.Num,
+			Url:      stats.Url,
+			Size:     stats.Size,
+			Sha256:   stats.Sha256,
+			Time:     stats.Started.Add(stats.Elapsed),
+			Status:   stats.Status,
+			Response: stats.Response,
+		})
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent(``, `  `)
+	if err := encoder.Encode(manifest); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if err := os.WriteFile(downloader.ManifestFilename, data.Bytes(), 0644); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest file.
+func ReadManifest(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// VerifyManifest re-hashes the output of the manifest (found next to the manifest file) and compares it with the
+// recorded hash and size.
+func VerifyManifest(filename string) (*Manifest, error) {
+	manifest, err := ReadManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.OutputSha256 == `` {
+		err := errors.Join(ErrManifestNoOutput, errors.New(fmt.Sprintf("%s (%s sink)", filename, manifest.Sink)))
+		ErrorLog.Println(err.Error())
+		return manifest, err
+	}
+	output := manifest.Output
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(filepath.Dir(filename), output)
+	}
+	hash, size, err := HashFile(output)
+	if err != nil {
+		return manifest, err
+	}
+	if hash != manifest.OutputSha256 || size != manifest.OutputSize {
+		err := errors.Join(ErrManifestMismatch, errors.New(fmt.Sprintf("%s is %d bytes %s, expect %d bytes %s",
+			output, size, hash, manifest.OutputSize, manifest.OutputSha256)))
+		ErrorLog.Println(err.Error())
+		return manifest, err
+	}
+	return manifest, nil
+}
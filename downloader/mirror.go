@@ -0,0 +1,526 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MirrorPlaylistName = `index.m3u8`
+
+var (
+	ErrMirrorMaster = errors.New(`master playlist can't be mirrored into an existing media playlist mirror`)
+
+	// playlist-wide tags stay in the header of the mirrored playlist, all the other ones belong to the next segment
+	mirrorHeaderTags = []string{`#EXTM3U`, `#EXT-X-VERSION`, `#EXT-X-TARGETDURATION`, `#EXT-X-MEDIA-SEQUENCE`,
+		`#EXT-X-DISCONTINUITY-SEQUENCE`, `#EXT-X-PLAYLIST-TYPE`, `#EXT-X-INDEPENDENT-SEGMENTS`, `#EXT-X-START`,
+		`#EXT-X-ALLOW-CACHE`, `#EXT-X-I-FRAMES-ONLY`, `#EXT-X-SERVER-CONTROL`, `#EXT-X-PART-INF`}
+	regexpUriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+	regexpByteRange    = regexp.MustCompile(`,?BYTERANGE="[^"]*"`)
+)
+
+func isMirrorHeaderTag(line string) bool {
+	for _, tag := range mirrorHeaderTags {
+		if line == tag || strings.HasPrefix(line, tag+`:`) {
+			return true
+		}
+	}
+	return false
+}
+
+func mirrorHash(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:4])
+}
+
+func urlExt(resourceUrl, defaultExt string) string {
+	if u, err := url.Parse(resourceUrl); err == nil {
+		if ext := path.Ext(u.Path); ext != `` && len(ext) <= 5 {
+			return ext
+		}
+	}
+	return defaultExt
+}
+
+// mirrorEntry is a segment line of a mirrored playlist with the tags before it.
+type mirrorEntry struct {
+	Sequence int
+	Lines    []string
+}
+
+// mirrorPlaylist is a media playlist mirrored into Dir. Entries are accumulated over updates of a live playlist, so
+// the local playlist keeps all the segments ever seen.
+type mirrorPlaylist struct {
+	Url            string
+	Dir            string
+	TargetDuration int
+	Ended          bool
+
+	header       []string
+	entries      []*mirrorEntry
+	lastSequence int
+	key          string // KEY and MAP tags in effect at the end of entries
+	init         string
+}
+
+// load reads the playlist of a previous run to continue the mirror.
+func (mirror *mirrorPlaylist) load() error {
+	data, err := os.ReadFile(filepath.Join(mirror.Dir, MirrorPlaylistName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if playlist.IsMaster(data) {
+		return ErrMirrorMaster
+	}
+	header, entries, _, _ := splitMediaPlaylist(string(data))
+	mirror.header = header
+	for _, entry := range entries {
+		// the local segment files are named by their sequence numbers, which is reliable even if there are gaps
+		name := entry.Lines[len(entry.Lines)-1]
+		if sequence, err := strconv.Atoi(strings.TrimSuffix(name, filepath.Ext(name))); err == nil {
+			entry.Sequence = sequence
+		}
+		mirror.add(entry)
+	}
+	return nil
+}
+
+// splitMediaPlaylist splits the playlist into header lines and segment entries. Sequence numbers of the entries are
+// counted from EXT-X-MEDIA-SEQUENCE.
+func splitMediaPlaylist(text string) (header []string, entries []*mirrorEntry, targetDuration int, ended bool) {
+	sequence := 0
+	current := make([]string, 0)
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == ``:
+			continue
+		case line == `#EXT-X-ENDLIST`:
+			ended = true
+		case isMirrorHeaderTag(line):
+			if value, found := strings.CutPrefix(line, `#EXT-X-MEDIA-SEQUENCE:`); found {
+				sequence, _ = strconv.Atoi(value)
+			}
+			if value, found := strings.CutPrefix(line, `#EXT-X-TARGETDURATION:`); found {
+				targetDuration, _ = strconv.Atoi(value)
+			}
+			if len(entries) == 0 {
+				header = append(header, line)
+			}
+		case strings.HasPrefix(line, `#`):
+			current = append(current, line)
+		default:
+			entries = append(entries, &mirrorEntry{Sequence: sequence, Lines: append(current, line)})
+			current = make([]string, 0)
+			sequence++
+		}
+	}
+	return header, entries, targetDuration, ended
+}
+
+func (mirror *mirrorPlaylist) add(entry *mirrorEntry) {
+	for _, line := range entry.Lines {
+		if strings.HasPrefix(line, `#EXT-X-KEY:`) {
+			mirror.key = line
+		}
+		if strings.HasPrefix(line, `#EXT-X-MAP:`) {
+			mirror.init = line
+		}
+	}
+	mirror.entries = append(mirror.entries, entry)
+	mirror.lastSequence = entry.Sequence
+}
+
+func (mirror *mirrorPlaylist) write() error {
+	b := strings.Builder{}
+	for _, line := range mirror.header {
+		if strings.HasPrefix(line, `#EXT-X-MEDIA-SEQUENCE:`) && len(mirror.entries) > 0 {
+			line = fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", mirror.entries[0].Sequence)
+		}
+		b.WriteString(line + "\n")
+	}
+	for _, entry := range mirror.entries {
+		for _, line := range entry.Lines {
+			b.WriteString(line + "\n")
+		}
+	}
+	if mirror.Ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	// written atomically, so a player never sees a half-written playlist of a live mirror
+	filename := filepath.Join(mirror.Dir, MirrorPlaylistName)
+	if err := os.WriteFile(filename+`.tmp`, []byte(b.String()), 0644); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if err := os.Rename(filename+`.tmp`, filename); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// mirrorFile downloads the resource into the mirror directory unless it is there already.
+func (downloader *Downloader) mirrorFile(dir, name, resourceUrl string,
+	byteRange *playlist.ByteRange, duration float32, encrypted bool, requestHeaders map[string]string) error {
+	filename := filepath.Join(dir, name)
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+	downloader.CurrentSegment.Url = resourceUrl
+	downloader.CurrentSegment.GotBytes = 0
+	downloader.phase = PhaseSegment
+	downloader.notify()
+	data, err := downloader.downloadSegment(resourceUrl, -1, false, byteRange, duration, encrypted, requestHeaders)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename+`.tmp`, data, 0644); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if err := os.Rename(filename+`.tmp`, filename); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if duration > 0 {
+		downloader.validatedBytes = downloader.validatedBytes + int64(len(data))
+		downloader.validatedDuration = downloader.validatedDuration + duration
+	}
+	return nil
+}
+
+// mirrorUriAttribute downloads the resource of the tag's URI attribute and points the attribute to the local file.
+// Non-HTTP URIs (e.g. skd:// keys) are kept as they are. The container of an encrypted resource (or a key) isn't
+// validated.
+func (downloader *Downloader) mirrorUriAttribute(dir, line, prefix, defaultExt string, encrypted bool,
+	baseUrl *url.URL, requestHeaders map[string]string) (string, error) {
+	match := regexpUriAttribute.FindStringSubmatchIndex(line)
+	if match == nil {
+		return line, nil
+	}
+	uri := line[match[2]:match[3]]
+	resourceUrl, err := MakeChunkUrl(baseUrl, uri, downloader.PropagateQuery)
+	if err != nil {
+		return ``, err
+	}
+	if !strings.HasPrefix(resourceUrl, `http://`) && !strings.HasPrefix(resourceUrl, `https://`) {
+		return line, nil
+	}
+	resourceUrl = downloader.Rewriter.Rewrite(resourceUrl)
+	var byteRange *playlist.ByteRange
+	key := resourceUrl
+	if value, ok := playlist.ParseAttributes(line[strings.IndexByte(line, ':')+1:])[`BYTERANGE`]; ok {
+		if byteRange, err = playlist.ParseByteRange(value); err != nil {
+			return ``, err
+		}
+		byteRange.Offset = max(byteRange.Offset, 0)
+		key = key + `@` + byteRange.String()
+	}
+	name := prefix + mirrorHash(key) + urlExt(resourceUrl, defaultExt)
+	if err := downloader.mirrorFile(dir, name, resourceUrl, byteRange, 0, encrypted, requestHeaders); err != nil {
+		return ``, err
+	}
+	// the range is downloaded into its own file
+	line = regexpByteRange.ReplaceAllString(line, ``)
+	match = regexpUriAttribute.FindStringSubmatchIndex(line)
+	return line[:match[2]] + name + line[match[3]:], nil
+}
+
+// update fetches the media playlist and downloads the segments (with their keys and init sections) that are not in
+// the mirror yet.
+func (downloader *Downloader) updateMirror(mirror *mirrorPlaylist,
+	requestHeaders map[string]string, validateSize bool) error {
+	data, baseUrl, err := downloader.fetchPlaylist(mirror.Url, requestHeaders)
+	if err != nil {
+		return err
+	}
+	if playlist.IsMaster(data) {
+		return errors.New(fmt.Sprintf("%s is a master playlist", mirror.Url))
+	}
+	header, entries, targetDuration, ended := splitMediaPlaylist(string(data))
+	if len(mirror.header) == 0 {
+		mirror.header = header
+	}
+	mirror.TargetDuration = targetDuration
+	if downloader.Playlist == nil {
+		downloader.Playlist = playlist.Parse(io.NopCloser(bytes.NewReader(data)))
+	}
+	key, init := mirror.key, mirror.init
+	for _, entry := range entries {
+		lines := make([]string, 0, len(entry.Lines))
+		var byteRange *playlist.ByteRange
+		duration := float32(0)
+		for _, line := range entry.Lines[:len(entry.Lines)-1] {
+			switch {
+			case strings.HasPrefix(line, `#EXT-X-KEY:`):
+				if line, err = downloader.mirrorUriAttribute(mirror.Dir, line, `key-`, `.key`, true, baseUrl,
+					requestHeaders); err != nil {
+					return err
+				}
+				key = line
+			case strings.HasPrefix(line, `#EXT-X-MAP:`):
+				if line, err = downloader.mirrorUriAttribute(mirror.Dir, line, `init-`, `.mp4`, keyEncrypted(key),
+					baseUrl, requestHeaders); err != nil {
+					return err
+				}
+				init = line
+			case strings.HasPrefix(line, `#EXT-X-BYTERANGE:`):
+				if byteRange, err = playlist.ParseByteRange(strings.TrimPrefix(line, `#EXT-X-BYTERANGE:`)); err != nil {
+					return err
+				}
+				continue // the range is downloaded into its own file
+			case strings.HasPrefix(line, `#EXTINF:`):
+				if f, err := strconv.ParseFloat(strings.SplitN(strings.TrimPrefix(line, `#EXTINF:`), `,`, 2)[0], 32); err == nil {
+					duration = float32(f)
+				}
+			}
+			lines = append(lines, line)
+		}
+		if len(mirror.entries) > 0 && entry.Sequence <= mirror.lastSequence {
+			continue
+		}
+		// the tags in effect could be declared before the part of a live playlist that is new for the mirror, and
+		// the ones repeated at the top of every update of it are not needed
+		filtered := lines[:0]
+		for _, line := range lines {
+			if (line == mirror.key && mirror.key != ``) || (line == mirror.init && mirror.init != ``) {
+				continue
+			}
+			filtered = append(filtered, line)
+		}
+		lines = filtered
+		if init != mirror.init && !containsPrefix(lines, `#EXT-X-MAP:`) {
+			lines = append([]string{init}, lines...)
+		}
+		if key != mirror.key && !containsPrefix(lines, `#EXT-X-KEY:`) {
+			lines = append([]string{key}, lines...)
+		}
+		if len(mirror.entries) > 0 && entry.Sequence > mirror.lastSequence+1 &&
+			!containsPrefix(lines, `#EXT-X-DISCONTINUITY`) {
+			ErrorLog.Printf("%s: segments %d-%d are lost\n", mirror.Url, mirror.lastSequence+1, entry.Sequence-1)
+			lines = append([]string{`#EXT-X-DISCONTINUITY`}, lines...)
+		}
+		segmentUrl, err := MakeChunkUrl(baseUrl, entry.Lines[len(entry.Lines)-1], downloader.PropagateQuery)
+		if err != nil {
+			return err
+		}
+		segmentUrl = downloader.Rewriter.Rewrite(segmentUrl)
+		if byteRange != nil && byteRange.Offset < 0 {
+			err := errors.New(fmt.Sprintf("%s: byte range without offset is not supported", segmentUrl))
+			ErrorLog.Println(err.Error())
+			return err
+		}
+		name := fmt.Sprintf("%08d%s", entry.Sequence, urlExt(segmentUrl, `.ts`))
+		downloader.CurrentSegment.Num++
+		sizeDuration := duration
+		if !validateSize {
+			sizeDuration = 0
+		}
+		if err := downloader.mirrorFile(mirror.Dir, name, segmentUrl, byteRange, sizeDuration, keyEncrypted(key),
+			requestHeaders); err != nil {
+			return err
+		}
+		downloader.DownloadedDuration = downloader.DownloadedDuration + duration
+		mirror.add(&mirrorEntry{Sequence: entry.Sequence, Lines: append(lines, name)})
+		if err := mirror.write(); err != nil {
+			return err
+		}
+	}
+	mirror.Ended = ended
+	return mirror.write()
+}
+
+// keyEncrypted tells if the EXT-X-KEY line (empty - none) encrypts the segments.
+func keyEncrypted(line string) bool {
+	return line != `` && playlist.ParseAttributes(strings.TrimPrefix(line, `#EXT-X-KEY:`))[`METHOD`] != `NONE`
+}
+
+func containsPrefix(lines []string, prefix string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorMaster writes the local master playlist with every variant, rendition and I-frame playlist pointed to its
+// own mirror subdirectory.
+func (downloader *Downloader) mirrorMaster(data []byte, baseUrl *url.URL, dir string) ([]*mirrorPlaylist, error) {
+	mirrors := make([]*mirrorPlaylist, 0)
+	local := make(map[string]string)
+	addMirror := func(uri string) (string, error) {
+		playlistUrl, err := MakeChunkUrl(baseUrl, uri, downloader.PropagateQuery)
+		if err != nil {
+			return ``, err
+		}
+		if name, ok := local[playlistUrl]; ok {
+			return name, nil // e.g. the same playlist as a variant and as a rendition
+		}
+		sub := fmt.Sprintf("%02d", len(mirrors))
+		mirror := mirrorPlaylist{Url: playlistUrl, Dir: filepath.Join(dir, sub), lastSequence: -1}
+		if err := os.MkdirAll(mirror.Dir, 0755); err != nil {
+			ErrorLog.Println(err.Error())
+			return ``, err
+		}
+		if err := mirror.load(); err != nil {
+			return ``, err
+		}
+		mirrors = append(mirrors, &mirror)
+		local[playlistUrl] = sub + `/` + MirrorPlaylistName
+		return local[playlistUrl], nil
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	streamInf := false
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == ``:
+		case strings.HasPrefix(line, `#EXT-X-STREAM-INF:`):
+			streamInf = true
+		case strings.HasPrefix(line, `#EXT-X-MEDIA:`) || strings.HasPrefix(line, `#EXT-X-I-FRAME-STREAM-INF:`):
+			match := regexpUriAttribute.FindStringSubmatchIndex(line)
+			if match == nil {
+				continue
+			}
+			local, err := addMirror(line[match[2]:match[3]])
+			if err != nil {
+				return nil, err
+			}
+			lines[i] = line[:match[2]] + local + line[match[3]:]
+		case !strings.HasPrefix(line, `#`) && streamInf:
+			streamInf = false
+			local, err := addMirror(line)
+			if err != nil {
+				return nil, err
+			}
+			lines[i] = local
+		}
+	}
+	filename := filepath.Join(dir, MirrorPlaylistName)
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return mirrors, nil
+}
+
+// mirrorRoutine updates the mirrors until all the playlists are ended, every target duration while they are live.
+func (downloader *Downloader) mirrorRoutine(mirrors []*mirrorPlaylist,
+	requestHeaders map[string]string) {
+	finish := func(err error) {
+		if downloader.ctx.Err() != nil {
+			err = ErrCancelled
+		}
+		downloader.setResult(err)
+		downloader.cancel()
+		downloader.progress.close()
+	}
+	for {
+		live := false
+		wait := 0
+		for _, mirror := range mirrors {
+			if mirror.Ended {
+				continue
+			}
+			if err := downloader.updateMirror(mirror, requestHeaders, len(mirrors) == 1); err != nil {
+				finish(err)
+				return
+			}
+			if !mirror.Ended {
+				live = true
+				if wait == 0 || mirror.TargetDuration < wait {
+					wait = mirror.TargetDuration
+				}
+			}
+		}
+		if !live {
+			finish(nil)
+			return
+		}
+		downloader.phase = PhaseWaiting
+		downloader.notify()
+		select {
+		case <-time.After(time.Duration(max(wait, 1)) * time.Second):
+		case <-downloader.ctx.Done():
+			finish(ErrCancelled)
+			return
+		}
+	}
+}
+
+// Mirror stores the stream as HLS in dir: the segments, init sections and keys as files and a local index.m3u8
+// pointing to them, so it plays from disk. A master playlist is mirrored with all its variants and renditions if
+// MirrorVariants is set, otherwise only the variant with the highest bandwidth is. A live playlist is followed until
+// it ends (or Cancel). Files already in dir are not downloaded again, so a mirror can be updated by another run.
+func (downloader *Downloader) Mirror(playlistUrl, dir string, requestHeaders map[string]string) (chan ProgressEvent, error) {
+	if err := downloader.start(); err != nil {
+		return nil, err
+	}
+	downloader.local = IsLocal(playlistUrl) || (downloader.BaseUrl != `` && IsLocal(downloader.BaseUrl))
+	downloader.playlistUrl = playlistUrl
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		ErrorLog.Println(err.Error())
+		downloader.stop(err)
+		return nil, err
+	}
+	data, baseUrl, err := downloader.fetchPlaylist(playlistUrl, requestHeaders)
+	if err != nil {
+		downloader.stop(err)
+		return nil, err
+	}
+	mirrors := make([]*mirrorPlaylist, 0)
+	switch {
+	case playlist.IsMaster(data) && downloader.MirrorVariants:
+		if mirrors, err = downloader.mirrorMaster(data, baseUrl, dir); err != nil {
+			downloader.stop(err)
+			return nil, err
+		}
+	case playlist.IsMaster(data):
+		variantUrl, err := BestVariantUrl(data, baseUrl, downloader.PropagateQuery)
+		if err != nil {
+			downloader.stop(err)
+			return nil, err
+		}
+		playlistUrl = variantUrl
+		fallthrough
+	default:
+		mirror := mirrorPlaylist{Url: playlistUrl, Dir: dir, lastSequence: -1}
+		if err := mirror.load(); err != nil {
+			ErrorLog.Println(err.Error())
+			downloader.stop(err)
+			return nil, err
+		}
+		mirrors = append(mirrors, &mirror)
+	}
+	downloader.phase = PhaseStarted
+	downloader.notify()
+	go downloader.mirrorRoutine(mirrors, requestHeaders)
+	return downloader.progress.events, nil
+}
+
+// BestVariantUrl returns the URL of the variant with the highest bandwidth of the master playlist.
+func BestVariantUrl(data []byte, baseUrl *url.URL, propagateQuery bool) (string, error) {
+	best := playlist.BestGroup(playlist.GroupRedundant(playlist.ParseMaster(data)))
+	if best == nil {
+		return ``, playlist.ErrNoSegments
+	}
+	return MakeChunkUrl(baseUrl, best[0].Uri, propagateQuery)
+}
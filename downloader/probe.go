@@ -0,0 +1,233 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ProbeSampleSegments is the default ProbeSamples of the Downloader.
+const ProbeSampleSegments = 3
+
+// ProbeMedia describes a media playlist.
+type ProbeMedia struct {
+	Url            string  `json:"url"`
+	Segments       int     `json:"segments"`
+	Duration       float32 `json:"duration"`
+	TargetDuration int     `json:"target_duration"`
+	Encryption     string  `json:"encryption"` // METHOD of EXT-X-KEY, NONE if the segments aren't encrypted
+	Container      string  `json:"container"`  // ts, fmp4, aac, ... by EXT-X-MAP and the segment URIs
+	Live           bool    `json:"live"`
+	PlaylistType   string  `json:"playlist_type,omitempty"`
+	EstimatedSize  int64   `json:"estimated_size"` // 0 if unknown
+	Sampled        int     `json:"sampled"`        // segments the size is estimated by
+	Error          string  `json:"error,omitempty"`
+}
+
+type ProbeVariant struct {
+	Url        string      `json:"url"`
+	Bandwidth  int64       `json:"bandwidth"`
+	Resolution string      `json:"resolution,omitempty"`
+	Codecs     string      `json:"codecs,omitempty"`
+	Audio      string      `json:"audio,omitempty"`
+	Subtitles  string      `json:"subtitles,omitempty"`
+	Media      *ProbeMedia `json:"media"`
+}
+
+type ProbeRendition struct {
+	Type     string `json:"type"`
+	GroupId  string `json:"group_id"`
+	Name     string `json:"name"`
+	Language string `json:"language,omitempty"`
+	Default  bool   `json:"default"`
+	Url      string `json:"url,omitempty"`
+}
+
+// ProbeResult describes the playlist: the variants and renditions of a master playlist or the media one.
+type ProbeResult struct {
+	Url        string           `json:"url"`
+	Master     bool             `json:"master"`
+	Variants   []ProbeVariant   `json:"variants,omitempty"`
+	Renditions []ProbeRendition `json:"renditions,omitempty"`
+	Media      *ProbeMedia      `json:"media,omitempty"`
+}
+
+// Probe fetches and describes the playlist without downloading it. Every variant of a master playlist is probed.
+// The Downloader must not be started: its options (Rewriter, PropagateQuery, BaseUrl) are used only.
+func (downloader *Downloader) Probe(playlistUrl string, requestHeaders map[string]string) (*ProbeResult, error) {
+	if downloader.Started {
+		err := errors.New(`already started`)
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	downloader.ctx, downloader.cancel = context.WithCancel(context.Background())
+	defer downloader.cancel()
+	downloader.local = IsLocal(playlistUrl) || (downloader.BaseUrl != `` && IsLocal(downloader.BaseUrl))
+	data, baseUrl, err := downloader.fetchPlaylist(playlistUrl, requestHeaders)
+	if err != nil {
+		return nil, err
+	}
+	result := ProbeResult{Url: playlistUrl, Master: playlist.IsMaster(data)}
+	if !result.Master {
+		result.Media = downloader.probeMedia(playlistUrl, data, baseUrl, requestHeaders)
+		return &result, nil
+	}
+	result.Variants = make([]ProbeVariant, 0)
+	for _, variant := range playlist.ParseMaster(data) {
+		variantUrl, err := MakeChunkUrl(baseUrl, variant.Uri, downloader.PropagateQuery)
+		if err != nil {
+			return nil, err
+		}
+		probeVariant := ProbeVariant{
+			Url:        variantUrl,
+			Bandwidth:  variant.Bandwidth,
+			Resolution: variant.Resolution,
+			Codecs:     variant.Codecs,
+			Audio:      variant.Attributes[`AUDIO`],
+			Subtitles:  variant.Attributes[`SUBTITLES`],
+		}
+		variantData, variantBaseUrl, err := downloader.fetchPlaylist(variantUrl, requestHeaders)
+		if err != nil {
+			probeVariant.Media = &ProbeMedia{Url: variantUrl, Error: err.Error()}
+		} else {
+			probeVariant.Media = downloader.probeMedia(variantUrl, variantData, variantBaseUrl, requestHeaders)
+		}
+		result.Variants = append(result.Variants, probeVariant)
+	}
+	result.Renditions = make([]ProbeRendition, 0)
+	for _, rendition := range playlist.ParseRenditions(data) {
+		probeRendition := ProbeRendition{
+			Type:     rendition.Type,
+			GroupId:  rendition.GroupId,
+			Name:     rendition.Name,
+			Language: rendition.Language,
+			Default:  rendition.Default,
+		}
+		if rendition.Uri != `` {
+			if probeRendition.Url, err = MakeChunkUrl(baseUrl, rendition.Uri, downloader.PropagateQuery); err != nil {
+				return nil, err
+			}
+		}
+		result.Renditions = append(result.Renditions, probeRendition)
+	}
+	return &result, nil
+}
+
+// probeMedia describes the media playlist. The size is estimated by the average bytes per second of media of
+// ProbeSamples segments spread over the playlist.
+func (downloader *Downloader) probeMedia(playlistUrl string, data []byte, baseUrl *url.URL,
+	requestHeaders map[string]string) *ProbeMedia {
+	media := ProbeMedia{Url: playlistUrl, Encryption: `NONE`}
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, `#EXT-X-KEY:`):
+			if method := playlist.ParseAttributes(strings.TrimPrefix(line, `#EXT-X-KEY:`))[`METHOD`]; method != `NONE` {
+				media.Encryption = method
+			}
+		case strings.HasPrefix(line, `#EXT-X-PLAYLIST-TYPE:`):
+			media.PlaylistType = strings.TrimPrefix(line, `#EXT-X-PLAYLIST-TYPE:`)
+		}
+	}
+	p := playlist.Parse(io.NopCloser(bytes.NewReader(data)))
+	segments := make([]*playlist.Segment, 0)
+	for {
+		segment, err := p.GetSegment()
+		if err != nil {
+			media.Error = err.Error()
+			return &media
+		}
+		if segment == nil {
+			break
+		}
+		segments = append(segments, segment)
+	}
+	media.Segments, media.Duration = p.Totals()
+	media.TargetDuration = p.TargetDuration
+	media.Live = !p.EndList && media.PlaylistType != `VOD`
+	if len(segments) == 0 {
+		media.Error = playlist.ErrNoSegments.Error()
+		return &media
+	}
+	media.Container = segmentContainer(segments[0])
+
+	var sampledBytes int64
+	var sampledDuration float32
+	samples := min(max(downloader.ProbeSamples, 0), len(segments))
+	for i := 0; i < samples; i++ {
+		index := 0
+		if samples > 1 {
+			index = i * (len(segments) - 1) / (samples - 1)
+		}
+		segment := segments[index]
+		size := int64(0)
+		if segment.ByteRange != nil {
+			size = segment.ByteRange.Length
+		} else {
+			segmentUrl, err := MakeChunkUrl(baseUrl, segment.Uri, downloader.PropagateQuery)
+			if err != nil {
+				continue
+			}
+			if size, err = downloader.headSize(downloader.Rewriter.Rewrite(segmentUrl), requestHeaders); err != nil {
+				continue
+			}
+		}
+		if size > 0 && segment.Duration > 0 {
+			sampledBytes, sampledDuration = sampledBytes+size, sampledDuration+segment.Duration
+			media.Sampled++
+		}
+	}
+	if sampledDuration > 0 {
+		media.EstimatedSize = int64(float64(sampledBytes) / float64(sampledDuration) * float64(media.Duration))
+	}
+	return &media
+}
+
+// segmentContainer guesses the container of the segments by EXT-X-MAP and the URI extension.
+func segmentContainer(segment *playlist.Segment) string {
+	if segment.Map != nil {
+		return `fmp4`
+	}
+	u, err := url.Parse(segment.Uri)
+	if err != nil {
+		return `unknown`
+	}
+	switch ext := strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), `.`)); ext {
+	case `ts`:
+		return `ts`
+	case `m4s`, `mp4`, `m4a`, `m4v`, `cmfv`, `cmfa`:
+		return `fmp4`
+	case `aac`, `ac3`, `ec3`, `mp3`, `vtt`, `webvtt`:
+		return ext
+	}
+	return `unknown`
+}
+
+// headSize returns the Content-Length of the resource by HEAD.
+func (downloader *Downloader) headSize(resourceUrl string, requestHeaders map[string]string) (int64, error) {
+	request, err := http.NewRequestWithContext(downloader.ctx, http.MethodHead, resourceUrl, nil)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return 0, err
+	}
+	downloader.setHeaders(request, requestHeaders)
+	response, err := downloader.httpClient().Do(request)
+	if err != nil {
+		ErrorLog.Println(err)
+		return 0, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err := errors.Join(ErrHttpStatus, errors.New(fmt.Sprintf("HEAD %s %s", resourceUrl, response.Status)))
+		ErrorLog.Println(err.Error())
+		return 0, err
+	}
+	return response.ContentLength, nil
+}
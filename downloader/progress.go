@@ -0,0 +1,230 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"net"
+	"sync"
+	"time"
+)
+
+type Phase string
+
+const (
+	PhaseStarted   Phase = `started`
+	PhaseInit      Phase = `init` // downloading an init section (EXT-X-MAP)
+	PhaseSegment   Phase = `segment`
+	PhaseRetry     Phase = `retry`
+	PhaseWaiting   Phase = `waiting`   // a live mirror waits for the playlist update
+	PhaseSubtitles Phase = `subtitles` // downloading the subtitle rendition after the media
+	PhaseFinished  Phase = `finished`
+	PhaseFailed    Phase = `failed`
+	PhaseCancelled Phase = `cancelled`
+)
+
+type ErrorKind string
+
+const (
+	ErrorKindNone      ErrorKind = ``
+	ErrorKindCancelled ErrorKind = `cancelled`
+	ErrorKindNetwork   ErrorKind = `network`
+	ErrorKindHttp      ErrorKind = `http`
+	ErrorKindTruncated ErrorKind = `truncated`
+	ErrorKindInvalid   ErrorKind = `invalid`
+	ErrorKindPlaylist  ErrorKind = `playlist`
+	ErrorKindFfmpeg    ErrorKind = `ffmpeg`
+	ErrorKindOther     ErrorKind = `other`
+)
+
+// GetErrorKind classifies the error of a download.
+func GetErrorKind(err error) ErrorKind {
+	var netErr net.Error
+	var ffmpegErr *FfmpegError
+	switch {
+	case err == nil:
+		return ErrorKindNone
+	case errors.Is(err, ErrCancelled), errors.Is(err, context.Canceled), errors.Is(err, ErrFfmpegKilled):
+		return ErrorKindCancelled
+	case errors.Is(err, ErrHttpStatus):
+		return ErrorKindHttp
+	case errors.Is(err, ErrTruncatedSegment):
+		return ErrorKindTruncated
+	case errors.Is(err, ErrEmptySegment), errors.Is(err, ErrHtmlSegment), errors.Is(err, ErrTsSync),
+		errors.Is(err, ErrBmffBox), errors.Is(err, ErrSegmentSize):
+		return ErrorKindInvalid
+	case errors.Is(err, playlist.ErrNoSegments), errors.Is(err, ErrClipOutOfRange),
+		errors.Is(err, ErrClipLive):
+		return ErrorKindPlaylist
+	case errors.As(err, &ffmpegErr), errors.Is(err, ErrFfmpegNoInput):
+		return ErrorKindFfmpeg
+	case errors.As(err, &netErr):
+		return ErrorKindNetwork
+	}
+	return ErrorKindOther
+}
+
+// ProgressEvent is a snapshot of the download state. It is a value, so it is safe to keep and read it while the
+// download goes on.
+type ProgressEvent struct {
+	Phase         Phase
+	SegmentNum    int
+	SegmentUrl    string
+	SegmentBytes  int64 // got bytes of the current segment
+	SegmentSize   int64 // Content-Length of the current segment, 0 if unknown
+	Attempt       int   // attempt of the current segment, from 0
+	Bytes         int64
+	Duration      float32 // downloaded media seconds
+	TotalSegments int
+	TotalDuration float32
+	Rate          float64       // average bytes per second since the start
+	CurrentRate   float64       // bytes per second over the last CurrentRateWindow
+	MovingRate    float64       // bytes per second over the last MovingRateWindow
+	Eta           time.Duration // 0 if unknown (e.g. live)
+	Retries       int           // retries of all the segments
+	Failovers     int           // switches to another source (redundant variant or alternate host)
+	Source        string        // the source the segments are downloaded from now, empty if there are no alternatives
+	Sink          string        // the sink the output is written with: SinkName, or SinkFallback if that failed
+	SinkError     error         // why SinkName couldn't be used if it is SinkFallback
+	Error         error
+	ErrorKind     ErrorKind
+	Ffmpeg        FfmpegProgress
+	Started       time.Time
+	Time          time.Time
+}
+
+// Done tells if it is the final event of the download.
+func (event ProgressEvent) Done() bool {
+	return event.Phase == PhaseFinished || event.Phase == PhaseFailed || event.Phase == PhaseCancelled
+}
+
+// progressNotifier delivers events to the channel and the callback without blocking the download: an event not
+// taken yet is replaced by the newer one, so a slow consumer gets only the latest state.
+type progressNotifier struct {
+	mu        sync.Mutex
+	last      ProgressEvent
+	ffmpeg    FfmpegProgress
+	events    chan ProgressEvent
+	callbacks chan ProgressEvent
+	closed    bool
+}
+
+// coalesce puts the event into the channel of capacity 1, replacing the one not taken yet. It is called under mu,
+// so there is no other sender.
+func coalesce(ch chan ProgressEvent, event ProgressEvent) {
+	for {
+		select {
+		case ch <- event:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+func (notifier *progressNotifier) publish(event ProgressEvent) {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	notifier.publishLocked(event)
+}
+
+func (notifier *progressNotifier) publishLocked(event ProgressEvent) {
+	if notifier.closed {
+		return
+	}
+	event.Ffmpeg = notifier.ffmpeg
+	notifier.last = event
+	coalesce(notifier.events, event)
+	if notifier.callbacks != nil {
+		coalesce(notifier.callbacks, event)
+	}
+}
+
+func (notifier *progressNotifier) setFfmpeg(progress FfmpegProgress) {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	notifier.ffmpeg = progress
+	event := notifier.last
+	event.Time = time.Now()
+	notifier.publishLocked(event)
+}
+
+func (notifier *progressNotifier) Last() ProgressEvent {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	return notifier.last
+}
+
+// close is called after the final event, the pending events are still delivered.
+func (notifier *progressNotifier) close() {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	if notifier.closed {
+		return
+	}
+	notifier.closed = true
+	close(notifier.events)
+	if notifier.callbacks != nil {
+		close(notifier.callbacks)
+	}
+}
+
+// newProgressNotifier calls the callback (if any) from its own goroutine.
+func newProgressNotifier(callback func(event ProgressEvent)) *progressNotifier {
+	notifier := progressNotifier{events: make(chan ProgressEvent, 1)}
+	if callback != nil {
+		notifier.callbacks = make(chan ProgressEvent, 1)
+		go func() {
+			for event := range notifier.callbacks {
+				callback(event)
+			}
+		}()
+	}
+	return &notifier
+}
+
+// notify publishes the current state of the download. It is called from the download goroutine only.
+func (downloader *Downloader) notify() {
+	event := ProgressEvent{
+		Phase:         downloader.phase,
+		SegmentNum:    downloader.CurrentSegment.Num,
+		SegmentUrl:    downloader.CurrentSegment.Url,
+		SegmentBytes:  downloader.CurrentSegment.GotBytes,
+		SegmentSize:   downloader.CurrentSegment.Size,
+		Attempt:       downloader.attempt,
+		Bytes:         downloader.GotBytes,
+		Duration:      downloader.DownloadedDuration,
+		TotalSegments: downloader.TotalSegments(),
+		TotalDuration: downloader.TotalDuration(),
+		Retries:       downloader.retries,
+		Sink:          downloader.sinkUsed,
+		SinkError:     downloader.sinkFallbackError,
+		Error:         downloader.Error,
+		ErrorKind:     GetErrorKind(downloader.Error),
+		Started:       downloader.startedAt,
+		Time:          time.Now(),
+	}
+	if elapsed := event.Time.Sub(event.Started).Seconds(); elapsed > 0 {
+		event.Rate = float64(event.Bytes) / elapsed
+	}
+	if downloader.failover != nil {
+		event.Failovers = downloader.failover.Failovers
+		event.Source = downloader.failover.Current().String()
+	}
+	downloader.rateMeter.add(event.Time, downloader.receivedBytes)
+	event.CurrentRate = downloader.rateMeter.rate(CurrentRateWindow)
+	event.MovingRate = downloader.rateMeter.rate(MovingRateWindow)
+	event.Eta = downloader.eta(event.MovingRate)
+	downloader.progress.publish(event)
+}
+
+// Progress returns the latest state of the download, it is safe to call it from any goroutine.
+func (downloader *Downloader) Progress() ProgressEvent {
+	if downloader.progress == nil {
+		return ProgressEvent{}
+	}
+	return downloader.progress.Last()
+}
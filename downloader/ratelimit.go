@@ -0,0 +1,162 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimiterMaxSleep = 250 * time.Millisecond
+
+// RateLimiter is a token bucket limiting throughput in bytes per second. A limiter may have a parent, so a per-task
+// limit can be nested under a global one. Zero or negative rate means unlimited.
+type RateLimiter struct {
+	Parent *RateLimiter
+
+	mu     sync.Mutex
+	rate   int64
+	burst  int64
+	tokens float64
+	last   time.Time
+}
+
+func (limiter *RateLimiter) refill(now time.Time) {
+	if limiter.rate <= 0 {
+		limiter.tokens = 0
+		limiter.last = now
+		return
+	}
+	limiter.tokens = limiter.tokens + now.Sub(limiter.last).Seconds()*float64(limiter.rate)
+	if limiter.tokens > float64(limiter.burst) {
+		limiter.tokens = float64(limiter.burst)
+	}
+	limiter.last = now
+}
+
+// SetLimit changes rate and burst (both in bytes) and takes effect immediately, even for readers that are waiting.
+// Zero burst means one second worth of rate.
+func (limiter *RateLimiter) SetLimit(rate, burst int64) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill(time.Now())
+	if burst <= 0 {
+		burst = rate
+	}
+	limiter.rate = rate
+	limiter.burst = burst
+	if limiter.tokens > float64(burst) {
+		limiter.tokens = float64(burst)
+	}
+}
+
+func (limiter *RateLimiter) Limit() (int64, int64) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return limiter.rate, limiter.burst
+}
+
+// WaitN takes n bytes from the bucket (and from the parent's), sleeping while the bucket is in debt. It returns the
+// error of the context as soon as it is done.
+func (limiter *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if limiter == nil {
+		return nil
+	}
+	limiter.mu.Lock()
+	limiter.refill(time.Now())
+	if limiter.rate > 0 {
+		limiter.tokens = limiter.tokens - float64(n)
+	}
+	limiter.mu.Unlock()
+	for {
+		limiter.mu.Lock()
+		limiter.refill(time.Now())
+		if limiter.rate <= 0 || limiter.tokens >= 0 {
+			limiter.mu.Unlock()
+			break
+		}
+		wait := time.Duration(-limiter.tokens / float64(limiter.rate) * float64(time.Second))
+		limiter.mu.Unlock()
+		if wait > rateLimiterMaxSleep {
+			wait = rateLimiterMaxSleep
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return limiter.Parent.WaitN(ctx, n)
+}
+
+// Reader wraps r so every read is accounted in the limiter, a read waiting for the limiter fails once ctx is done.
+func (limiter *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &rateLimitedReader{r: r, limiter: limiter, ctx: ctx}
+}
+
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter *RateLimiter
+	ctx     context.Context
+}
+
+func (reader *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := reader.r.Read(p)
+	if n > 0 {
+		if waitErr := reader.limiter.WaitN(reader.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func NewRateLimiter(rate, burst int64, parent *RateLimiter) *RateLimiter {
+	limiter := RateLimiter{
+		Parent: parent,
+		last:   time.Now(),
+	}
+	limiter.SetLimit(rate, burst)
+	limiter.tokens = float64(limiter.burst)
+	return &limiter
+}
+
+// ParseRate parses a bytes per second value with an optional K, M or G (binary) suffix: "512K", "2M", "100000".
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), `B`)
+	if s == `` {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return 0, err
+	}
+	if n < 0 || math.IsInf(n, 0) || math.IsNaN(n) || n*float64(multiplier) >= math.MaxInt64 {
+		err := errors.New(fmt.Sprintf("bad rate: %s", s))
+		ErrorLog.Println(err.Error())
+		return 0, err
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,62 @@
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		rate int64
+		ok   bool
+	}{
+		{``, 0, true},
+		{`100000`, 100000, true},
+		{`512K`, 512 * 1024, true},
+		{`2M`, 2 * 1024 * 1024, true},
+		{`1.5MB`, 1536 * 1024, true},
+		{`1g`, 1024 * 1024 * 1024, true},
+		{`-1`, 0, false},
+		{`inf`, 0, false},
+		{`NaN`, 0, false},
+		{`1e30`, 0, false},
+		{`fast`, 0, false},
+	}
+	for _, test := range tests {
+		rate, err := ParseRate(test.s)
+		if (err == nil) != test.ok || rate != test.rate {
+			t.Errorf("ParseRate(%q) = %d, %v; want %d, ok %t", test.s, rate, err, test.rate, test.ok)
+		}
+	}
+}
+
+func TestWaitNCancel(t *testing.T) {
+	parent := NewRateLimiter(1024, 0, nil)
+	limiter := NewRateLimiter(0, 0, parent)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	// the parent bucket is 100 seconds in debt after this
+	if err := limiter.WaitN(ctx, 100*1024); err != context.Canceled {
+		t.Fatalf("WaitN() = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("WaitN returned in %s after the cancel", elapsed)
+	}
+}
+
+func TestWaitNLimit(t *testing.T) {
+	limiter := NewRateLimiter(10*1024, 1024, nil)
+	started := time.Now()
+	// 1K of burst, 2K more take 200ms
+	for i := 0; i < 3; i++ {
+		if err := limiter.WaitN(context.Background(), 1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("3K at 10K/s with 1K burst took %s", elapsed)
+	}
+}
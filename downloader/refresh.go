@@ -0,0 +1,288 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RefreshTimeout limits a call of a command or an endpoint refresher.
+const RefreshTimeout = 30 * time.Second
+
+var (
+	ErrRefresh     = errors.New(`can't refresh the URLs`)
+	ErrRefresherId = errors.New(`unknown refresher`)
+)
+
+// RefreshRequest describes the rejected request a refresher is called for.
+type RefreshRequest struct {
+	PlaylistUrl string `json:"playlist_url"` // the one the download was started with
+	SegmentUrl  string `json:"segment_url"`
+	Sequence    int    `json:"sequence"` // media sequence number, -1 for other resources
+	Status      int    `json:"status"`
+}
+
+// Refreshed is a result of a refresher: a playlist (master or media) to take the segment URLs from and headers to
+// set on the next requests. Both are optional.
+type Refreshed struct {
+	PlaylistUrl string            `json:"playlist_url,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// Refresher gets fresh URLs or headers when the server rejects the requests with 401 or 403, e.g. the signed URLs
+// have expired. The refresh is stopped when ctx is done.
+type Refresher interface {
+	Refresh(ctx context.Context, request RefreshRequest) (*Refreshed, error)
+}
+
+// PlaylistRefresher re-fetches the playlist the download was started with: a master playlist usually hands out
+// freshly signed variant URLs.
+type PlaylistRefresher struct{}
+
+func (PlaylistRefresher) Refresh(ctx context.Context, request RefreshRequest) (*Refreshed, error) {
+	return &Refreshed{PlaylistUrl: request.PlaylistUrl}, nil
+}
+
+// CommandRefresher runs the command with sh -c. The request is in HLS_PLAYLIST_URL, HLS_SEGMENT_URL, HLS_SEQUENCE
+// and HLS_STATUS environment variables. The command prints a Refreshed JSON or just a playlist URL. It is killed
+// after RefreshTimeout.
+type CommandRefresher struct {
+	Command string
+}
+
+func (refresher CommandRefresher) Refresh(ctx context.Context, request RefreshRequest) (*Refreshed, error) {
+	ctx, cancel := context.WithTimeout(ctx, RefreshTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, `sh`, `-c`, refresher.Command)
+	// the children of the shell could keep the output open after it is killed
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(),
+		`HLS_PLAYLIST_URL=`+request.PlaylistUrl,
+		`HLS_SEGMENT_URL=`+request.SegmentUrl,
+		`HLS_SEQUENCE=`+strconv.Itoa(request.Sequence),
+		`HLS_STATUS=`+strconv.Itoa(request.Status),
+	)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		err = errors.Join(ErrRefresh, errors.New(fmt.Sprintf("'%s': %s", refresher.Command, err.Error())))
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return parseRefreshed(output)
+}
+
+// HttpRefresher POSTs the request as JSON to the endpoint, which responds with a Refreshed JSON or just a playlist
+// URL. The request times out after RefreshTimeout.
+type HttpRefresher struct {
+	Url string
+}
+
+func (refresher HttpRefresher) Refresh(ctx context.Context, request RefreshRequest) (*Refreshed, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, refresher.Url, bytes.NewReader(body))
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, errors.Join(ErrRefresh, err)
+	}
+	httpRequest.Header.Set(`Content-Type`, `application/json`)
+	response, err := (&http.Client{Timeout: RefreshTimeout}).Do(httpRequest)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, errors.Join(ErrRefresh, err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, errors.Join(ErrRefresh, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		err := errors.Join(ErrRefresh, ErrHttpStatus, errors.New(fmt.Sprintf("%s %s", refresher.Url, response.Status)))
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return parseRefreshed(data)
+}
+
+// parseRefreshed parses the output of a refresher: a Refreshed JSON or a playlist URL.
+func parseRefreshed(data []byte) (*Refreshed, error) {
+	data = bytes.TrimSpace(data)
+	var refreshed Refreshed
+	if bytes.HasPrefix(data, []byte(`{`)) {
+		if err := json.Unmarshal(data, &refreshed); err != nil {
+			ErrorLog.Println(err.Error())
+			return nil, errors.Join(ErrRefresh, err)
+		}
+		return &refreshed, nil
+	}
+	if len(data) == 0 {
+		err := errors.Join(ErrRefresh, errors.New(`empty output`))
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	refreshed.PlaylistUrl = string(data)
+	return &refreshed, nil
+}
+
+// ParseRefresher makes the refresher by its spec: 'playlist', 'cmd:<command>' or a http(s) URL of an endpoint.
+func ParseRefresher(spec string) (Refresher, error) {
+	switch {
+	case spec == `playlist`:
+		return PlaylistRefresher{}, nil
+	case strings.HasPrefix(spec, `cmd:`):
+		return CommandRefresher{Command: strings.TrimPrefix(spec, `cmd:`)}, nil
+	case strings.HasPrefix(spec, `http://`) || strings.HasPrefix(spec, `https://`):
+		return HttpRefresher{Url: spec}, nil
+	}
+	err := errors.Join(ErrRefresherId, errors.New(spec))
+	ErrorLog.Println(err.Error())
+	return nil, err
+}
+
+// setHeaders sets the request headers and the ones got from the refresher over them.
+func (downloader *Downloader) setHeaders(request *http.Request, requestHeaders map[string]string) {
+	for k, v := range requestHeaders {
+		request.Header.Set(k, v)
+	}
+	for k, v := range downloader.refreshedHeaders {
+		request.Header.Set(k, v)
+	}
+}
+
+// refresh calls the Refresher for the rejected resource and applies the result: the headers are set on the next
+// requests and the segment URLs are taken from the refreshed playlist.
+func (downloader *Downloader) refresh(resourceUrl string, sequence int, status int,
+	requestHeaders map[string]string) error {
+	ErrorLog.Printf("Refreshing the URLs after %d for %s\n", status, resourceUrl)
+	refreshed, err := downloader.Refresher.Refresh(downloader.ctx, RefreshRequest{
+		PlaylistUrl: downloader.playlistUrl,
+		SegmentUrl:  resourceUrl,
+		Sequence:    sequence,
+		Status:      status,
+	})
+	if err != nil {
+		return err
+	}
+	if len(refreshed.Headers) > 0 {
+		headers := make(map[string]string)
+		for k, v := range downloader.refreshedHeaders {
+			headers[k] = v
+		}
+		for k, v := range refreshed.Headers {
+			headers[k] = v
+		}
+		downloader.refreshedHeaders = headers
+	}
+	if refreshed.PlaylistUrl == `` {
+		return nil
+	}
+	return downloader.loadRefreshed(refreshed.PlaylistUrl, requestHeaders)
+}
+
+// loadRefreshed reads the segment URLs from the refreshed playlist. Of a master playlist the variant of the same
+// stream (see playlist.Variant.StreamKey) as the one being downloaded is taken. Other resources (e.g. init sections) get the query
+// parameters of the refreshed media playlist, as signed tokens usually are.
+func (downloader *Downloader) loadRefreshed(playlistUrl string, requestHeaders map[string]string) error {
+	data, baseUrl, err := downloader.fetchPlaylist(playlistUrl, requestHeaders)
+	if err != nil {
+		return err
+	}
+	if playlist.IsMaster(data) {
+		group := downloader.variantGroup(data)
+		if group == nil {
+			err := errors.Join(ErrRefresh, playlist.ErrNoSegments)
+			ErrorLog.Println(err.Error())
+			return err
+		}
+		variant := group[0]
+		for _, v := range playlist.ParseMaster(data) {
+			if downloader.variant != nil && v.StreamKey() == downloader.variant.StreamKey() {
+				variant = v
+				break
+			}
+		}
+		variantUrl, err := MakeChunkUrl(baseUrl, variant.Uri, downloader.PropagateQuery)
+		if err != nil {
+			return err
+		}
+		if data, baseUrl, err = downloader.fetchPlaylist(variantUrl, requestHeaders); err != nil {
+			return err
+		}
+	}
+	segments := make(map[int]string)
+	p := playlist.Parse(io.NopCloser(bytes.NewReader(data)))
+	for {
+		segment, err := p.GetSegment()
+		if err != nil {
+			return err
+		}
+		if segment == nil {
+			break
+		}
+		segmentUrl, err := MakeChunkUrl(baseUrl, segment.Uri, downloader.PropagateQuery)
+		if err != nil {
+			return err
+		}
+		segments[segment.Sequence] = downloader.Rewriter.Rewrite(segmentUrl)
+	}
+	downloader.refreshedSegments, downloader.refreshedQuery = segments, baseUrl.RawQuery
+	DebugLog.Printf("Refreshed %d segment URLs from %s\n", len(segments), baseUrl)
+	return nil
+}
+
+// refreshedUrl returns the URL of the resource from the refreshed playlist, as is if there was no refresh. Other
+// resources get the parameters of the refreshed playlist in place of theirs with the same names, the rest of the
+// query is kept byte for byte (a signature may cover its exact form).
+func (downloader *Downloader) refreshedUrl(resourceUrl string, sequence int) string {
+	if segmentUrl, ok := downloader.refreshedSegments[sequence]; ok && sequence >= 0 {
+		return segmentUrl
+	}
+	if downloader.refreshedQuery == `` {
+		return resourceUrl
+	}
+	base, query, hasQuery := strings.Cut(resourceUrl, `?`)
+	if !hasQuery {
+		return resourceUrl
+	}
+	query, fragment, hasFragment := strings.Cut(query, `#`)
+	fresh := make(map[string][]string)
+	for _, pair := range strings.Split(downloader.refreshedQuery, `&`) {
+		if name, ok := queryPairName(pair); ok {
+			fresh[name] = append(fresh[name], pair)
+		}
+	}
+	// all the pairs of a name are replaced by the fresh ones at the place of the first of them
+	pairs := make([]string, 0)
+	replaced := make(map[string]bool)
+	for _, pair := range strings.Split(query, `&`) {
+		name, ok := queryPairName(pair)
+		if freshPairs, found := fresh[name]; ok && found {
+			if !replaced[name] {
+				pairs = append(pairs, freshPairs...)
+				replaced[name] = true
+			}
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	resourceUrl = base + `?` + strings.Join(pairs, `&`)
+	if hasFragment {
+		resourceUrl = resourceUrl + `#` + fragment
+	}
+	return resourceUrl
+}
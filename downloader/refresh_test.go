@@ -0,0 +1,61 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefreshedUrl(t *testing.T) {
+	downloader := Downloader{refreshedSegments: map[int]string{5: `https://cdn.example.com/5.ts?token=new`}}
+	if u := downloader.refreshedUrl(`https://cdn.example.com/5.ts?token=old`, 5); u != `https://cdn.example.com/5.ts?token=new` {
+		t.Errorf("refreshedUrl() of a segment = %s", u)
+	}
+	downloader.refreshedQuery = `token=new%2Fa&b=1&b=2&Expires=9`
+	tests := []struct {
+		resourceUrl string
+		want        string
+	}{
+		{`https://cdn.example.com/init.mp4`, `https://cdn.example.com/init.mp4`},
+		// the other pairs keep their order and escaping
+		{`https://cdn.example.com/init.mp4?z=%7e&token=old&a=x+y`,
+			`https://cdn.example.com/init.mp4?z=%7e&token=new%2Fa&a=x+y`},
+		{`https://cdn.example.com/key?b=0&sig=a%2Bb&b=3&Expires=1`,
+			`https://cdn.example.com/key?b=1&b=2&sig=a%2Bb&Expires=9`},
+		{`https://cdn.example.com/key?other=1#frag`, `https://cdn.example.com/key?other=1#frag`},
+	}
+	for _, test := range tests {
+		if u := downloader.refreshedUrl(test.resourceUrl, -1); u != test.want {
+			t.Errorf("refreshedUrl(%s) = %s, want %s", test.resourceUrl, u, test.want)
+		}
+	}
+}
+
+func TestRefresherCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	request := RefreshRequest{PlaylistUrl: `https://cdn.example.com/index.m3u8`, Sequence: -1, Status: 403}
+	// the sleep keeps the output of the killed shell open
+	for _, refresher := range []Refresher{CommandRefresher{Command: `sleep 10 2>/dev/null; echo https://x/`},
+		HttpRefresher{Url: server.URL}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		started := time.Now()
+		_, err := refresher.Refresh(ctx, request)
+		cancel()
+		if !errors.Is(err, ErrRefresh) || time.Since(started) > 5*time.Second {
+			t.Errorf("%T: Refresh() = %v after %s, want %v at the cancel", refresher, err, time.Since(started),
+				ErrRefresh)
+		}
+	}
+	refreshed, err := CommandRefresher{Command: `echo "$HLS_STATUS $HLS_SEQUENCE"`}.Refresh(context.Background(), request)
+	if err != nil || refreshed.PlaylistUrl != `403 -1` {
+		t.Errorf("Refresh() = %+v, %v", refreshed, err)
+	}
+}
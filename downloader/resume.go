@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrResumeMismatch = errors.New(`can't resume the download`)
+
+	regexpContentRange = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+|\*)$`)
+)
+
+// resume requests the rest of the resource from the received bytes (within the original byte range if any). If-Range
+// and the validators of the first response make sure it is the same object, so a changed one isn't stitched together.
+func (downloader *Downloader) resume(chunkUrl string, requestHeaders map[string]string, first *http.Response,
+	received int64) (*http.Response, error) {
+	start, end := received, ``
+	if match := regexpRange.FindStringSubmatch(requestHeaders[`Range`]); match != nil {
+		offset, _ := strconv.ParseInt(match[1], 10, 64)
+		start, end = offset+received, match[2]
+	}
+	headers := make(map[string]string)
+	for k, v := range requestHeaders {
+		headers[k] = v
+	}
+	headers[`Range`] = fmt.Sprintf("bytes=%d-%s", start, end)
+	etag, lastModified := first.Header.Get(`ETag`), first.Header.Get(`Last-Modified`)
+	switch {
+	case etag != `` && !strings.HasPrefix(etag, `W/`): // weak ETags can't be used in If-Range
+		headers[`If-Range`] = etag
+	case lastModified != ``:
+		headers[`If-Range`] = lastModified
+	}
+	response, err := downloader.get(chunkUrl, headers)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResume(first, response, start, requestHeaders[`Range`] == ``); err != nil {
+		response.Body.Close()
+		err = errors.Join(err, errors.New(chunkUrl))
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return response, nil
+}
+
+// validateResume checks that the response is the requested part of the same object. The total size is checked only
+// if the whole object was requested first.
+func validateResume(first, response *http.Response, start int64, whole bool) error {
+	if response.StatusCode != http.StatusPartialContent {
+		// e.g. If-Range didn't match, so the whole changed object is sent
+		return errors.Join(ErrResumeMismatch, errors.New(fmt.Sprintf("got '%s' for the range", response.Status)))
+	}
+	contentRange := response.Header.Get(`Content-Range`)
+	match := regexpContentRange.FindStringSubmatch(contentRange)
+	if match == nil || match[1] != strconv.FormatInt(start, 10) {
+		return errors.Join(ErrResumeMismatch, errors.New(fmt.Sprintf("Content-Range '%s' doesn't start at %d",
+			contentRange, start)))
+	}
+	if whole && first.ContentLength > 0 && match[3] != `*` && match[3] != strconv.FormatInt(first.ContentLength, 10) {
+		return errors.Join(ErrResumeMismatch, errors.New(fmt.Sprintf("the size is %s, it was %d", match[3],
+			first.ContentLength)))
+	}
+	for _, name := range []string{`ETag`, `Last-Modified`} {
+		if value := first.Header.Get(name); value != `` && response.Header.Get(name) != value {
+			return errors.Join(ErrResumeMismatch, errors.New(fmt.Sprintf("%s changed from %s to %s", name, value,
+				response.Header.Get(name))))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	rewriteSeparator  = `=>`
+	rewriteHostPrefix = `host:`
+)
+
+// RewriteRule either maps hosts (Host is a regexp matched against the whole host name, To may reference its groups as
+// $1) or rewrites the whole URL (Regexp and Replace, with the same substitution syntax).
+type RewriteRule struct {
+	Host    string `json:"host,omitempty"`
+	To      string `json:"to,omitempty"`
+	Regexp  string `json:"regexp,omitempty"`
+	Replace string `json:"replace,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (rule *RewriteRule) compile() error {
+	var err error
+	switch {
+	case rule.Host != `` && rule.Regexp != ``:
+		err = errors.New(fmt.Sprintf("rule has both host '%s' and regexp '%s'", rule.Host, rule.Regexp))
+	case rule.Host != ``:
+		rule.re, err = regexp.Compile(`^(?:` + rule.Host + `)$`)
+	case rule.Regexp != ``:
+		rule.re, err = regexp.Compile(rule.Regexp)
+	default:
+		err = errors.New(`rule has neither host nor regexp`)
+	}
+	if err != nil {
+		ErrorLog.Println(err.Error())
+	}
+	return err
+}
+
+func (rule *RewriteRule) Apply(rawUrl string) string {
+	if rule.re == nil {
+		return rawUrl
+	}
+	if rule.Regexp != `` {
+		return rule.re.ReplaceAllString(rawUrl, rule.Replace)
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == `` || !rule.re.MatchString(u.Hostname()) {
+		return rawUrl
+	}
+	host := rule.re.ReplaceAllString(u.Hostname(), rule.To)
+	if port := u.Port(); port != `` && !strings.Contains(host, `:`) {
+		host = host + `:` + port
+	}
+	u.Host = host
+	return u.String()
+}
+
+func (rule *RewriteRule) String() string {
+	if rule.Host != `` {
+		return rewriteHostPrefix + rule.Host + rewriteSeparator + rule.To
+	}
+	return rule.Regexp + rewriteSeparator + rule.Replace
+}
+
+// Rewriter applies its rules in order, each one to the result of the previous.
+type Rewriter struct {
+	Rules []*RewriteRule
+}
+
+func (rewriter *Rewriter) Rewrite(rawUrl string) string {
+	if rewriter == nil {
+		return rawUrl
+	}
+	for _, rule := range rewriter.Rules {
+		rawUrl = rule.Apply(rawUrl)
+	}
+	return rawUrl
+}
+
+func NewRewriter(rules ...*RewriteRule) (*Rewriter, error) {
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &Rewriter{Rules: rules}, nil
+}
+
+// ParseRewriteRule parses an inline rule: 'regexp=>replacement' or 'host:hostregexp=>newhost'.
+func ParseRewriteRule(s string) (*RewriteRule, error) {
+	parts := strings.SplitN(s, rewriteSeparator, 2)
+	if len(parts) != 2 {
+		err := errors.New(fmt.Sprintf("rewrite rule '%s' has no '%s'", s, rewriteSeparator))
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	rule := RewriteRule{Regexp: parts[0], Replace: parts[1]}
+	if strings.HasPrefix(parts[0], rewriteHostPrefix) {
+		rule = RewriteRule{Host: strings.TrimPrefix(parts[0], rewriteHostPrefix), To: parts[1]}
+	}
+	if err := rule.compile(); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// LoadRewriteRules reads a JSON array of rules, e.g.
+// [{"host": "vh74.vhcdn.com", "to": "2lfkbh0yxg.a.trbcdn.net"}, {"regexp": "^http://", "replace": "https://"}]
+func LoadRewriteRules(filename string) ([]*RewriteRule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	rules := make([]*RewriteRule, 0)
+	if err := json.Unmarshal(data, &rules); err != nil {
+		ErrorLog.Printf("%s: %s\n", filename, err.Error())
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// ParseRewriteRules turns a list of inline rules and rule file names (anything without '=>') into a Rewriter.
+func ParseRewriteRules(values []string) (*Rewriter, error) {
+	rules := make([]*RewriteRule, 0)
+	for _, value := range values {
+		if strings.Contains(value, rewriteSeparator) {
+			rule, err := ParseRewriteRule(value)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+			continue
+		}
+		fileRules, err := LoadRewriteRules(value)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+	return &Rewriter{Rules: rules}, nil
+}
@@ -0,0 +1,384 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/remux"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const DefaultStoreLayout = `{{.Date}}/{{.Num}}{{.Ext}}`
+
+var (
+	ErrUnknownSink = errors.New(`unknown sink`)
+
+	Sinks = map[string]SinkFactory{
+		`file`:   NewFileSink,
+		`ffmpeg`: NewFfmpegSink,
+		`stdout`: NewStdoutSink,
+		`dir`:    NewDirSink,
+		`store`:  NewStoreSink,
+		`mp4`:    NewMp4Sink,
+		`fmp4`:   NewFragmentedMp4Sink,
+		`m4a`:    NewM4aSink,
+		`aac`:    NewAacSink,
+	}
+)
+
+// SegmentInfo describes the segment passed to a Sink along with its data.
+type SegmentInfo struct {
+	Num      int
+	Url      string
+	Duration float32
+	IsMap    bool
+}
+
+// Ext returns the segment file extension from its URL (.ts if there is none).
+func (info SegmentInfo) Ext() string {
+	ext := path.Ext(strings.SplitN(strings.SplitN(info.Url, `?`, 2)[0], `#`, 2)[0])
+	if ext == `` || len(ext) > 5 {
+		if info.IsMap {
+			return `.mp4`
+		}
+		return `.ts`
+	}
+	return ext
+}
+
+// Sink receives complete validated segments in playlist order.
+type Sink interface {
+	WriteSegment(info SegmentInfo, data []byte) error
+	Close() error
+}
+
+// Trimmer is a Sink that can cut the output precisely: start and duration (0 - till the end) are relative to the
+// start of the first segment.
+type Trimmer interface {
+	Trim(start, duration time.Duration)
+}
+
+// Aborter is a Sink that can be stopped without finishing its output (e.g. on cancel).
+type Aborter interface {
+	Abort() error
+}
+
+type SinkOptions struct {
+	Filename       string
+	StoreLayout    string
+	FfmpegArgs     []string
+	FfmpegProfile  string
+	FfmpegProgress func(progress FfmpegProgress)
+}
+
+type SinkFactory func(options SinkOptions) (Sink, error)
+
+func SinkNames() []string {
+	names := make([]string, 0, len(Sinks))
+	for name := range Sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func NewSink(name string, options SinkOptions) (Sink, error) {
+	factory, ok := Sinks[name]
+	if !ok {
+		err := errors.Join(ErrUnknownSink, errors.New(fmt.Sprintf("'%s' (known: %s)", name,
+			strings.Join(SinkNames(), `, `))))
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return factory(options)
+}
+
+// writerSink writes segments one after another into a single stream.
+type writerSink struct {
+	w io.WriteCloser
+}
+
+func (sink *writerSink) WriteSegment(info SegmentInfo, data []byte) error {
+	_, err := sink.w.Write(data)
+	return err
+}
+
+func (sink *writerSink) Close() error {
+	return sink.w.Close()
+}
+
+func NewFileSink(options SinkOptions) (Sink, error) {
+	f, err := os.Create(options.Filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return &writerSink{w: f}, nil
+}
+
+// RemuxSink converts MPEG-TS segments to MP4 natively, without ffmpeg. Fragmented MP4 segments are defragmented
+// into progressive MP4, or written as they are if the output is fragmented (and not audio-only).
+type RemuxSink struct {
+	remuxer    *remux.Remuxer
+	w          io.Writer
+	file       *os.File
+	fragmented bool
+	audioOnly  bool
+	input      string
+}
+
+func (sink *RemuxSink) WriteSegment(info SegmentInfo, data []byte) error {
+	input := `ts`
+	switch {
+	case IsBmff(data):
+		input = `fmp4`
+	case !IsTs(data):
+		return errors.Join(remux.ErrNotTs, errors.New(info.Url))
+	}
+	if sink.input == `` {
+		sink.input = input
+	} else if sink.input != input {
+		err := errors.New(fmt.Sprintf("%s: got %s segment in %s stream", info.Url, input, sink.input))
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if input == `fmp4` && sink.fragmented && !sink.audioOnly {
+		_, err := sink.w.Write(data)
+		return err
+	}
+	_, err := sink.remuxer.Write(data)
+	return err
+}
+
+// Trim cuts the progressive output with edit lists, fragmented output is not trimmed.
+func (sink *RemuxSink) Trim(start, duration time.Duration) {
+	if !sink.fragmented {
+		sink.remuxer.Trim(start, duration)
+	}
+}
+
+func (sink *RemuxSink) Close() error {
+	var err error
+	if sink.input != `fmp4` || !sink.fragmented || sink.audioOnly {
+		err = sink.remuxer.Close()
+	}
+	if err != nil {
+		ErrorLog.Println(err.Error())
+	}
+	if sink.file != nil {
+		if closeErr := sink.file.Close(); closeErr != nil && err == nil {
+			ErrorLog.Println(closeErr.Error())
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// NewMp4Sink writes progressive MP4, or fragmented MP4 to stdout if the filename is '-'.
+func NewMp4Sink(options SinkOptions) (Sink, error) {
+	if options.Filename == `-` {
+		return NewFragmentedMp4Sink(options)
+	}
+	f, err := os.Create(options.Filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	remuxer, err := remux.NewRemuxer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &RemuxSink{remuxer: remuxer, w: f, file: f}, nil
+}
+
+func NewFragmentedMp4Sink(options SinkOptions) (Sink, error) {
+	if options.Filename == `-` {
+		return &RemuxSink{remuxer: remux.NewFragmentedRemuxer(os.Stdout), w: os.Stdout, fragmented: true}, nil
+	}
+	f, err := os.Create(options.Filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return &RemuxSink{remuxer: remux.NewFragmentedRemuxer(f), w: f, file: f, fragmented: true}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// NewStdoutSink writes the stream to stdout for piping into other tools. Nothing else should write to stdout then.
+func NewStdoutSink(options SinkOptions) (Sink, error) {
+	return &writerSink{w: nopCloser{os.Stdout}}, nil
+}
+
+// DirSink writes every segment into its own numbered file in the directory.
+type DirSink struct {
+	Dir string
+}
+
+func (sink *DirSink) WriteSegment(info SegmentInfo, data []byte) error {
+	name := fmt.Sprintf("%05d%s", info.Num, info.Ext())
+	if info.IsMap {
+		name = fmt.Sprintf("init-%05d%s", info.Num, info.Ext())
+	}
+	if err := os.WriteFile(filepath.Join(sink.Dir, name), data, 0644); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (sink *DirSink) Close() error {
+	return nil
+}
+
+func NewDirSink(options SinkOptions) (Sink, error) {
+	if err := os.MkdirAll(options.Filename, 0755); err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	return &DirSink{Dir: options.Filename}, nil
+}
+
+type StoreObjectMeta struct {
+	Key         string    `json:"key"`
+	Url         string    `json:"url"`
+	Num         int       `json:"num"`
+	Duration    float32   `json:"duration"`
+	IsMap       bool      `json:"is_map"`
+	Size        int       `json:"size"`
+	Sha256      string    `json:"sha256"`
+	StoredAt    time.Time `json:"stored_at"`
+	ContentType string    `json:"content_type"`
+}
+
+// StoreSink lays segments out like objects in a bucket: the key of every object is made by the Layout template
+// (fields: Date, Num, Ext, Base) and every object gets a '<key>.meta.json' sidecar. An 'index.json' with all
+// the objects is written on Close.
+type StoreSink struct {
+	Root    string
+	Layout  *template.Template
+	Started time.Time
+	Objects []StoreObjectMeta
+}
+
+func (sink *StoreSink) key(info SegmentInfo) (string, error) {
+	var data struct {
+		Date string
+		Num  string
+		Ext  string
+		Base string
+	}
+	data.Date = sink.Started.Format(`2006/01/02`)
+	data.Num = fmt.Sprintf("%05d", info.Num)
+	if info.IsMap {
+		data.Num = `init-` + data.Num
+	}
+	data.Ext = info.Ext()
+	data.Base = path.Base(strings.SplitN(info.Url, `?`, 2)[0])
+	key := strings.Builder{}
+	if err := sink.Layout.Execute(&key, data); err != nil {
+		ErrorLog.Println(err.Error())
+		return ``, err
+	}
+	return path.Clean(`/` + key.String())[1:], nil
+}
+
+func (sink *StoreSink) put(key string, data []byte) error {
+	filename := filepath.Join(sink.Root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (sink *StoreSink) WriteSegment(info SegmentInfo, data []byte) error {
+	key, err := sink.key(info)
+	if err != nil {
+		return err
+	}
+	if err := sink.put(key, data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	meta := StoreObjectMeta{
+		Key:      key,
+		Url:      info.Url,
+		Num:      info.Num,
+		Duration: info.Duration,
+		IsMap:    info.IsMap,
+		Size:     len(data),
+		Sha256:   hex.EncodeToString(sum[:]),
+		StoredAt: time.Now(),
+	}
+	switch {
+	case IsTs(data):
+		meta.ContentType = `video/mp2t`
+	case IsBmff(data):
+		meta.ContentType = `video/mp4`
+	default:
+		meta.ContentType = `application/octet-stream`
+	}
+	metaData, err := json.MarshalIndent(meta, ``, `  `)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if err := sink.put(key+`.meta.json`, metaData); err != nil {
+		return err
+	}
+	sink.Objects = append(sink.Objects, meta)
+	return nil
+}
+
+func (sink *StoreSink) Close() error {
+	data, err := json.MarshalIndent(sink.Objects, ``, `  `)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return sink.put(`index.json`, data)
+}
+
+func NewStoreSink(options SinkOptions) (Sink, error) {
+	layout := options.StoreLayout
+	if layout == `` {
+		layout = DefaultStoreLayout
+	}
+	t, err := template.New(``).Parse(layout)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	if err := os.MkdirAll(options.Filename, 0755); err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	sink := StoreSink{
+		Root:    options.Filename,
+		Layout:  t,
+		Started: time.Now(),
+		Objects: make([]StoreObjectMeta, 0),
+	}
+	return &sink, nil
+}
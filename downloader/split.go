@@ -0,0 +1,202 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSplitPart = errors.New(`bad part of the split download`)
+
+// splitRanges divides length bytes from offset into parts ranges of about the same size.
+func splitRanges(offset, length int64, parts int) []playlist.ByteRange {
+	parts = int(min(int64(parts), length))
+	ranges := make([]playlist.ByteRange, 0, parts)
+	for i := 0; i < parts; i++ {
+		start, end := length*int64(i)/int64(parts), length*int64(i+1)/int64(parts)
+		ranges = append(ranges, playlist.ByteRange{Offset: offset + start, Length: end - start})
+	}
+	return ranges
+}
+
+// fetch downloads the resource: in SplitParts concurrent byte ranges if it is SplitThreshold bytes or larger,
+// in a single request otherwise. The size of a byte range segment is known, of a whole resource it is in the
+// Content-Range of its first part: the part is requested as a range, and the rest in SplitParts-1 ranges then (in one
+// if it is smaller than SplitThreshold). A server that ignores ranges sends all of it at once.
+func (downloader *Downloader) fetch(chunkUrl string, byteRange *playlist.ByteRange, requestHeaders map[string]string,
+	stats *SegmentStats) ([]byte, string, error) {
+	if downloader.SplitParts < 2 || downloader.SplitThreshold <= 0 ||
+		(byteRange != nil && byteRange.Length < downloader.SplitThreshold) {
+		data, contentType, _, err := downloader.downloadChunk(chunkUrl, requestHeaders, stats)
+		return data, contentType, err
+	}
+	if byteRange != nil {
+		ranges := splitRanges(byteRange.Offset, byteRange.Length, downloader.SplitParts)
+		return downloader.downloadSplit(chunkUrl, ranges, byteRange.Length, nil, requestHeaders, stats)
+	}
+	first := max(downloader.SplitThreshold/int64(downloader.SplitParts), 1)
+	headers := make(map[string]string)
+	for k, v := range requestHeaders {
+		headers[k] = v
+	}
+	headers[`Range`] = fmt.Sprintf("bytes=0-%d", first-1)
+	data, contentType, header, err := downloader.downloadChunk(chunkUrl, headers, stats)
+	if err != nil || stats.Status != http.StatusPartialContent {
+		return data, contentType, err
+	}
+	contentRange := header.Get(`Content-Range`)
+	match := regexpContentRange.FindStringSubmatch(contentRange)
+	if match == nil || match[1] != `0` || match[2] != strconv.Itoa(len(data)-1) || match[3] == `*` {
+		err := errors.Join(ErrSplitPart, errors.New(fmt.Sprintf("Content-Range '%s' for %s", contentRange,
+			headers[`Range`])))
+		ErrorLog.Println(err.Error())
+		return nil, contentType, err
+	}
+	size, _ := strconv.ParseInt(match[3], 10, 64)
+	stats.Parts = 1
+	if int64(len(data)) >= size {
+		return data, contentType, nil
+	}
+	parts := downloader.SplitParts - 1
+	if size < downloader.SplitThreshold {
+		parts = 1
+	}
+	ranges := splitRanges(int64(len(data)), size-int64(len(data)), parts)
+	rest, _, err := downloader.downloadSplit(chunkUrl, ranges, size, header, requestHeaders, stats)
+	if err != nil {
+		return nil, contentType, err
+	}
+	return append(data, rest...), contentType, nil
+}
+
+// countingReader adds the bytes read to the counter shared by the parts.
+type countingReader struct {
+	reader  io.Reader
+	counter *atomic.Int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.counter.Add(int64(n))
+	return n, err
+}
+
+type splitPart struct {
+	data        []byte
+	contentType string
+	status      int
+	header      http.Header
+	ttfb        time.Duration
+	err         error
+}
+
+// downloadPart downloads one range. The response must be exactly the requested part of the object the validators
+// (if any) belong to.
+func (downloader *Downloader) downloadPart(ctx context.Context, chunkUrl string, byteRange playlist.ByteRange,
+	validators http.Header, requestHeaders map[string]string, counter *atomic.Int64) splitPart {
+	headers := make(map[string]string)
+	for k, v := range requestHeaders {
+		headers[k] = v
+	}
+	headers[`Range`] = byteRange.Header()
+	started := time.Now()
+	response, err := downloader.getWithContext(ctx, chunkUrl, headers)
+	if err != nil {
+		return splitPart{err: err}
+	}
+	defer response.Body.Close()
+	part := splitPart{contentType: response.Header.Get(`Content-Type`), status: response.StatusCode,
+		header: response.Header, ttfb: time.Since(started)}
+	if response.StatusCode != http.StatusPartialContent {
+		part.err = errors.Join(ErrHttpStatus, errors.New(fmt.Sprintf("%s %s for %s", chunkUrl, response.Status,
+			headers[`Range`])))
+		return part
+	}
+	contentRange := response.Header.Get(`Content-Range`)
+	match := regexpContentRange.FindStringSubmatch(contentRange)
+	if match == nil || match[1] != strconv.FormatInt(byteRange.Offset, 10) ||
+		match[2] != strconv.FormatInt(byteRange.Offset+byteRange.Length-1, 10) {
+		part.err = errors.Join(ErrSplitPart, errors.New(fmt.Sprintf("Content-Range '%s' for %s", contentRange,
+			headers[`Range`])))
+		return part
+	}
+	for _, name := range []string{`ETag`, `Last-Modified`} {
+		if value := validators.Get(name); value != `` && response.Header.Get(name) != value {
+			part.err = errors.Join(ErrSplitPart, errors.New(fmt.Sprintf("%s changed from %s to %s", name, value,
+				response.Header.Get(name))))
+			return part
+		}
+	}
+	body := &countingReader{reader: downloader.RateLimiter.Reader(ctx, response.Body), counter: counter}
+	part.data, part.err = io.ReadAll(body)
+	if part.err == nil && int64(len(part.data)) != byteRange.Length {
+		part.err = errors.Join(ErrTruncatedSegment, errors.New(fmt.Sprintf("got %d bytes of %s range",
+			len(part.data), byteRange.String())))
+	}
+	return part
+}
+
+// downloadSplit downloads the ranges of the resource of size bytes in parallel and joins them in order. The parts
+// must be of the object the validators (the ETag and Last-Modified of a response, if any) belong to. A failed part
+// cancels the others, the whole resource is retried then.
+func (downloader *Downloader) downloadSplit(chunkUrl string, ranges []playlist.ByteRange, size int64,
+	validators http.Header, requestHeaders map[string]string, stats *SegmentStats) ([]byte, string, error) {
+	DebugLog.Printf("Downloading %s in %d parts\n", chunkUrl, stats.Parts+len(ranges))
+	ctx, cancel := context.WithCancel(downloader.ctx)
+	defer cancel()
+	// the bytes of the first part (if it is downloaded already) are counted
+	var counter atomic.Int64
+	counter.Store(downloader.CurrentSegment.GotBytes)
+	parts := make([]splitPart, len(ranges))
+	doneChan := make(chan int, len(ranges))
+	for i, byteRange := range ranges {
+		go func() {
+			parts[i] = downloader.downloadPart(ctx, chunkUrl, byteRange, validators, requestHeaders, &counter)
+			doneChan <- i
+		}()
+	}
+	downloader.CurrentSegment.Size = size
+	// the counters are updated here only, as readBody does
+	var err error
+	for done := 0; done < len(ranges); {
+		select {
+		case i := <-doneChan:
+			done++
+			if parts[i].err != nil && err == nil {
+				err = parts[i].err
+				ErrorLog.Println(err.Error())
+				cancel()
+			}
+		case <-time.After(time.Second):
+		}
+		n := counter.Load() - downloader.CurrentSegment.GotBytes
+		downloader.CurrentSegment.GotBytes = downloader.CurrentSegment.GotBytes + n
+		downloader.GotBytes = downloader.GotBytes + n
+		downloader.receivedBytes = downloader.receivedBytes + n
+		downloader.notify()
+	}
+	if stats.Parts == 0 {
+		stats.Status, stats.Ttfb = parts[0].status, parts[0].ttfb
+		if parts[0].header != nil {
+			stats.Response = responseMetadata(parts[0].header)
+		}
+	}
+	stats.Parts = stats.Parts + len(ranges)
+	if err != nil {
+		return nil, parts[0].contentType, err
+	}
+	if err := ValidateContentType(parts[0].contentType); err != nil {
+		return nil, parts[0].contentType, err
+	}
+	output := make([]byte, 0, size)
+	for _, part := range parts {
+		output = append(output, part.data...)
+	}
+	return output, parts[0].contentType, nil
+}
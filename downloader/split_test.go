@@ -0,0 +1,71 @@
+package downloader
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDownloadSplit downloads a segment in parts: its size is taken from the first part, no HEAD is sent.
+func TestDownloadSplit(t *testing.T) {
+	segment := bytes.Repeat(append([]byte{0x47}, bytes.Repeat([]byte{0x11}, tsPacketSize-1)...), 6)
+	tests := []struct {
+		name     string
+		ranges   bool
+		requests int64
+	}{
+		{`ranges`, true, 4},
+		{`no ranges`, false, 1},
+	}
+	for _, test := range tests {
+		var heads, gets atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case `/index.m3u8`:
+				w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\n0.ts\n#EXT-X-ENDLIST\n"))
+			case `/0.ts`:
+				if r.Method == http.MethodHead {
+					heads.Add(1)
+				} else {
+					gets.Add(1)
+				}
+				if test.ranges {
+					http.ServeContent(w, r, `0.ts`, time.Time{}, bytes.NewReader(segment))
+				} else {
+					w.Write(segment)
+				}
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		d := NewDownloader()
+		d.SinkName, d.Retries, d.RetryDelay = `file`, 0, time.Millisecond
+		d.SplitParts, d.SplitThreshold = 4, 100
+		filename := filepath.Join(t.TempDir(), `out.ts`)
+		events, err := d.Download(server.URL+`/index.m3u8`, filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var last ProgressEvent
+		for event := range events {
+			last = event
+		}
+		server.Close()
+		if last.Error != nil {
+			t.Errorf("%s: %v", test.name, last.Error)
+			continue
+		}
+		if data, err := os.ReadFile(filename); err != nil || !bytes.Equal(data, segment) {
+			t.Errorf("%s: output = %d bytes, %v; want %d bytes of the segment", test.name, len(data), err, len(segment))
+		}
+		if heads.Load() != 0 || gets.Load() != test.requests {
+			t.Errorf("%s: %d HEAD and %d GET requests, want 0 and %d", test.name, heads.Load(), gets.Load(),
+				test.requests)
+		}
+	}
+}
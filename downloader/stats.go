@@ -0,0 +1,108 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	CurrentRateWindow = 2 * time.Second
+	MovingRateWindow  = 10 * time.Second
+)
+
+// SegmentStats describes the download of a segment (or an init section, a key of the mirror) for debugging slow
+// CDNs. Ttfb, Status and Elapsed are of the last attempt.
+type SegmentStats struct {
+	Num      int               `json:"num"`
+	Url      string            `json:"url"`
+	Attempts int               `json:"attempts"`
+	Resumes  int               `json:"resumes"` // of the last attempt
+	Parts    int               `json:"parts"`   // parallel ranges of the last attempt, 0 - not split
+	Status   int               `json:"status"`
+	Size     int64             `json:"size"`
+	Duration float32           `json:"duration"` // media seconds
+	Started  time.Time         `json:"started"`
+	Ttfb     time.Duration     `json:"ttfb"`
+	Elapsed  time.Duration     `json:"elapsed"`
+	Error    string            `json:"error,omitempty"`
+	Sha256   string            `json:"sha256,omitempty"`   // of the downloaded data
+	Response map[string]string `json:"response,omitempty"` // some headers of the response of the last attempt
+}
+
+type rateSample struct {
+	time  time.Time
+	bytes int64
+}
+
+// rateMeter measures the throughput over the last MovingRateWindow by the samples of the total got bytes.
+type rateMeter struct {
+	samples []rateSample
+}
+
+func (meter *rateMeter) add(t time.Time, bytes int64) {
+	meter.samples = append(meter.samples, rateSample{time: t, bytes: bytes})
+	// the oldest sample out of the window is kept as a base
+	drop := 0
+	for drop < len(meter.samples)-1 && t.Sub(meter.samples[drop+1].time) >= MovingRateWindow {
+		drop++
+	}
+	meter.samples = meter.samples[drop:]
+}
+
+// rate returns bytes per second over the window, 0 if there are no samples enough.
+func (meter *rateMeter) rate(window time.Duration) float64 {
+	if len(meter.samples) < 2 {
+		return 0
+	}
+	last := meter.samples[len(meter.samples)-1]
+	base := meter.samples[0]
+	for _, sample := range meter.samples {
+		if last.time.Sub(sample.time) <= window {
+			break
+		}
+		base = sample
+	}
+	elapsed := last.time.Sub(base.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-base.bytes) / elapsed
+}
+
+// segmentStatsList is written by the download goroutine and read by anyone.
+type segmentStatsList struct {
+	mu    sync.Mutex
+	stats []SegmentStats
+}
+
+func (list *segmentStatsList) add(stats SegmentStats) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.stats = append(list.stats, stats)
+}
+
+func (list *segmentStatsList) get() []SegmentStats {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	return append([]SegmentStats{}, list.stats...)
+}
+
+// eta estimates the time left by the remaining media duration, the average bytes per second of media of the
+// segments so far and the current throughput. It is 0 if unknown.
+func (downloader *Downloader) eta(movingRate float64) time.Duration {
+	remaining := downloader.TotalDuration() - downloader.DownloadedDuration
+	if remaining <= 0 || movingRate <= 0 || downloader.validatedDuration <= 0 {
+		return 0
+	}
+	mediaRate := float64(downloader.validatedBytes) / float64(downloader.validatedDuration)
+	bytes := float64(remaining)*mediaRate - float64(downloader.CurrentSegment.GotBytes)
+	if bytes <= 0 {
+		return 0
+	}
+	return time.Duration(bytes / movingRate * float64(time.Second))
+}
+
+// SegmentStats returns the stats of every segment downloaded so far, all of them after the download is finished.
+func (downloader *Downloader) SegmentStats() []SegmentStats {
+	return downloader.segmentStats.get()
+}
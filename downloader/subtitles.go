@@ -0,0 +1,284 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/playlist"
+	"github.com/vvampirius/hls-downloader/remux"
+	"github.com/vvampirius/hls-downloader/webvtt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoSubtitles     = errors.New(`no such subtitle rendition`)
+	ErrSubtitlesFormat = errors.New(`unknown subtitles format, expect vtt or srt`)
+	ErrSubtitlesMux    = errors.New(`can't mux subtitles into the output`)
+)
+
+// subtitlesCodec returns the ffmpeg subtitle codec to mux the subtitles into the output with, by its extension.
+func subtitlesCodec(outputFilename, format string) (string, error) {
+	switch strings.ToLower(filepath.Ext(outputFilename)) {
+	case `.mp4`, `.m4v`, `.mov`:
+		return `mov_text`, nil
+	case `.mkv`:
+		if format == `srt` {
+			return `srt`, nil
+		}
+		return `webvtt`, nil
+	case `.webm`:
+		return `webvtt`, nil
+	}
+	err := errors.Join(ErrSubtitlesMux, errors.New(fmt.Sprintf("'%s' (mp4, m4v, mov, mkv and webm only)",
+		outputFilename)))
+	ErrorLog.Println(err.Error())
+	return ``, err
+}
+
+// checkSubtitles rejects the subtitle options that can't work with the output before anything is downloaded.
+func (downloader *Downloader) checkSubtitles(outputFilename string) error {
+	if downloader.Subtitles == `` {
+		return nil
+	}
+	if downloader.SubtitlesFormat != `` && downloader.SubtitlesFormat != `vtt` && downloader.SubtitlesFormat != `srt` {
+		err := errors.Join(ErrSubtitlesFormat, errors.New(downloader.SubtitlesFormat))
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if outputFilename == `-` || downloader.SinkName == `stdout` {
+		err := errors.New(`subtitles need an output file, not stdout`)
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if !downloader.SubtitlesMux {
+		return nil
+	}
+	if _, err := subtitlesCodec(outputFilename, downloader.SubtitlesFormat); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath(FfmpegPath); err != nil {
+		err = errors.Join(ErrSubtitlesMux, err)
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// selectSubtitles finds the Subtitles rendition in the master playlist: by LANGUAGE ('en' matches 'en-US' too) or
+// NAME, or the DEFAULT one (the first one if none is) for 'default'. Renditions of the SUBTITLES group of the chosen
+// variant are looked at only. Subtitles may be the URL of a subtitle playlist as well.
+func (downloader *Downloader) selectSubtitles(data []byte, baseUrl *url.URL) error {
+	if strings.Contains(downloader.Subtitles, `://`) {
+		downloader.subtitlesUrl = downloader.Subtitles
+		return nil
+	}
+	group := ``
+	if downloader.variant != nil {
+		group = downloader.variant.Attributes[`SUBTITLES`]
+	}
+	var selected *playlist.Rendition
+	for _, rendition := range playlist.ParseRenditions(data) {
+		if rendition.Type != `SUBTITLES` || rendition.Uri == `` || (group != `` && rendition.GroupId != group) {
+			continue
+		}
+		if downloader.Subtitles == `default` {
+			if selected == nil || (rendition.Default && !selected.Default) {
+				selected = &rendition
+			}
+			continue
+		}
+		language := strings.ToLower(rendition.Language)
+		if rendition.Name == downloader.Subtitles || language == strings.ToLower(downloader.Subtitles) ||
+			strings.HasPrefix(language, strings.ToLower(downloader.Subtitles)+`-`) {
+			selected = &rendition
+			break
+		}
+	}
+	if selected == nil {
+		err := errors.Join(ErrNoSubtitles, errors.New(downloader.Subtitles))
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	subtitlesUrl, err := MakeChunkUrl(baseUrl, selected.Uri, downloader.PropagateQuery)
+	if err != nil {
+		return err
+	}
+	DebugLog.Printf("Subtitles '%s' (%s) %s\n", selected.Name, selected.Language, subtitlesUrl)
+	downloader.subtitlesUrl, downloader.subtitlesLanguage = subtitlesUrl, selected.Language
+	return nil
+}
+
+// firstPts returns the earliest presentation timestamp of the MPEG-TS segment, NoTimestamp if it isn't MPEG-TS.
+func firstPts(data []byte) int64 {
+	pts := webvtt.NoTimestamp
+	demuxer := remux.NewTsDemuxer()
+	demuxer.OnPes = func(pes *remux.PES) error {
+		if pes.Pts != remux.NoTimestamp && (pts == webvtt.NoTimestamp || pes.Pts < pts) {
+			pts = pes.Pts
+		}
+		return nil
+	}
+	if _, err := demuxer.Write(data); err != nil {
+		return webvtt.NoTimestamp
+	}
+	if err := demuxer.Flush(); err != nil {
+		return webvtt.NoTimestamp
+	}
+	return pts
+}
+
+// subtitlesFilename is the sidecar file next to the output: <name>[.<language>].<format>, or subtitles[...] in the
+// output directory.
+func subtitlesFilename(outputFilename, language, format string) string {
+	suffix := `.` + format
+	if language != `` {
+		suffix = `.` + language + suffix
+	}
+	if info, err := os.Stat(outputFilename); err == nil && info.IsDir() {
+		return filepath.Join(outputFilename, `subtitles`+suffix)
+	}
+	return strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)) + suffix
+}
+
+// downloadSubtitles downloads the segments of the subtitle playlist that overlap the output, merges them into one
+// file timed from the start of the output and keeps it next to the output or muxes it in.
+func (downloader *Downloader) downloadSubtitles() error {
+	downloader.phase = PhaseSubtitles
+	downloader.CurrentSegment.Url = downloader.subtitlesUrl
+	downloader.notify()
+	data, baseUrl, err := downloader.fetchPlaylist(downloader.subtitlesUrl, downloader.requestHeaders)
+	if err != nil {
+		return err
+	}
+	if playlist.IsMaster(data) {
+		err := errors.Join(ErrNoSubtitles, errors.New(fmt.Sprintf("%s is a master playlist", downloader.subtitlesUrl)))
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	origin := downloader.firstPts
+	if origin != webvtt.NoTimestamp {
+		origin = origin + int64(downloader.outputTrim.Seconds()*90000)
+	}
+	merger := webvtt.NewMerger(origin, downloader.outputStart, downloader.outputDuration)
+	p := playlist.Parse(io.NopCloser(bytes.NewReader(data)))
+	position := time.Duration(0)
+	for {
+		segment, err := p.GetSegment()
+		if err != nil {
+			return err
+		}
+		if segment == nil {
+			break
+		}
+		duration := time.Duration(float64(segment.Duration) * float64(time.Second))
+		position = position + duration
+		if position <= downloader.outputStart || (downloader.outputDuration > 0 &&
+			position-duration >= downloader.outputStart+downloader.outputDuration) {
+			continue
+		}
+		segmentUrl, err := MakeChunkUrl(baseUrl, segment.Uri, downloader.PropagateQuery)
+		if err != nil {
+			return err
+		}
+		segmentUrl = downloader.Rewriter.Rewrite(segmentUrl)
+		downloader.CurrentSegment.Url = segmentUrl
+		downloader.CurrentSegment.GotBytes = 0
+		downloader.notify()
+		segmentData, err := downloader.downloadSegment(segmentUrl, -1, false, segment.ByteRange, 0, segment.Key.Encrypted(),
+			downloader.requestHeaders)
+		if err != nil {
+			return err
+		}
+		if err := merger.Add(segmentData); err != nil {
+			err = &SegmentError{Url: segmentUrl, Err: err}
+			ErrorLog.Println(err.Error())
+			return err
+		}
+	}
+	format := downloader.SubtitlesFormat
+	if format == `` {
+		format = `vtt`
+	}
+	filename := subtitlesFilename(downloader.outputFilename, downloader.subtitlesLanguage, format)
+	if err := writeSubtitles(filename, merger, format); err != nil {
+		return err
+	}
+	DebugLog.Printf("%d cues written to %s\n", len(merger.Cues()), filename)
+	if !downloader.SubtitlesMux {
+		downloader.SubtitlesFilename = filename
+		return nil
+	}
+	defer os.Remove(filename)
+	return muxSubtitles(downloader.outputFilename, filename, downloader.subtitlesLanguage, format)
+}
+
+func writeSubtitles(filename string, merger *webvtt.Merger, format string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if format == `srt` {
+		err = merger.WriteSrt(f)
+	} else {
+		err = merger.WriteVtt(f)
+	}
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// muxSubtitles adds the subtitles to the output as a stream with ffmpeg: the streams of the output are copied into
+// a temporary file which replaces the output then.
+func muxSubtitles(outputFilename, subtitlesFilename, language, format string) error {
+	codec, err := subtitlesCodec(outputFilename, format)
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Split(outputFilename)
+	tmpFilename := filepath.Join(dir, `.`+name+`.subtitles`+filepath.Ext(name))
+	args := []string{`-hide_banner`, `-nostats`, `-loglevel`, `warning`, `-i`, outputFilename, `-i`, subtitlesFilename,
+		`-map`, `0`, `-map`, `1`, `-c`, `copy`, `-c:s`, codec}
+	if language != `` {
+		args = append(args, `-metadata:s:s:0`, `language=`+language)
+	}
+	cmd := exec.Command(FfmpegPath, append(args, `-y`, tmpFilename)...)
+	DebugLog.Println(cmd.String())
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(tmpFilename)
+		ffmpegErr := FfmpegError{ExitCode: cmd.ProcessState.ExitCode()}
+		if cmd.ProcessState == nil {
+			ffmpegErr.Err = err
+		}
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		if len(lines) > ffmpegStderrLines {
+			lines = lines[len(lines)-ffmpegStderrLines:]
+		}
+		if len(lines) > 0 && lines[0] != `` {
+			ffmpegErr.Stderr = lines
+		}
+		err = errors.Join(ErrSubtitlesMux, &ffmpegErr)
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if err := os.Rename(tmpFilename, outputFilename); err != nil {
+		ErrorLog.Println(err.Error())
+		os.Remove(tmpFilename)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrToml = errors.New(`bad TOML`)
+
+	regexpTomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// tomlParser parses the subset of TOML the config needs: tables ([a.b]), dotted and quoted keys, basic and literal
+// strings, integers, floats, booleans, arrays and inline tables. Multi-line strings, dates and arrays of tables aren't
+// supported.
+type tomlParser struct {
+	s   string
+	pos int
+}
+
+func (p *tomlParser) errorf(format string, a ...any) error {
+	line := strings.Count(p.s[:min(p.pos, len(p.s))], "\n") + 1
+	return errors.Join(ErrToml, errors.New(fmt.Sprintf("line %d: %s", line, fmt.Sprintf(format, a...))))
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+// skipSpace skips spaces and tabs, and newlines and comments too if newlines is set.
+func (p *tomlParser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch c := p.s[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+		case (c == '\n' || c == '\r') && newlines:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine expects nothing but a comment till the end of the line.
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace(false)
+	if p.eof() {
+		return nil
+	}
+	if p.s[p.pos] == '\r' {
+		p.pos++
+	}
+	if p.eof() || p.s[p.pos] == '\n' {
+		return nil
+	}
+	return p.errorf("unexpected '%c'", p.s[p.pos])
+}
+
+func (p *tomlParser) key() ([]string, error) {
+	parts := make([]string, 0)
+	for {
+		p.skipSpace(false)
+		if p.eof() {
+			return nil, p.errorf(`key expected`)
+		}
+		var part string
+		if c := p.s[p.pos]; c == '"' || c == '\'' {
+			value, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			part = value
+		} else {
+			start := p.pos
+			for !p.eof() && regexpTomlBareKey.MatchString(p.s[p.pos:p.pos+1]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("unexpected '%c'", p.s[p.pos])
+			}
+			part = p.s[start:p.pos]
+		}
+		parts = append(parts, part)
+		p.skipSpace(false)
+		if p.eof() || p.s[p.pos] != '.' {
+			return parts, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tomlParser) str() (string, error) {
+	quote := p.s[p.pos]
+	if strings.HasPrefix(p.s[p.pos:], strings.Repeat(string(quote), 3)) {
+		return ``, p.errorf(`multi-line strings aren't supported`)
+	}
+	var value strings.Builder
+	for p.pos++; ; p.pos++ {
+		if p.eof() || p.s[p.pos] == '\n' {
+			return ``, p.errorf(`unterminated string`)
+		}
+		c := p.s[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return value.String(), nil
+		case c < 0x20 && c != '\t' || c == 0x7F:
+			return ``, p.errorf(`control character in a string`)
+		case c == '\\' && quote == '"':
+			r, err := p.escape()
+			if err != nil {
+				return ``, err
+			}
+			value.WriteRune(r)
+		default:
+			value.WriteByte(c)
+		}
+	}
+}
+
+// escape reads the escape sequence of a basic string at the backslash, leaving pos at its last character.
+func (p *tomlParser) escape() (rune, error) {
+	p.pos++
+	if p.eof() {
+		return 0, p.errorf(`unterminated string`)
+	}
+	switch c := p.s[p.pos]; c {
+	case 'b':
+		return '\b', nil
+	case 't':
+		return '\t', nil
+	case 'n':
+		return '\n', nil
+	case 'f':
+		return '\f', nil
+	case 'r':
+		return '\r', nil
+	case '"', '\\':
+		return rune(c), nil
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		hex := p.s[p.pos+1 : min(p.pos+1+size, len(p.s))]
+		n, err := strconv.ParseUint(hex, 16, 32)
+		if len(hex) != size || err != nil || !utf8.ValidRune(rune(n)) {
+			return 0, p.errorf("bad escape '\\%c%s'", c, hex)
+		}
+		p.pos = p.pos + size
+		return rune(n), nil
+	}
+	return 0, p.errorf("bad escape '\\%c'", p.s[p.pos])
+}
+
+func (p *tomlParser) value() (any, error) {
+	if p.eof() {
+		return nil, p.errorf(`value expected`)
+	}
+	switch p.s[p.pos] {
+	case '"', '\'':
+		return p.str()
+	case '[':
+		p.pos++
+		values := make([]any, 0)
+		for {
+			p.skipSpace(true)
+			if !p.eof() && p.s[p.pos] == ']' {
+				p.pos++
+				return values, nil
+			}
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			p.skipSpace(true)
+			if !p.eof() && p.s[p.pos] == ',' {
+				p.pos++
+			} else if p.eof() || p.s[p.pos] != ']' {
+				return nil, p.errorf(`',' or ']' expected`)
+			}
+		}
+	case '{':
+		p.pos++
+		table := make(map[string]any)
+		for {
+			p.skipSpace(false)
+			if !p.eof() && p.s[p.pos] == '}' && len(table) == 0 {
+				p.pos++
+				return table, nil
+			}
+			if err := p.keyValue(table); err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if !p.eof() && p.s[p.pos] == '}' {
+				p.pos++
+				return table, nil
+			}
+			if p.eof() || p.s[p.pos] != ',' {
+				return nil, p.errorf(`',' or '}' expected`)
+			}
+			p.pos++
+		}
+	}
+	start := p.pos
+	for !p.eof() && strings.IndexByte(`+-._:0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ`,
+		p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+	token := p.s[start:p.pos]
+	switch token {
+	case `true`:
+		return true, nil
+	case `false`:
+		return false, nil
+	}
+	if n, err := strconv.ParseInt(strings.ReplaceAll(token, `_`, ``), 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(strings.ReplaceAll(token, `_`, ``), 64); err == nil {
+		return f, nil
+	}
+	p.pos = start
+	return nil, p.errorf("bad value '%s' (a string must be quoted)", token)
+}
+
+// table returns the table of the path under root, creating the missing ones.
+func (p *tomlParser) table(root map[string]any, path []string) (map[string]any, error) {
+	table := root
+	for _, name := range path {
+		switch v := table[name].(type) {
+		case nil:
+			child := make(map[string]any)
+			table[name], table = child, child
+		case map[string]any:
+			table = v
+		default:
+			return nil, p.errorf("'%s' is not a table", name)
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) keyValue(table map[string]any) error {
+	key, err := p.key()
+	if err != nil {
+		return err
+	}
+	if p.eof() || p.s[p.pos] != '=' {
+		return p.errorf(`'=' expected`)
+	}
+	p.pos++
+	p.skipSpace(false)
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	if table, err = p.table(table, key[:len(key)-1]); err != nil {
+		return err
+	}
+	name := key[len(key)-1]
+	if _, ok := table[name]; ok {
+		return p.errorf("'%s' is defined twice", strings.Join(key, `.`))
+	}
+	table[name] = value
+	return nil
+}
+
+// ParseToml parses the document into nested maps of string, int64, float64, bool and []any values.
+func ParseToml(data []byte) (map[string]any, error) {
+	p := tomlParser{s: string(data)}
+	root := make(map[string]any)
+	current := root
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return root, nil
+		}
+		if p.s[p.pos] == '[' {
+			p.pos++
+			if !p.eof() && p.s[p.pos] == '[' {
+				return nil, p.errorf(`arrays of tables aren't supported`)
+			}
+			path, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			if p.eof() || p.s[p.pos] != ']' {
+				return nil, p.errorf(`']' expected`)
+			}
+			p.pos++
+			if current, err = p.table(root, path); err != nil {
+				return nil, err
+			}
+		} else if err := p.keyValue(current); err != nil {
+			return nil, err
+		}
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func tomlKey(key string) string {
+	if regexpTomlBareKey.MatchString(key) {
+		return key
+	}
+	return tomlQuote(key)
+}
+
+// tomlQuote makes a basic string: control characters are escaped as TOML has no Go escapes like \a or \x.
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\b':
+			b.WriteString(`\b`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7F:
+			fmt.Fprintf(&b, "\\u%04X", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func tomlValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return tomlQuote(v)
+	case []any:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = tomlValue(item)
+		}
+		return `[` + strings.Join(values, `, `) + `]`
+	case map[string]any:
+		values := make([]string, 0, len(v))
+		for _, key := range sortedKeys(v) {
+			if v[key] != nil {
+				values = append(values, tomlKey(key)+` = `+tomlValue(v[key]))
+			}
+		}
+		return `{` + strings.Join(values, `, `) + `}`
+	case nil:
+		return `""`
+	}
+	return fmt.Sprint(value)
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteToml writes the nested maps as TOML: the values of a table first, then its subtables as sections. Tables
+// of tables of strings only (e.g. headers of a profile) are written inline. Nil values are left out.
+func WriteToml(w io.Writer, root map[string]any) error {
+	return writeTomlTable(w, nil, root)
+}
+
+func writeTomlTable(w io.Writer, path []string, table map[string]any) error {
+	subtables := make([]string, 0)
+	for _, key := range sortedKeys(table) {
+		if table[key] == nil {
+			continue // TOML has no null, an unset list or table is left out
+		}
+		if subtable, ok := table[key].(map[string]any); ok && (len(path) == 0 || !isFlatTable(subtable)) {
+			subtables = append(subtables, key)
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s = %s\n", tomlKey(key), tomlValue(table[key])); err != nil {
+			return err
+		}
+	}
+	for _, key := range subtables {
+		subpath := append(append([]string{}, path...), tomlKey(key))
+		subtable := table[key].(map[string]any)
+		// a table of tables only gets its header with its subtables
+		if hasTomlValues(subtable) || len(subtable) == 0 {
+			if _, err := fmt.Fprintf(w, "\n[%s]\n", strings.Join(subpath, `.`)); err != nil {
+				return err
+			}
+		}
+		if err := writeTomlTable(w, subpath, subtable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasTomlValues tells if the table has values that aren't written as sections.
+func hasTomlValues(table map[string]any) bool {
+	for _, value := range table {
+		if subtable, ok := value.(map[string]any); !ok || isFlatTable(subtable) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFlatTable tells if the table has no subtables, so it fits an inline one.
+func isFlatTable(table map[string]any) bool {
+	for _, value := range table {
+		if _, ok := value.(map[string]any); ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseToml(t *testing.T) {
+	data := "# a comment\n" +
+		"name = \"top\" # after a value\n" +
+		"count = 1_000\n" +
+		"ratio = -0.5\n" +
+		"enabled = true\r\n" +
+		"list = [\n  'a', # an item\n  \"b\",\n]\n" +
+		"site.host = 'example.com'\n" +
+		"\"quoted key\" = 1\n" +
+		"inline = {a = 1, b.c = 'x', \"d e\" = []}\n" +
+		"\n[http]\n" +
+		"proxy = 'C:\\no\\escapes'\n" +
+		"\n[ \"header_profiles\" . 'my site' ]\n" +
+		"headers = {Referer = \"https://example.com/\"}\n" +
+		"[site]\n" +
+		"port = 80\n"
+	values, err := ParseToml([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		`name`:       `top`,
+		`count`:      int64(1000),
+		`ratio`:      -0.5,
+		`enabled`:    true,
+		`list`:       []any{`a`, `b`},
+		`site`:       map[string]any{`host`: `example.com`, `port`: int64(80)},
+		`quoted key`: int64(1),
+		`inline`:     map[string]any{`a`: int64(1), `b`: map[string]any{`c`: `x`}, `d e`: []any{}},
+		`http`:       map[string]any{`proxy`: `C:\no\escapes`},
+		`header_profiles`: map[string]any{`my site`: map[string]any{
+			`headers`: map[string]any{`Referer`: `https://example.com/`}}},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("ParseToml() = %#v, want %#v", values, want)
+	}
+}
+
+func TestParseTomlEscapes(t *testing.T) {
+	tests := []struct {
+		s     string
+		value string
+		ok    bool
+	}{
+		{`"a\"b\\c"`, `a"b\c`, true},
+		{`"\b\t\n\f\r"`, "\b\t\n\f\r", true},
+		{`"\u00e9\U0001F600"`, "\u00e9\U0001F600", true},
+		{`'\x41'`, `\x41`, true},
+		{`"tab	inside"`, "tab\tinside", true},
+		{`"\x41"`, ``, false},
+		{`"\a"`, ``, false},
+		{`"\v"`, ``, false},
+		{`"\101"`, ``, false},
+		{`"\'"`, ``, false},
+		{`"\e"`, ``, false},
+		{`"\u12"`, ``, false},
+		{`"\uD800"`, ``, false},
+		{`"\U00110000"`, ``, false},
+		{"\"a\x01\"", ``, false},
+		{`"unterminated`, ``, false},
+		{`"""multi-line"""`, ``, false},
+	}
+	for _, test := range tests {
+		values, err := ParseToml([]byte(`key = ` + test.s))
+		if (err == nil) != test.ok {
+			t.Errorf("ParseToml(%s) error = %v, want ok %t", test.s, err, test.ok)
+		} else if test.ok && values[`key`] != test.value {
+			t.Errorf("ParseToml(%s) = %q, want %q", test.s, values[`key`], test.value)
+		} else if err != nil && !errors.Is(err, ErrToml) {
+			t.Errorf("ParseToml(%s) error = %v, want %v", test.s, err, ErrToml)
+		}
+	}
+}
+
+func TestParseTomlErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{`duplicate key`, "a = 1\nb = 2\na = 3\n", `line 3: 'a' is defined twice`},
+		{`duplicate dotted key`, "a.b = 1\n[a]\nb = 2\n", `line 3: 'b' is defined twice`},
+		{`key of a value`, "a = 1\n[a.b]\n", `line 2: 'a' is not a table`},
+		{`unquoted string`, "a = text\n", `line 1: bad value 'text'`},
+		{`two values`, "a = 1 2\n", `line 1: unexpected '2'`},
+		{`no value`, "a =\n", `line 1: bad value ''`},
+		{`unclosed array`, "a = [1, 2\n", `line 2: ',' or ']' expected`},
+		{`unclosed inline table`, "a = {b = 1\n", `line 1: ',' or '}' expected`},
+		{`array of tables`, "[[a]]\n", `line 1: arrays of tables aren't supported`},
+		{`unclosed table`, "[a\n", `line 1: ']' expected`},
+	}
+	for _, test := range tests {
+		_, err := ParseToml([]byte(test.data))
+		if !errors.Is(err, ErrToml) || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.error)
+		}
+	}
+}
+
+func TestWriteToml(t *testing.T) {
+	values := map[string]any{
+		`name`:    "a \"quoted\" \\ value\twith\x07bell\x7F and \u00e9",
+		`count`:   int64(3),
+		`ratio`:   0.25,
+		`enabled`: false,
+		`list`:    []any{`a`, "b\x00"},
+		`empty`:   map[string]any{},
+		`http`:    map[string]any{`proxy`: `http://proxy:3128`},
+		`header_profiles`: map[string]any{`my site`: map[string]any{`host`: `example\.com`,
+			`headers`: map[string]any{`Referer`: `https://example.com/`, "X-\x01": `1`}}},
+	}
+	output := bytes.Buffer{}
+	if err := WriteToml(&output, values); err != nil {
+		t.Fatal(err)
+	}
+	want := "count = 3\n" +
+		"enabled = false\n" +
+		"list = [\"a\", \"b\\u0000\"]\n" +
+		"name = \"a \\\"quoted\\\" \\\\ value\\twith\\u0007bell\\u007F and \u00e9\"\n" +
+		"ratio = 0.25\n" +
+		"\n[empty]\n" +
+		"\n[header_profiles.\"my site\"]\n" +
+		"headers = {Referer = \"https://example.com/\", \"X-\\u0001\" = \"1\"}\n" +
+		"host = \"example\\\\.com\"\n" +
+		"\n[http]\n" +
+		"proxy = \"http://proxy:3128\"\n"
+	if output.String() != want {
+		t.Errorf("WriteToml() = %q, want %q", output.String(), want)
+	}
+	parsed, err := ParseToml(output.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, values) {
+		t.Errorf("ParseToml(WriteToml()) = %#v, want %#v", parsed, values)
+	}
+}
@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+)
+
+const tsPacketSize = 188
+
+var (
+	ErrEmptySegment     = errors.New(`empty segment`)
+	ErrHtmlSegment      = errors.New(`got HTML instead of media`)
+	ErrTruncatedSegment = errors.New(`truncated segment`)
+	ErrTsSync           = errors.New(`MPEG-TS sync byte not found`)
+	ErrBmffBox          = errors.New(`broken ISO-BMFF box structure`)
+	ErrSegmentSize      = errors.New(`unexpected segment size`)
+
+	bmffBoxTypes = map[string]bool{`ftyp`: true, `styp`: true, `moov`: true, `moof`: true, `mdat`: true, `sidx`: true,
+		`emsg`: true, `prft`: true, `free`: true, `skip`: true}
+)
+
+type SegmentError struct {
+	Url string
+	Err error
+}
+
+func (err *SegmentError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Url, err.Err.Error())
+}
+
+func (err *SegmentError) Unwrap() error {
+	return err.Err
+}
+
+func ValidateContentType(contentType string) error {
+	if contentType == `` {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	if mediaType == `text/html` || mediaType == `application/xhtml+xml` {
+		return errors.Join(ErrHtmlSegment, errors.New(contentType))
+	}
+	return nil
+}
+
+func IsTs(data []byte) bool {
+	return len(data) > 0 && data[0] == 0x47
+}
+
+func IsBmff(data []byte) bool {
+	return len(data) >= 8 && bmffBoxTypes[string(data[4:8])]
+}
+
+func isHtml(data []byte) bool {
+	head := bytes.ToLower(bytes.TrimSpace(data[:min(len(data), 512)]))
+	return bytes.HasPrefix(head, []byte(`<!doctype html`)) || bytes.HasPrefix(head, []byte(`<html`))
+}
+
+func ValidateTs(data []byte) error {
+	if len(data)%tsPacketSize != 0 {
+		return errors.Join(ErrTruncatedSegment, errors.New(fmt.Sprintf("%d bytes is not a whole number of %d byte packets",
+			len(data), tsPacketSize)))
+	}
+	for offset := 0; offset < len(data); offset += tsPacketSize {
+		if data[offset] != 0x47 {
+			return errors.Join(ErrTsSync, errors.New(fmt.Sprintf("at offset %d", offset)))
+		}
+	}
+	return nil
+}
+
+func ValidateBmff(data []byte) error {
+	offset := 0
+	for offset < len(data) {
+		if len(data)-offset < 8 {
+			return errors.Join(ErrTruncatedSegment, errors.New(fmt.Sprintf("%d trailing bytes at offset %d",
+				len(data)-offset, offset)))
+		}
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		boxType := string(data[offset+4 : offset+8])
+		switch size {
+		case 0:
+			size = uint64(len(data) - offset)
+		case 1:
+			if len(data)-offset < 16 {
+				return errors.Join(ErrTruncatedSegment, errors.New(fmt.Sprintf("'%s' at offset %d", boxType, offset)))
+			}
+			size = binary.BigEndian.Uint64(data[offset+8:])
+		}
+		if size < 8 {
+			return errors.Join(ErrBmffBox, errors.New(fmt.Sprintf("'%s' at offset %d has size %d", boxType, offset, size)))
+		}
+		if size > uint64(len(data)-offset) {
+			return errors.Join(ErrTruncatedSegment, errors.New(fmt.Sprintf("'%s' at offset %d needs %d bytes but %d left",
+				boxType, offset, size, len(data)-offset)))
+		}
+		offset = offset + int(size)
+	}
+	return nil
+}
+
+// ValidateSegment rejects empty and HTML bodies and checks the container structure of MPEG-TS and ISO-BMFF
+// segments. Other formats (raw AAC, WebVTT, ...) are accepted as they are, and so are encrypted segments (and keys):
+// the structure of their ciphertext means nothing.
+func ValidateSegment(data []byte, contentType string, encrypted bool) error {
+	if len(data) == 0 {
+		return ErrEmptySegment
+	}
+	if err := ValidateContentType(contentType); err != nil {
+		return err
+	}
+	if isHtml(data) {
+		return ErrHtmlSegment
+	}
+	if encrypted {
+		return nil
+	}
+	if IsTs(data) {
+		return ValidateTs(data)
+	}
+	if IsBmff(data) {
+		return ValidateBmff(data)
+	}
+	return nil
+}
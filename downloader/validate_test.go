@@ -0,0 +1,80 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ciphertext is an AES-128 encrypted segment that happens to start with the MPEG-TS sync byte.
+var ciphertext = append([]byte{0x47, 0x9A, 0x01, 0xC3}, bytes.Repeat([]byte{0x5E, 0xA1}, 500)...)
+
+func TestValidateSegment(t *testing.T) {
+	ts := bytes.Repeat(append([]byte{0x47}, make([]byte, tsPacketSize-1)...), 2)
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		encrypted   bool
+		err         error
+	}{
+		{`ts`, ts, `video/mp2t`, false, nil},
+		{`truncated ts`, ts[:300], ``, false, ErrTruncatedSegment},
+		{`ciphertext`, ciphertext, ``, true, nil},
+		{`ciphertext as ts`, ciphertext, ``, false, ErrTruncatedSegment},
+		{`encrypted empty`, nil, ``, true, ErrEmptySegment},
+		{`encrypted html`, []byte(`<html><body>Forbidden</body></html>`), ``, true, ErrHtmlSegment},
+		{`encrypted html type`, ciphertext, `text/html; charset=utf-8`, true, ErrHtmlSegment},
+	}
+	for _, test := range tests {
+		if err := ValidateSegment(test.data, test.contentType, test.encrypted); !errors.Is(err, test.err) ||
+			(err == nil) != (test.err == nil) {
+			t.Errorf("%s: ValidateSegment() = %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+// TestDownloadEncrypted downloads the ciphertext segment as it is: it isn't validated as MPEG-TS.
+func TestDownloadEncrypted(t *testing.T) {
+	for _, key := range []string{"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\",IV=0x1\n", ``} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case `/index.m3u8`:
+				w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n" + key + "#EXTINF:4.0,\n0.ts\n#EXT-X-ENDLIST\n"))
+			case `/0.ts`:
+				w.Write(ciphertext)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+		d := NewDownloader()
+		d.SinkName, d.Retries, d.RetryDelay = `file`, 1, time.Millisecond
+		filename := filepath.Join(t.TempDir(), `out.ts`)
+		events, err := d.Download(server.URL+`/index.m3u8`, filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var last ProgressEvent
+		for event := range events {
+			last = event
+		}
+		if key == `` {
+			if !errors.Is(last.Error, ErrTruncatedSegment) {
+				t.Errorf("unencrypted: error = %v, want %v", last.Error, ErrTruncatedSegment)
+			}
+			continue
+		}
+		if last.Error != nil {
+			t.Fatalf("encrypted: %v", last.Error)
+		}
+		if data, err := os.ReadFile(filename); err != nil || !bytes.Equal(data, ciphertext) {
+			t.Errorf("encrypted: output = %d bytes, %v; want the ciphertext", len(data), err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"github.com/vvampirius/hls-downloader/downloader"
+)
+
+// headerFlags are the options of the request headers shared by the commands.
+type headerFlags struct {
+	headers      stringsFlag
+	headersFile  *string
+	profilesFile *string
+	profile      *string
+	config       *downloader.Config
+}
+
+func newHeaderFlags(flags *flag.FlagSet, config *downloader.Config) *headerFlags {
+	f := headerFlags{config: config}
+	flags.Var(&f.headers, "H", "request header 'Name: value' (repeatable)")
+	f.headersFile = flags.String("headers-file", "", "file of request headers, a 'Name: value' per line")
+	f.profilesFile = flags.String("header-profiles", config.HeaderProfilesFile, "JSON file of named header profiles (default "+downloader.DefaultHeaderProfilesFile()+" if it exists)")
+	f.profile = flags.String("profile", "", "header profile to use (default: the one whose host matches the playlist URL)")
+	return &f
+}
+
+// requestHeaders merges the headers of the config, the profile, the headers file and the -H headers, in this order
+// of precedence from low to high.
+func (f *headerFlags) requestHeaders(playlistUrl string) (map[string]string, error) {
+	config := *f.config
+	config.HeaderProfilesFile = *f.profilesFile
+	profiles, err := config.LoadHeaderProfiles()
+	if err != nil {
+		return nil, err
+	}
+	profileHeaders, err := profiles.Headers(*f.profile, playlistUrl)
+	if err != nil {
+		return nil, err
+	}
+	headers := config.RequestHeaders()
+	for k, v := range profileHeaders {
+		headers[k] = v
+	}
+	if *f.headersFile != `` {
+		if err := downloader.ReadHeadersFile(*f.headersFile, headers); err != nil {
+			return nil, err
+		}
+	}
+	if err := downloader.ParseHeaders(f.headers, headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
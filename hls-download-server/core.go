@@ -1,17 +1,51 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/vvampirius/hls-downloader/downloader"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Core struct {
-	Tasks []*Task
+	Config         *downloader.Config
+	Tasks          []*Task
+	RateLimiter    *downloader.RateLimiter
+	Rewriter       *downloader.Rewriter
+	HeaderProfiles downloader.HeaderProfiles
+
+	tasksMu  sync.Mutex
+	reserved int // tasks being started, counted by MaxTasks before they are added
+}
+
+// requestHeaders makes the headers of the requests to the playlist: the headers of the config, the Referer and
+// User-Agent of the browser, the header profile (by the 'profile' parameter or the host) and the 'header' parameters
+// over them.
+func (core *Core) requestHeaders(r *http.Request, playlistUrl string) (map[string]string, error) {
+	requestHeaders := core.Config.RequestHeaders()
+	ignoreReferrer := r.URL.Query().Get(`ignore_referrer`) == `true` || r.Header.Get(`ignore_referrer`) == `true`
+	if referer := r.Header.Get(`Referer`); referer != `` && !ignoreReferrer {
+		requestHeaders[`Referer`] = referer
+	}
+	if userAgent := r.Header.Get(`User-Agent`); userAgent != `` {
+		requestHeaders[`User-Agent`] = userAgent
+	}
+	profileHeaders, err := core.HeaderProfiles.Headers(r.URL.Query().Get(`profile`), playlistUrl)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range profileHeaders {
+		requestHeaders[k] = v
+	}
+	if err := downloader.ParseHeaders(r.URL.Query()[`header`], requestHeaders); err != nil {
+		return nil, err
+	}
+	return requestHeaders, nil
 }
 
 func (core *Core) addHandler(w http.ResponseWriter, r *http.Request) {
@@ -22,43 +56,211 @@ func (core *Core) addHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, `URL is empty`)
 		return
 	}
+	// local playlists are CLI only, the server must not read its files
+	if !strings.HasPrefix(taskUrl, `http://`) && !strings.HasPrefix(taskUrl, `https://`) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `only http(s) URLs are allowed`)
+		return
+	}
+	sinkName := core.Config.Sink
+	if r.URL.Query().Has(`dont_recode`) {
+		sinkName = `mp4`
+	}
+	if name := r.URL.Query().Get(`sink`); name != `` {
+		sinkName = name
+	}
+	ext := `.mp4`
+	ffmpegProfile := r.URL.Query().Get(`ffmpeg_profile`)
+	sinkFallback := core.Config.SinkFallback
+	audioOnly := r.URL.Query().Has(`audio_only`)
+	if audioOnly {
+		// audio_format (m4a, aac or mp3) chooses the profile and the native sink, an explicit ffmpeg_profile is kept
+		format := r.URL.Query().Get(`audio_format`)
+		if format == `` {
+			format = `m4a`
+		}
+		audioOutput, err := downloader.GetAudioOutput(`.` + format)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		if ffmpegProfile == `` {
+			ffmpegProfile = audioOutput.FfmpegProfile
+		}
+		if sinkName == `mp4` {
+			sinkName = audioOutput.Sink
+		}
+		if sinkName == `` {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s needs ffmpeg\n", format)
+			return
+		}
+		ext, sinkFallback = `.`+format, audioOutput.Sink
+	}
+	if ffmpegProfile == `` {
+		ffmpegProfile = core.Config.FfmpegProfile
+	}
+	if sinkName == `ffmpeg` {
+		profile, err := downloader.GetFfmpegProfile(ffmpegProfile)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		ext = profile.Ext
+	}
 	filename := r.URL.Query().Get(`filename`)
 	if filename == `` {
-		filename = fmt.Sprintf(`%d.mp4`, time.Now().Unix())
+		template := core.Config.FilenameTemplate
+		if template == `` {
+			template = `{unix}{ext}`
+		}
+		filename = downloader.ExpandFilenameTemplate(template, taskUrl, len(core.tasks())+1, ext)
 	} else if !strings.Contains(filename, `.`) {
-		filename = fmt.Sprintf(`%s.mp4`, filename)
+		filename = filename + ext
 	}
-	useFfmpeg := true
-	if r.URL.Query().Has(`dont_recode`) {
-		useFfmpeg = false
+	filename = core.Config.OutputPath(filename)
+	if sinkName == `stdout` || filename == `-` {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `stdout sink is not available in the server`)
+		return
+	}
+	rate, err := downloader.ParseRate(r.URL.Query().Get(`ratelimit`))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	burst, err := downloader.ParseRate(r.URL.Query().Get(`ratelimit_burst`))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	clip := make(map[string]time.Duration)
+	for _, name := range []string{`start`, `end`, `duration`} {
+		if clip[name], err = downloader.ParseClipTime(r.URL.Query().Get(name)); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
 	}
 	task := Task{
 		EventStreams: make([]*EventStream, 0),
 		Url:          taskUrl,
 		Filename:     filename,
-		Downloader:   downloader.NewDownloader(),
+		Downloader:   core.Config.NewDownloader(),
+	}
+	task.Downloader.RateLimiter = downloader.NewRateLimiter(rate, burst, core.RateLimiter)
+	task.Downloader.Rewriter = core.Rewriter
+	task.Downloader.SinkName = sinkName
+	task.Downloader.ClipStart = clip[`start`]
+	task.Downloader.ClipEnd = clip[`end`]
+	task.Downloader.ClipDuration = clip[`duration`]
+	task.Downloader.ClipPrecise = r.URL.Query().Has(`precise`)
+	task.Downloader.SinkFallback = sinkFallback
+	task.Downloader.AudioOnly = audioOnly
+	if r.URL.Query().Has(`sink_fallback`) {
+		task.Downloader.SinkFallback = r.URL.Query().Get(`sink_fallback`)
+	}
+	task.Downloader.SinkOptions.StoreLayout = r.URL.Query().Get(`store_layout`)
+	task.Downloader.SinkOptions.FfmpegProfile = ffmpegProfile // custom ffmpeg arguments are CLI only
+	task.Downloader.PropagateQuery = task.Downloader.PropagateQuery || r.URL.Query().Has(`propagate_query`)
+	// commands and endpoints are CLI only, the server may only re-fetch the playlist
+	if refresh := r.URL.Query().Get(`refresh`); refresh == `playlist` {
+		task.Downloader.Refresher = downloader.PlaylistRefresher{}
+	} else if refresh != `` {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `only refresh=playlist is allowed`)
+		return
+	}
+	if r.URL.Query().Has(`manifest`) {
+		task.Downloader.ManifestFilename = downloader.ManifestFor(filename)
+	}
+	task.Downloader.Subtitles = r.URL.Query().Get(`subs`)
+	task.Downloader.SubtitlesFormat = r.URL.Query().Get(`subs_format`)
+	task.Downloader.SubtitlesMux = r.URL.Query().Has(`subs_mux`)
+	if strings.Contains(task.Downloader.Subtitles, `://`) && !strings.HasPrefix(task.Downloader.Subtitles, `http://`) &&
+		!strings.HasPrefix(task.Downloader.Subtitles, `https://`) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `only http(s) subtitle playlist URLs are allowed`)
+		return
+	}
+	task.Downloader.AlternateHosts = r.URL.Query()[`alt_host`]
+	if retries := r.URL.Query().Get(`retries`); retries != `` {
+		n, err := strconv.Atoi(retries)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		task.Downloader.Retries = n
+	}
+	if sizeTolerance := r.URL.Query().Get(`size_tolerance`); sizeTolerance != `` {
+		f, err := strconv.ParseFloat(sizeTolerance, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		task.Downloader.SizeTolerance = f
+	}
+	if task.Downloader.SplitThreshold, err = downloader.ParseRate(r.URL.Query().Get(`split_threshold`)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	if splitParts := r.URL.Query().Get(`split_parts`); splitParts != `` {
+		n, err := strconv.Atoi(splitParts)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		task.Downloader.SplitParts = n
+	}
+	if values := r.URL.Query()[`rewrite`]; len(values) > 0 {
+		rules := make([]*downloader.RewriteRule, 0)
+		for _, value := range values {
+			rule, err := downloader.ParseRewriteRule(value) // only inline rules here, no files from the request
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, err.Error())
+				return
+			}
+			rules = append(rules, rule)
+		}
+		if core.Rewriter != nil {
+			rules = append(rules, core.Rewriter.Rules...)
+		}
+		task.Downloader.Rewriter = &downloader.Rewriter{Rules: rules}
 	}
 	if source := r.URL.Query().Get(`source`); source != `` {
 		task.Source = source
 	}
-	requestHeaders := make(map[string]string)
-	if referer := r.Header.Get(`Referer`); referer != `` && r.Header.Get(`ignore_referrer`) != `true` {
-		requestHeaders[`Referer`] = referer
+	requestHeaders, err := core.requestHeaders(r, taskUrl)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
 	}
-	if userAgent := r.Header.Get(`User-Agent`); userAgent != `` {
-		requestHeaders[`User-Agent`] = userAgent
+	if running, ok := core.reserveTask(); !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%d tasks are running already, try again later\n", running)
+		return
 	}
-	c, err := task.Downloader.Download(taskUrl, filename, useFfmpeg, requestHeaders)
+	c, err := task.Downloader.Download(taskUrl, filename, requestHeaders)
+	id := core.addTask(&task, err == nil)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, err.Error())
 		return
 	}
-	core.Tasks = append(core.Tasks, &task)
 	go func() {
 		for range c {
 			//DebugLog.Println(d)
-			for _, es := range task.EventStreams {
+			for _, es := range task.GetEventStreams() {
 				//DebugLog.Println(es)
 				if es.DataChan != nil && es.Error == nil {
 					ti := task.GetInfo()
@@ -66,9 +268,45 @@ func (core *Core) addHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-		task.Finished = true
 	}()
-	http.Redirect(w, r, fmt.Sprintf(`/%d/`, len(core.Tasks)-1), http.StatusFound)
+	http.Redirect(w, r, fmt.Sprintf(`/%d/`, id), http.StatusFound)
+}
+
+// reserveTask counts the task being started as a running one unless MaxTasks are running already. addTask ends the
+// reservation.
+func (core *Core) reserveTask() (int, bool) {
+	core.tasksMu.Lock()
+	defer core.tasksMu.Unlock()
+	running := core.reserved
+	for _, task := range core.Tasks {
+		if !task.Finished() {
+			running++
+		}
+	}
+	if core.Config.Server.MaxTasks > 0 && running >= core.Config.Server.MaxTasks {
+		return running, false
+	}
+	core.reserved++
+	return running, true
+}
+
+// addTask ends the reservation of reserveTask and adds the task if it is started. It returns the task id.
+func (core *Core) addTask(task *Task, started bool) int {
+	core.tasksMu.Lock()
+	defer core.tasksMu.Unlock()
+	core.reserved--
+	if !started {
+		return -1
+	}
+	core.Tasks = append(core.Tasks, task)
+	return len(core.Tasks) - 1
+}
+
+// tasks returns the tasks added so far.
+func (core *Core) tasks() []*Task {
+	core.tasksMu.Lock()
+	defer core.tasksMu.Unlock()
+	return core.Tasks[:len(core.Tasks):len(core.Tasks)]
 }
 
 func (core *Core) getTask(id string) (*Task, error) {
@@ -77,18 +315,19 @@ func (core *Core) getTask(id string) (*Task, error) {
 		ErrorLog.Println(id, err.Error())
 		return nil, err
 	}
-	if len(core.Tasks)-1 < int(n) {
+	tasks := core.tasks()
+	if n < 0 || len(tasks)-1 < int(n) {
 		err = errors.New(fmt.Sprintf("%d not found", n))
 		ErrorLog.Println(err.Error())
 		return nil, err
 	}
-	return core.Tasks[int(n)], nil
+	return tasks[int(n)], nil
 }
 
 func (core *Core) indexHandler(w http.ResponseWriter, r *http.Request) {
 	DebugLog.Printf("%s %s %s '%s'", r.Header.Get(`X-Real-IP`), r.Method, r.RequestURI, r.UserAgent())
 	t := getTemplate(`index.html`, indexTemplate)
-	if err := t.Execute(w, core.Tasks); err != nil {
+	if err := t.Execute(w, core.tasks()); err != nil {
 		ErrorLog.Println(err.Error())
 	}
 }
@@ -108,7 +347,7 @@ func (core *Core) taskHandler(w http.ResponseWriter, r *http.Request) {
 		es := NewEventStream(w)
 		ti := task.GetInfo()
 		es.DataChan <- ti.Json()
-		task.EventStreams = append(task.EventStreams, es)
+		task.AddEventStream(es)
 		es.Stream()
 		break
 
@@ -126,9 +365,125 @@ func (core *Core) taskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func NewCore() *Core {
+func (core *Core) rateLimit(w http.ResponseWriter, r *http.Request, limiter *downloader.RateLimiter) {
+	if r.URL.Query().Has(`rate`) {
+		rate, err := downloader.ParseRate(r.URL.Query().Get(`rate`))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		burst, err := downloader.ParseRate(r.URL.Query().Get(`burst`))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		limiter.SetLimit(rate, burst)
+	}
+	rate, burst := limiter.Limit()
+	w.Header().Set(`Content-Type`, `application/json`)
+	fmt.Fprintf(w, "{\"rate\":%d,\"burst\":%d}\n", rate, burst)
+}
+
+func (core *Core) rateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	DebugLog.Printf("%s %s %s '%s'", r.Header.Get(`X-Real-IP`), r.Method, r.RequestURI, r.UserAgent())
+	core.rateLimit(w, r, core.RateLimiter)
+}
+
+func (core *Core) taskRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	DebugLog.Printf("%s %s %s '%s'", r.Header.Get(`X-Real-IP`), r.Method, r.RequestURI, r.UserAgent())
+	task, err := core.getTask(r.PathValue(`task`))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	if task.Downloader == nil || task.Downloader.RateLimiter == nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, `task has no rate limiter`)
+		return
+	}
+	core.rateLimit(w, r, task.Downloader.RateLimiter)
+}
+
+func (core *Core) cancelHandler(w http.ResponseWriter, r *http.Request) {
+	DebugLog.Printf("%s %s %s '%s'", r.Header.Get(`X-Real-IP`), r.Method, r.RequestURI, r.UserAgent())
+	task, err := core.getTask(r.PathValue(`task`))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	if task.Downloader == nil || task.Finished() {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, `task is not running`)
+		return
+	}
+	task.Downloader.Cancel()
+	http.Redirect(w, r, fmt.Sprintf(`/%s/`, r.PathValue(`task`)), http.StatusFound)
+}
+
+// statsHandler returns the stats of every segment of the task as JSON.
+func (core *Core) statsHandler(w http.ResponseWriter, r *http.Request) {
+	DebugLog.Printf("%s %s %s '%s'", r.Header.Get(`X-Real-IP`), r.Method, r.RequestURI, r.UserAgent())
+	task, err := core.getTask(r.PathValue(`task`))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	data, err := json.MarshalIndent(task.Downloader.SegmentStats(), ``, `  `)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.Write(data)
+}
+
+// probeHandler describes the playlist (variants, renditions, duration, estimated size) before adding a task.
+func (core *Core) probeHandler(w http.ResponseWriter, r *http.Request) {
+	DebugLog.Printf("%s %s %s '%s'", r.Header.Get(`X-Real-IP`), r.Method, r.RequestURI, r.UserAgent())
+	probeUrl := r.URL.Query().Get(`url`)
+	if !strings.HasPrefix(probeUrl, `http://`) && !strings.HasPrefix(probeUrl, `https://`) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `only http(s) URLs are allowed`)
+		return
+	}
+	d := core.Config.NewDownloader()
+	d.RateLimiter = core.RateLimiter
+	d.Rewriter = core.Rewriter
+	d.PropagateQuery = d.PropagateQuery || r.URL.Query().Has(`propagate_query`)
+	requestHeaders, err := core.requestHeaders(r, probeUrl)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	result, err := d.Probe(probeUrl, requestHeaders)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	data, err := json.MarshalIndent(result, ``, `  `)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.Write(data)
+}
+
+func NewCore(config *downloader.Config, rateLimiter *downloader.RateLimiter, rewriter *downloader.Rewriter) *Core {
 	core := Core{
-		Tasks: make([]*Task, 0),
+		Config:      config,
+		Tasks:       make([]*Task, 0),
+		RateLimiter: rateLimiter,
+		Rewriter:    rewriter,
 	}
 	return &core
 }
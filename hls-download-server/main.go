@@ -4,10 +4,12 @@ import (
 	_ "embed"
 	"flag"
 	"fmt"
+	"github.com/vvampirius/hls-downloader/downloader"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 )
 
 const VERSION = `0.2.4`
@@ -23,6 +25,17 @@ var (
 	taskTemplate string
 )
 
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, `, `)
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func getTemplate(fileName, stringTemplate string) *template.Template {
 	t, err := template.ParseFiles(fileName)
 	if err != nil {
@@ -40,9 +53,23 @@ func helpText() {
 }
 
 func main() {
+	config, err := downloader.LoadConfig(downloader.ConfigFilename(os.Args[1:]))
+	if err != nil {
+		os.Exit(2)
+	}
+	downloader.FfmpegPath = config.FfmpegPath
 	help := flag.Bool("h", false, "print this help")
-	listen := flag.String("l", ":80", "listen address")
+	flag.String("config", config.Filename, "TOML config file (default "+downloader.DefaultConfigFile()+
+		" if it exists, or $"+downloader.ConfigEnvPrefix+"CONFIG), "+downloader.ConfigEnvPrefix+"<KEY> variables override it")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration as TOML and exit")
+	listen := flag.String("l", config.Server.Listen, "listen address")
+	maxTasks := flag.Int("max-tasks", config.Server.MaxTasks, "tasks running at once (0 - unlimited)")
 	ver := flag.Bool("v", false, "Show version")
+	rateLimit := flag.String("ratelimit", config.RateLimit.Rate, "total download rate limit for all tasks in bytes/sec (K, M suffixes allowed)")
+	rateLimitBurst := flag.String("ratelimit-burst", config.RateLimit.Burst, "total download rate limit burst in bytes (default: one second of rate)")
+	rewrite := stringsFlag(config.Rewrite)
+	flag.Var(&rewrite, "rewrite", "URL rewrite rule 'regexp=>replacement', 'host:hostregexp=>host' or JSON rules file (repeatable)")
+	headerProfiles := flag.String("header-profiles", config.HeaderProfilesFile, "JSON file of named header profiles (default "+downloader.DefaultHeaderProfilesFile()+" if it exists)")
 	flag.Parse()
 
 	if *help {
@@ -55,12 +82,51 @@ func main() {
 		os.Exit(0)
 	}
 
-	core := NewCore()
+	config.Server.Listen, config.Server.MaxTasks = *listen, *maxTasks
+	config.RateLimit.Rate, config.RateLimit.Burst = *rateLimit, *rateLimitBurst
+	config.Rewrite, config.HeaderProfilesFile = rewrite, *headerProfiles
+	if *printConfig {
+		if config.Filename != `` {
+			fmt.Printf("# %s\n", config.Filename)
+		}
+		if err := config.WriteToml(os.Stdout); err != nil {
+			ErrorLog.Fatalln(err.Error())
+		}
+		os.Exit(0)
+	}
+
+	rate, err := downloader.ParseRate(*rateLimit)
+	if err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+	burst, err := downloader.ParseRate(*rateLimitBurst)
+	if err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+
+	rewriter, err := downloader.ParseRewriteRules(rewrite)
+	if err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+
+	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+
+	core := NewCore(config, downloader.NewRateLimiter(rate, burst, nil), rewriter)
+	if core.HeaderProfiles, err = config.LoadHeaderProfiles(); err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
 
 	server := http.Server{Addr: *listen}
 	http.HandleFunc("/add", core.addHandler)
 	http.HandleFunc("/{$}", core.indexHandler)
 	http.HandleFunc("/{task}/{$}", core.taskHandler)
+	http.HandleFunc("/probe", core.probeHandler)
+	http.HandleFunc("/ratelimit", core.rateLimitHandler)
+	http.HandleFunc("/{task}/ratelimit", core.taskRateLimitHandler)
+	http.HandleFunc("/{task}/cancel", core.cancelHandler)
+	http.HandleFunc("/{task}/stats", core.statsHandler)
 	http.HandleFunc(`/favicon.ico`, http.NotFound)
 	if err := server.ListenAndServe(); err != nil {
 		ErrorLog.Fatalln(err.Error())
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/vvampirius/hls-downloader/downloader"
+	"sync"
 )
 
 type TaskInfo struct {
@@ -16,12 +18,29 @@ type TaskInfo struct {
 	} `json:"current_segment"`
 	DownloadedDuration float32 `json:"downloaded_duration"`
 	Error              string  `json:"error"`
+	ErrorKind          string  `json:"error_kind"`
+	Phase              string  `json:"phase"`
+	Retries            int     `json:"retries"`
+	Failovers          int     `json:"failovers"`
+	FailoverSource     string  `json:"failover_source"`
 	Finished           bool    `json:"finished"`
 	GotBytes           int64   `json:"got_bytes"`
 	Started            bool    `json:"started"`
 	SegmentsCount      int     `json:"segments_count"`
 	SegmentsDuration   float32 `json:"segments_duration"`
-	Source             string
+	RateLimit          int64   `json:"rate_limit"`
+	Rate               float64 `json:"rate"`
+	RateAverage        float64 `json:"rate_average"`
+	Eta                float64 `json:"eta"`
+	Sink               string  `json:"sink"`
+	SinkFallback       string  `json:"sink_fallback"`
+	Ffmpeg             struct {
+		Frame     int64   `json:"frame"`
+		OutTime   float64 `json:"out_time"`
+		TotalSize int64   `json:"total_size"`
+		Speed     string  `json:"speed"`
+	} `json:"ffmpeg"`
+	Source string
 }
 
 func (ti *TaskInfo) Json() string {
@@ -33,12 +52,12 @@ func (ti *TaskInfo) Json() string {
 }
 
 type Task struct {
-	EventStreams []*EventStream
-	Filename     string
-	Url          string
-	Downloader   *downloader.Downloader
-	Finished     bool
-	Source       string
+	EventStreams   []*EventStream
+	eventStreamsMu sync.Mutex
+	Filename       string
+	Url            string
+	Downloader     *downloader.Downloader
+	Source         string
 }
 
 func (task *Task) GetInfo() TaskInfo {
@@ -48,30 +67,60 @@ func (task *Task) GetInfo() TaskInfo {
 		Source:   task.Source,
 	}
 	if task.Downloader != nil {
+		progress := task.Downloader.Progress()
 		ti.Started = task.Downloader.Started
-		if task.Downloader.Finished || task.Downloader.Error != nil {
-			ti.Finished = true
+		ti.Finished = progress.Done()
+		if progress.Error != nil {
+			ti.Error = progress.Error.Error()
 		}
-		if task.Downloader.Error != nil {
-			ti.Error = task.Downloader.Error.Error()
+		ti.CurrentSegment.Num = progress.SegmentNum
+		ti.CurrentSegment.Size = progress.SegmentSize
+		ti.CurrentSegment.Url = progress.SegmentUrl
+		ti.CurrentSegment.GotBytes = progress.SegmentBytes
+		ti.DownloadedDuration = progress.Duration
+		ti.GotBytes = progress.Bytes
+		ti.Phase = string(progress.Phase)
+		ti.ErrorKind = string(progress.ErrorKind)
+		ti.Retries = progress.Retries
+		ti.Failovers = progress.Failovers
+		ti.FailoverSource = progress.Source
+		ti.Rate = progress.CurrentRate
+		ti.RateAverage = progress.MovingRate
+		ti.Eta = progress.Eta.Seconds()
+		ti.Sink = progress.Sink
+		if progress.SinkError != nil {
+			ti.SinkFallback = fmt.Sprintf("can't use '%s' sink: %s", task.Downloader.SinkName,
+				progress.SinkError.Error())
 		}
-		ti.CurrentSegment.Num = task.Downloader.CurrentSegment.Num
-		ti.CurrentSegment.Size = task.Downloader.CurrentSegment.Size
-		ti.CurrentSegment.Url = task.Downloader.CurrentSegment.Url
-		ti.CurrentSegment.GotBytes = task.Downloader.CurrentSegment.GotBytes
-		ti.DownloadedDuration = task.Downloader.DownloadedDuration
-		ti.GotBytes = task.Downloader.GotBytes
-		if task.Downloader.Playlist != nil {
-			ti.SegmentsCount = task.Downloader.Playlist.SegmentsCount
-			ti.SegmentsDuration = task.Downloader.Playlist.SegmentsDuration
+		ti.Ffmpeg.Frame = progress.Ffmpeg.Frame
+		ti.Ffmpeg.OutTime = progress.Ffmpeg.OutTime.Seconds()
+		ti.Ffmpeg.TotalSize = progress.Ffmpeg.TotalSize
+		ti.Ffmpeg.Speed = progress.Ffmpeg.Speed
+		if task.Downloader.RateLimiter != nil {
+			ti.RateLimit, _ = task.Downloader.RateLimiter.Limit()
 		}
+		ti.SegmentsCount = progress.TotalSegments
+		ti.SegmentsDuration = progress.TotalDuration
 	}
 	return ti
 }
 
+func (task *Task) AddEventStream(es *EventStream) {
+	task.eventStreamsMu.Lock()
+	defer task.eventStreamsMu.Unlock()
+	task.EventStreams = append(task.EventStreams, es)
+}
+
+func (task *Task) GetEventStreams() []*EventStream {
+	task.eventStreamsMu.Lock()
+	defer task.eventStreamsMu.Unlock()
+	return append([]*EventStream{}, task.EventStreams...)
+}
+
 func (task *Task) IsError() bool {
-	if task.Downloader != nil && task.Downloader.Error != nil {
-		return true
-	}
-	return false
+	return task.Downloader != nil && task.Downloader.Progress().Error != nil
+}
+
+func (task *Task) Finished() bool {
+	return task.Downloader != nil && task.Downloader.Progress().Done()
 }
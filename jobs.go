@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/downloader"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrJobFile = errors.New(`bad job file`)
+
+	regexpHeaderToken = regexp.MustCompile(`^[A-Za-z0-9-]+:(\s|$)`) // 'Name:' or quoted 'Name: value'
+)
+
+// batchJob is a download of the batch. Headers override the ones of the batch options.
+type batchJob struct {
+	Line     int               `json:"-"`
+	Url      string            `json:"url"`
+	Filename string            `json:"filename,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+func jobFileError(filename string, line int, message string) error {
+	err := errors.Join(ErrJobFile, errors.New(fmt.Sprintf("%s:%d: %s", filename, line, message)))
+	ErrorLog.Println(err.Error())
+	return err
+}
+
+// splitFields splits the line by spaces, '...' and "..." are single fields (without the quotes).
+func splitFields(line string) ([]string, error) {
+	fields := make([]string, 0)
+	var field strings.Builder
+	var quote rune
+	inField := false
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			field.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inField = r, true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New(`unterminated quote`)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// parseTextJobs parses lines of 'url [filename] [Name: value]...'. Empty lines and lines starting with '#' are
+// skipped, a header with spaces in the value is quoted or written as 'Name: value' tokens. The token after the URL
+// is a header if it is 'Name:' (or quoted 'Name: value'), so a filename may have colons (e.g. 'out:1.mp4').
+func parseTextJobs(filename string, data []byte) ([]batchJob, error) {
+	jobs := make([]batchJob, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		fields, err := splitFields(line)
+		if err != nil {
+			return nil, jobFileError(filename, n, err.Error())
+		}
+		job := batchJob{Line: n, Url: fields[0], Headers: make(map[string]string)}
+		rest := fields[1:]
+		if len(rest) > 0 && !regexpHeaderToken.MatchString(rest[0]) {
+			job.Filename, rest = rest[0], rest[1:]
+		}
+		for i := 0; i < len(rest); i++ {
+			token := rest[i]
+			if strings.HasSuffix(token, `:`) && i+1 < len(rest) {
+				token, i = token+` `+rest[i+1], i+1
+			}
+			name, value, err := downloader.ParseHeader(token)
+			if err != nil {
+				return nil, jobFileError(filename, n, err.Error())
+			}
+			job.Headers[name] = value
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// lineAt is the line of the first value after the offset (skipping spaces and commas) in the JSON data.
+func lineAt(data []byte, offset int64) int {
+	offset = min(offset, int64(len(data)))
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,", data[offset]) >= 0 {
+		offset++
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// parseJsonJobs parses an array of jobs or an object with the array in "jobs".
+func parseJsonJobs(filename string, data []byte) ([]batchJob, error) {
+	jobs := make([]batchJob, 0)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	fail := func(err error) ([]batchJob, error) {
+		return nil, jobFileError(filename, lineAt(data, decoder.InputOffset()), err.Error())
+	}
+	token, err := decoder.Token()
+	if err != nil {
+		return fail(err)
+	}
+	if token == json.Delim('{') {
+		// other keys are skipped
+		for {
+			if token, err = decoder.Token(); err != nil {
+				return fail(err)
+			}
+			if token == json.Delim('}') {
+				return jobs, nil
+			}
+			if token == `jobs` {
+				break
+			}
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return fail(err)
+			}
+		}
+		if token, err = decoder.Token(); err != nil {
+			return fail(err)
+		}
+	}
+	if token != json.Delim('[') {
+		return fail(errors.New(`expect an array of jobs`))
+	}
+	for decoder.More() {
+		job := batchJob{Line: lineAt(data, decoder.InputOffset())}
+		if err := decoder.Decode(&job); err != nil {
+			return fail(err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// yamlValue unquotes a scalar.
+func yamlValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, `'`):
+		if len(value) < 2 || !strings.HasSuffix(value, `'`) {
+			return ``, errors.New(`unterminated quote`)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], `''`, `'`), nil
+	}
+	return value, nil
+}
+
+// yamlStripComment cuts off the comment: '#' at the start or after a space, outside quoted scalars.
+func yamlStripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case i > 0 && line[i-1] != ' ' && line[i-1] != '\t':
+			// a quote or '#' inside a plain scalar
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return line
+}
+
+// parseYamlJobs parses a YAML list of jobs (optionally under 'jobs:'), the subset needed for them only: an item is
+// a mapping of url, filename and headers (a mapping of names to values) or the URL alone.
+func parseYamlJobs(filename string, data []byte) ([]batchJob, error) {
+	jobs := make([]batchJob, 0)
+	inHeaders, headersIndent := false, 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		raw := strings.TrimRight(yamlStripComment(strings.TrimRight(scanner.Text(), "\r")), " \t")
+		line := strings.TrimSpace(raw)
+		if line == `` || line == `---` {
+			continue
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, ` `))
+		if indent == 0 && line == `jobs:` {
+			continue
+		}
+		if line == `-` || strings.HasPrefix(line, `- `) {
+			jobs = append(jobs, batchJob{Line: n, Headers: make(map[string]string)})
+			inHeaders = false
+			line, indent = strings.TrimSpace(line[1:]), indent+2
+			if line == `` {
+				continue
+			}
+			if !strings.Contains(line, `: `) && !strings.HasSuffix(line, `:`) {
+				value, err := yamlValue(line)
+				if err != nil {
+					return nil, jobFileError(filename, n, err.Error())
+				}
+				jobs[len(jobs)-1].Url = value
+				continue
+			}
+		}
+		if len(jobs) == 0 {
+			return nil, jobFileError(filename, n, `expect a list of jobs`)
+		}
+		job := &jobs[len(jobs)-1]
+		key, value, _ := strings.Cut(line, `:`)
+		value, err := yamlValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, jobFileError(filename, n, err.Error())
+		}
+		if inHeaders && indent > headersIndent {
+			job.Headers[strings.TrimSpace(key)] = value
+			continue
+		}
+		inHeaders = false
+		switch key {
+		case `url`:
+			job.Url = value
+		case `filename`:
+			job.Filename = value
+		case `headers`:
+			inHeaders, headersIndent = true, indent
+		default:
+			return nil, jobFileError(filename, n, fmt.Sprintf("unknown key '%s'", key))
+		}
+	}
+	return jobs, nil
+}
+
+// readJobs reads the job file: JSON by .json extension or content, YAML by .yaml/.yml extension, text otherwise.
+func readJobs(filename string) ([]batchJob, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	var jobs []batchJob
+	trimmed := bytes.TrimSpace(data)
+	switch ext := strings.ToLower(filepath.Ext(filename)); {
+	case ext == `.json` || bytes.HasPrefix(trimmed, []byte(`[`)) || bytes.HasPrefix(trimmed, []byte(`{`)):
+		jobs, err = parseJsonJobs(filename, data)
+	case ext == `.yaml` || ext == `.yml`:
+		jobs, err = parseYamlJobs(filename, data)
+	default:
+		jobs, err = parseTextJobs(filename, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.Url == `` {
+			return nil, jobFileError(filename, job.Line, `no url`)
+		}
+	}
+	if len(jobs) == 0 {
+		return nil, jobFileError(filename, 0, `no jobs`)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJobs(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func(filename string, data []byte) ([]batchJob, error)
+		data  string
+		jobs  []batchJob
+	}{
+		{`text`, parseTextJobs, "# comment\n\nhttp://a/1.m3u8\n" +
+			"  http://a/2.m3u8 two.mp4 Referer: http://a/ 'User-Agent: Test 1.0'\n" +
+			"http://a/3.m3u8 out:3.mp4 X-Token: t\n" +
+			"http://a/4.m3u8 Cookie: a=b\n" +
+			"http://a/5.m3u8 \"my video.mp4\"\n", []batchJob{
+			{3, `http://a/1.m3u8`, ``, map[string]string{}},
+			{4, `http://a/2.m3u8`, `two.mp4`, map[string]string{`Referer`: `http://a/`, `User-Agent`: `Test 1.0`}},
+			{5, `http://a/3.m3u8`, `out:3.mp4`, map[string]string{`X-Token`: `t`}},
+			{6, `http://a/4.m3u8`, ``, map[string]string{`Cookie`: `a=b`}},
+			{7, `http://a/5.m3u8`, `my video.mp4`, map[string]string{}},
+		}},
+		{`json array`, parseJsonJobs, "[\n  {\"url\": \"http://a/1.m3u8\"},\n\n  {\n    \"url\": \"http://a/2.m3u8\",\n" +
+			"    \"filename\": \"two.mp4\",\n    \"headers\": {\"Referer\": \"http://a/\"}\n  }\n]\n", []batchJob{
+			{2, `http://a/1.m3u8`, ``, nil},
+			{4, `http://a/2.m3u8`, `two.mp4`, map[string]string{`Referer`: `http://a/`}},
+		}},
+		{`json object`, parseJsonJobs, "{\n  \"comment\": {\"a\": [1, 2]},\n  \"jobs\": [\n" +
+			"    {\"url\": \"http://a/1.m3u8\"}, {\"url\": \"http://a/2.m3u8\"}\n  ]\n}\n", []batchJob{
+			{4, `http://a/1.m3u8`, ``, nil},
+			{4, `http://a/2.m3u8`, ``, nil},
+		}},
+		{`yaml`, parseYamlJobs, "# jobs\njobs:\n  - http://a/1.m3u8 # the first\n" +
+			"  - url: 'http://a/2.m3u8#t=1'\n    filename: \"two #2.mp4\"  # quoted\n    headers:\n" +
+			"      Referer: http://a/ # a comment\n      X-Token: a#b\n" +
+			"  -\n    url: http://a/3.m3u8\n    filename: 'it''s.mp4'\n", []batchJob{
+			{3, `http://a/1.m3u8`, ``, map[string]string{}},
+			{4, `http://a/2.m3u8#t=1`, `two #2.mp4`, map[string]string{`Referer`: `http://a/`, `X-Token`: `a#b`}},
+			{9, `http://a/3.m3u8`, `it's.mp4`, map[string]string{}},
+		}},
+	}
+	for _, test := range tests {
+		jobs, err := test.parse(`jobs`, []byte(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(jobs, test.jobs) {
+			t.Errorf("%s: jobs = %+v, want %+v", test.name, jobs, test.jobs)
+		}
+	}
+}
+
+func TestParseJobsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func(filename string, data []byte) ([]batchJob, error)
+		data  string
+		error string
+	}{
+		{`text quote`, parseTextJobs, "http://a/1.m3u8\nhttp://a/2.m3u8 'out.mp4\n",
+			"bad job file\njobs:2: unterminated quote"},
+		{`text header`, parseTextJobs, "http://a/1.m3u8 out.mp4 Referer\n", "bad job file\njobs:1: bad header"},
+		{`json syntax`, parseJsonJobs, "[\n  {\"url\": \"http://a/1.m3u8\"},\n  {\"url\": }\n]\n",
+			"bad job file\njobs:3: "},
+		{`json type`, parseJsonJobs, "{\"jobs\": {}}", "bad job file\njobs:1: expect an array of jobs"},
+		{`yaml key`, parseYamlJobs, "- url: http://a/1.m3u8\n  file: out.mp4\n",
+			"bad job file\njobs:2: unknown key 'file'"},
+		{`yaml list`, parseYamlJobs, "url: http://a/1.m3u8\n", "bad job file\njobs:1: expect a list of jobs"},
+	}
+	for _, test := range tests {
+		_, err := test.parse(`jobs`, []byte(test.data))
+		if !errors.Is(err, ErrJobFile) || !strings.HasPrefix(err.Error(), test.error) {
+			t.Errorf("%s: error = %v, want %q...", test.name, err, test.error)
+		}
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"flag"
 	"fmt"
 	"github.com/vvampirius/hls-downloader/downloader"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"time"
@@ -19,10 +21,28 @@ var (
 	DebugLog = log.New(os.Stdout, `debug#`, log.Lshortfile)
 )
 
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, `, `)
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func helpText() {
 	fmt.Println(`https://github.com/vvampirius/hls-downloader`)
 	fmt.Println(`Download HTTP Live Streaming (HLS) content`)
-	fmt.Printf("\nUsage: %s [options] [<m3u url> <output filename>]\n\n", os.Args[0])
+	fmt.Printf("\nUsage: %s [options] [<m3u url> [<output filename>]]\n", os.Args[0])
+	fmt.Printf("       %s probe [-json] <m3u url>\n", os.Args[0])
+	fmt.Printf("       %s verify <output or manifest>...\n", os.Args[0])
+	fmt.Printf("       %s batch [options] <job file>\n", os.Args[0])
+	fmt.Printf("       %s config [-config <file>]\n", os.Args[0])
+	fmt.Println("The m3u may be a local file (path or file:// URL) or '-' to read it from stdin.")
+	fmt.Println("Without the output filename it is made of the filename_template of the config.")
+	fmt.Println()
 	flag.PrintDefaults()
 }
 
@@ -55,7 +75,7 @@ func readOutputFilename() string {
 		}
 		line = strings.TrimSuffix(line, "\n")
 		if line == `` {
-			return fmt.Sprintf("%d.mp4", time.Now().Unix())
+			return `` // made of the filename template
 		}
 		if ext := filepath.Ext(line); ext == `` || len(ext) > 4 {
 			log.Println(`Added mp4 extension`)
@@ -70,9 +90,59 @@ func readOutputFilename() string {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case `probe`:
+			os.Exit(probeCommand(os.Args[2:]))
+		case `verify`:
+			os.Exit(verifyCommand(os.Args[2:]))
+		case `batch`:
+			os.Exit(batchCommand(os.Args[2:]))
+		case `config`:
+			os.Exit(configCommand(os.Args[2:]))
+		}
+	}
+	config := loadConfig(os.Args[1:])
+	if config == nil {
+		os.Exit(2)
+	}
+	configFlag(flag.CommandLine, config)
 	help := flag.Bool("h", false, "print this help")
 	ver := flag.Bool("v", false, "Show version")
-	noffmpeg := flag.Bool("noffmpeg", false, "Do not use ffmpeg")
+	noffmpeg := flag.Bool("noffmpeg", false, "Do not use ffmpeg, remux to MP4 natively (same as -sink mp4)")
+	sinkName := flag.String("sink", config.Sink, "output sink: "+strings.Join(downloader.SinkNames(), ", "))
+	sinkFallback := flag.String("sink-fallback", config.SinkFallback, "sink to use if the -sink one can't be opened (empty - fail)")
+	ffmpegProfile := flag.String("ffmpeg-profile", config.FfmpegProfile, "ffmpeg output profile: "+strings.Join(downloader.FfmpegProfileNames(), ", "))
+	ffmpegArgs := flag.String("ffmpeg-args", "", "custom ffmpeg output options instead of the profile ones (e.g. \"-c:v libx265 -c:a copy -f mp4\")")
+	storeLayout := flag.String("store-layout", downloader.DefaultStoreLayout, "object key template of the store sink")
+	rateLimit := flag.String("ratelimit", config.RateLimit.Rate, "download rate limit in bytes/sec (K, M suffixes allowed)")
+	rateLimitBurst := flag.String("ratelimit-burst", config.RateLimit.Burst, "download rate limit burst in bytes (default: one second of rate)")
+	retries := flag.Int("retries", config.Retries, "retries of a failed or invalid segment")
+	noValidate := flag.Bool("novalidate", false, "do not validate segments (HTML responses, truncation, container structure)")
+	sizeTolerance := flag.Float64("size-tolerance", 0, "reject a segment whose size differs from the expected one by more than this fraction (0 - disabled)")
+	propagateQuery := flag.Bool("propagate-query", config.Http.PropagateQuery, "add playlist URL query parameters (e.g. signed tokens) to segment URLs")
+	mirror := flag.Bool("mirror", false, "mirror the stream as HLS into the output directory (segments, keys and a local index.m3u8); an existing mirror is updated")
+	mirrorVariants := flag.Bool("mirror-variants", false, "mirror all variants and renditions of a master playlist (default: the highest bandwidth one)")
+	clipStart := flag.String("start", "", "download from this time of a VOD playlist (seconds, [hh:]mm:ss[.fff] or 1m30s)")
+	clipEnd := flag.String("end", "", "download till this time of a VOD playlist")
+	clipDuration := flag.String("duration", "", "download this long part of a VOD playlist (instead of -end)")
+	clipPrecise := flag.Bool("precise", false, "cut the clip exactly at -start/-end instead of the segment boundaries (ffmpeg and mp4 sinks)")
+	baseUrl := flag.String("base-url", "", "resolve segment URIs against this URL or directory instead of the playlist location")
+	splitParts := flag.Int("split-parts", config.Http.SplitParts, "download a large segment in this many parallel byte ranges")
+	splitThreshold := flag.String("split-threshold", config.Http.SplitThreshold, "split segments of this size or larger (K, M suffixes allowed; empty - never)")
+	maxHostConnections := flag.Int("max-host-connections", config.Http.MaxHostConnections, "connections per host (0 - unlimited)")
+	printStats := flag.Bool("stats", false, "print the stats of every segment (status, attempts, resumes, parts, size, TTFB, time) to stderr at the end")
+	refresh := flag.String("refresh", "", "on 401/403 get fresh URLs: 'playlist' (re-fetch it), 'cmd:<command>' (prints a playlist URL or {\"playlist_url\", \"headers\"} JSON) or an endpoint URL (POSTed the request JSON)")
+	manifest := flag.Bool("manifest", false, "write the JSON manifest (source, segments with SHA-256, output hash) next to the output after the download")
+	audioOnly := flag.Bool("audio-only", false, "download the audio only (an audio-only variant or rendition, or the lowest bandwidth variant) into .m4a, .aac or .mp3 by the output extension")
+	subtitles := flag.String("subs", "", "download the subtitle rendition by language or name, 'default' or a subtitle playlist URL")
+	subtitlesFormat := flag.String("subs-format", "vtt", "subtitles file format: vtt or srt")
+	subtitlesMux := flag.Bool("subs-mux", false, "mux the subtitles into the output with ffmpeg (mp4, mov, mkv, webm) instead of keeping the file next to it")
+	headerOptions := newHeaderFlags(flag.CommandLine, config)
+	alternateHosts := stringsFlag{}
+	flag.Var(&alternateHosts, "alt-host", "alternate host serving the same URLs to fail over to (repeatable)")
+	rewrite := stringsFlag(config.Rewrite)
+	flag.Var(&rewrite, "rewrite", "URL rewrite rule 'regexp=>replacement', 'host:hostregexp=>host' or JSON rules file (repeatable)")
 	flag.Parse()
 
 	if *help {
@@ -89,9 +159,8 @@ func main() {
 	switch flag.NArg() {
 	case 2:
 		m3uUrl, outputFilename = flag.Arg(0), flag.Arg(1)
-		if _, err := os.Stat(outputFilename); err == nil {
-			ErrorLog.Fatalln(`File exist!`)
-		}
+	case 1:
+		m3uUrl = flag.Arg(0)
 	case 0:
 		outputFilename = readOutputFilename()
 		m3uUrl = readUrl()
@@ -101,37 +170,205 @@ func main() {
 		os.Exit(1)
 	}
 
-	useFfmpeg := true
 	if *noffmpeg {
-		useFfmpeg = false
+		*sinkName = `mp4`
+	}
+	if outputFilename == `` {
+		template, ext := config.FilenameTemplate, outputExt(*sinkName, *ffmpegProfile)
+		if template == `` {
+			template = `{unix}{ext}`
+		}
+		switch {
+		case *mirror:
+			ext = ``
+		case *audioOnly:
+			ext = `.m4a`
+		}
+		outputFilename = downloader.ExpandFilenameTemplate(template, m3uUrl, 1, ext)
+	}
+	outputFilename = config.OutputPath(outputFilename)
+	if outputFilename != `-` {
+		if err := os.MkdirAll(filepath.Dir(outputFilename), 0755); err != nil {
+			ErrorLog.Fatalln(err.Error())
+		}
+	}
+	if _, err := os.Stat(outputFilename); err == nil && !*mirror {
+		ErrorLog.Fatalln(`File exist!`)
+	}
+	if *audioOnly {
+		if *mirror {
+			ErrorLog.Fatalln(`-audio-only can't be used with -mirror`)
+		}
+		audioOutput, err := downloader.GetAudioOutput(outputFilename)
+		if err != nil {
+			ErrorLog.Fatalln(err.Error())
+		}
+		// the profile and the native sink of the extension replace the default ones, explicit options are kept
+		explicit := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = true
+		})
+		if !explicit[`ffmpeg-profile`] {
+			*ffmpegProfile = audioOutput.FfmpegProfile
+		}
+		if *sinkName == `mp4` {
+			if audioOutput.Sink == `` {
+				ErrorLog.Fatalf("%s output needs ffmpeg\n", filepath.Ext(outputFilename))
+			}
+			*sinkName = audioOutput.Sink
+		}
+		if !explicit[`sink-fallback`] {
+			*sinkFallback = audioOutput.Sink
+		}
+	}
+	// the stream goes to stdout with the stdout sink (or '-' output), so everything else has to go to stderr
+	var progress io.Writer = os.Stdout
+	if *sinkName == `stdout` || outputFilename == `-` {
+		progress = os.Stderr
+		downloader.DebugLog.SetOutput(os.Stderr)
+		DebugLog.SetOutput(os.Stderr)
+	}
+
+	if _, err := downloader.GetFfmpegProfile(*ffmpegProfile); err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+
+	rate, err := downloader.ParseRate(*rateLimit)
+	if err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+	burst, err := downloader.ParseRate(*rateLimitBurst)
+	if err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+	threshold, err := downloader.ParseRate(*splitThreshold)
+	if err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+
+	requestHeaders, err := headerOptions.requestHeaders(m3uUrl)
+	if err != nil {
+		ErrorLog.Fatalln(err.Error())
 	}
 
-	notifyChan, err := downloader.NewDownloader().Download(m3uUrl, outputFilename, useFfmpeg, nil)
+	d := downloader.NewDownloader()
+	if d.ClipStart, err = downloader.ParseClipTime(*clipStart); err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+	if d.ClipEnd, err = downloader.ParseClipTime(*clipEnd); err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+	if d.ClipDuration, err = downloader.ParseClipTime(*clipDuration); err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+	d.ClipPrecise = *clipPrecise
+	d.BaseUrl = *baseUrl
+	d.AlternateHosts = alternateHosts
+	d.PropagateQuery = *propagateQuery
+	d.Retries = *retries
+	d.Validate = !*noValidate
+	d.SizeTolerance = *sizeTolerance
+	d.SplitParts = *splitParts
+	d.SplitThreshold = threshold
+	d.MaxHostConnections = *maxHostConnections
+	d.SinkName = *sinkName
+	d.SinkFallback = *sinkFallback
+	d.SinkOptions.StoreLayout = *storeLayout
+	d.SinkOptions.FfmpegProfile = *ffmpegProfile
+	d.SinkOptions.FfmpegArgs = strings.Fields(*ffmpegArgs)
+	d.HttpOptions = config.HttpOptions()
+	if rate > 0 {
+		d.RateLimiter = downloader.NewRateLimiter(rate, burst, nil)
+	}
+	if d.Rewriter, err = downloader.ParseRewriteRules(rewrite); err != nil {
+		ErrorLog.Fatalln(err.Error())
+	}
+	d.MirrorVariants = *mirrorVariants
+	d.AudioOnly = *audioOnly
+	if *refresh != `` {
+		if d.Refresher, err = downloader.ParseRefresher(*refresh); err != nil {
+			ErrorLog.Fatalln(err.Error())
+		}
+	}
+	if *manifest && *mirror {
+		ErrorLog.Fatalln(`-manifest can't be used with -mirror`)
+	}
+	if *manifest {
+		d.ManifestFilename = downloader.ManifestFor(outputFilename)
+	}
+	if *subtitles != `` && *mirror {
+		ErrorLog.Fatalln(`-subs can't be used with -mirror, -mirror-variants mirrors the subtitles`)
+	}
+	d.Subtitles, d.SubtitlesFormat, d.SubtitlesMux = *subtitles, *subtitlesFormat, *subtitlesMux
+	var events chan downloader.ProgressEvent
+	if *mirror {
+		events, err = d.Mirror(m3uUrl, outputFilename, requestHeaders)
+	} else {
+		events, err = d.Download(m3uUrl, outputFilename, requestHeaders)
+	}
 	if err != nil {
 		ErrorLog.Println(err.Error())
 		os.Exit(1)
 	}
+	if progress := d.Progress(); progress.SinkError != nil {
+		fmt.Fprintf(os.Stderr, "Can't use '%s' sink (%s), writing with '%s' sink\n", d.SinkName,
+			progress.SinkError.Error(), progress.Sink)
+	}
+	// the first interrupt cancels the download (and kills ffmpeg), the second one exits at once
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nCancelling...")
+		d.Cancel()
+		<-signals
+		os.Exit(130)
+	}()
 
 	i, segmentNum := 0, 0
-	for d := range notifyChan {
-		if i != 0 && segmentNum != d.CurrentSegment.Num {
-			fmt.Println()
-		}
-		if d.Playlist != nil {
-			fmt.Printf("\r[%d / %d] [%s / %s] [%.1f Mb] [%.1f / %.1f Kb]\t",
-				d.CurrentSegment.Num, d.Playlist.SegmentsCount, time.Duration(d.DownloadedDuration*float32(time.Second)),
-				time.Duration(d.Playlist.SegmentsDuration*float32(time.Second)), float64(d.GotBytes)/1024/1024,
-				float32(d.CurrentSegment.GotBytes)/1024, float32(d.CurrentSegment.Size)/1024)
+	for event := range events {
+		if i != 0 && segmentNum != event.SegmentNum {
+			fmt.Fprintln(progress)
+		}
+		if event.TotalSegments > 0 {
+			fmt.Fprintf(progress, "\r[%d / %d] [%s / %s] [%.1f Mb] [%.1f / %.1f Kb]\t",
+				event.SegmentNum, event.TotalSegments, time.Duration(event.Duration*float32(time.Second)),
+				time.Duration(event.TotalDuration*float32(time.Second)), float64(event.Bytes)/1024/1024,
+				float32(event.SegmentBytes)/1024, float32(event.SegmentSize)/1024)
 		} else {
-			fmt.Printf("\rno playlist loaded")
+			fmt.Fprintf(progress, "\r[%s] [%.1f Mb] [%.1f / %.1f Kb]\t", event.Phase, float64(event.Bytes)/1024/1024,
+				float32(event.SegmentBytes)/1024, float32(event.SegmentSize)/1024)
+		}
+		if event.MovingRate > 0 {
+			fmt.Fprintf(progress, "[%.2f Mb/s", event.MovingRate/1024/1024)
+			if event.Eta > 0 {
+				fmt.Fprintf(progress, " ETA %s", event.Eta.Round(time.Second))
+			}
+			fmt.Fprint(progress, "]\t")
+		}
+		if event.Failovers > 0 {
+			fmt.Fprintf(progress, "[failovers %d, %s]\t", event.Failovers, event.Source)
+		}
+		if event.Ffmpeg.OutTime > 0 {
+			fmt.Fprintf(progress, "[ffmpeg %s %s]\t", event.Ffmpeg.OutTime.Truncate(time.Second), event.Ffmpeg.Speed)
 		}
 		i++
-		segmentNum = d.CurrentSegment.Num
-		err = d.Error
+		segmentNum = event.SegmentNum
+		err = event.Error
+	}
+	fmt.Fprintln(progress)
+	if *printStats {
+		for _, stats := range d.SegmentStats() {
+			fmt.Fprintf(os.Stderr, "%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", stats.Num, stats.Status,
+				stats.Attempts, stats.Resumes, stats.Parts, stats.Size,
+				stats.Ttfb.Round(time.Millisecond), stats.Elapsed.Round(time.Millisecond), stats.Url, stats.Error)
+		}
 	}
-	fmt.Println()
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Fprintln(progress, err.Error())
 		os.Exit(1)
 	}
+	if d.SubtitlesFilename != `` {
+		fmt.Fprintf(progress, "Subtitles: %s\n", d.SubtitlesFilename)
+	}
 }
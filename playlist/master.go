@@ -0,0 +1,164 @@
+package playlist
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Variant is an EXT-X-STREAM-INF entry of a master playlist.
+type Variant struct {
+	Uri        string
+	Bandwidth  int64
+	Resolution string
+	Codecs     string
+	Attributes map[string]string
+}
+
+// IsMaster tells if the data is a master playlist.
+func IsMaster(data []byte) bool {
+	return bytes.Contains(data, []byte(`#EXT-X-STREAM-INF`))
+}
+
+// ParseMaster returns the variants of the master playlist in their order.
+func ParseMaster(data []byte) []Variant {
+	variants := make([]Variant, 0)
+	var variant *Variant
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, `#EXT-X-STREAM-INF:`):
+			attributes := ParseAttributes(strings.TrimPrefix(line, `#EXT-X-STREAM-INF:`))
+			variant = &Variant{
+				Resolution: attributes[`RESOLUTION`],
+				Codecs:     attributes[`CODECS`],
+				Attributes: attributes,
+			}
+			variant.Bandwidth, _ = strconv.ParseInt(attributes[`BANDWIDTH`], 10, 64)
+		case line != `` && !strings.HasPrefix(line, `#`) && variant != nil:
+			variant.Uri = line
+			variants = append(variants, *variant)
+			variant = nil
+		}
+	}
+	return variants
+}
+
+// StreamKey identifies the stream of the variant by BANDWIDTH, RESOLUTION, CODECS and the rendition groups (AUDIO,
+// VIDEO, SUBTITLES and CLOSED-CAPTIONS): redundant variants of the stream have the same key.
+func (variant Variant) StreamKey() string {
+	return strings.Join([]string{strconv.FormatInt(variant.Bandwidth, 10), variant.Resolution, variant.Codecs,
+		variant.Attributes[`AUDIO`], variant.Attributes[`VIDEO`], variant.Attributes[`SUBTITLES`],
+		variant.Attributes[`CLOSED-CAPTIONS`]}, "\n")
+}
+
+// GroupRedundant groups the variants of the same stream served from different locations: the ones with the same
+// StreamKey but different URIs. Groups are in the order of their first variants.
+func GroupRedundant(variants []Variant) [][]Variant {
+	groups := make([][]Variant, 0)
+	index := make(map[string]int)
+	for _, variant := range variants {
+		key := variant.StreamKey()
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(groups)
+			groups = append(groups, []Variant{variant})
+			continue
+		}
+		duplicate := false
+		for _, v := range groups[i] {
+			duplicate = duplicate || v.Uri == variant.Uri
+		}
+		if !duplicate {
+			groups[i] = append(groups[i], variant)
+		}
+	}
+	return groups
+}
+
+// BestGroup returns the redundant group of the highest bandwidth, nil if there are no variants.
+func BestGroup(groups [][]Variant) []Variant {
+	var best []Variant
+	for _, group := range groups {
+		if best == nil || group[0].Bandwidth > best[0].Bandwidth {
+			best = group
+		}
+	}
+	return best
+}
+
+// WorstGroup returns the redundant group of the lowest bandwidth, nil if there are no variants.
+func WorstGroup(groups [][]Variant) []Variant {
+	var worst []Variant
+	for _, group := range groups {
+		if worst == nil || group[0].Bandwidth < worst[0].Bandwidth {
+			worst = group
+		}
+	}
+	return worst
+}
+
+var (
+	audioCodecs = []string{`mp4a`, `ac-3`, `ec-3`, `ac-4`, `opus`, `flac`, `alac`, `mp3`, `dtsc`, `dtse`, `dtsh`}
+	videoCodecs = []string{`avc1`, `avc3`, `hvc1`, `hev1`, `dvh1`, `dvhe`, `vp08`, `vp09`, `av01`}
+)
+
+// codecKinds tells if the CODECS list has audio and video codecs.
+func codecKinds(codecs string) (bool, bool) {
+	audio, video := false, false
+	for _, codec := range strings.Split(strings.ToLower(codecs), `,`) {
+		codec = strings.TrimSpace(codec)
+		for _, prefix := range audioCodecs {
+			audio = audio || strings.HasPrefix(codec, prefix)
+		}
+		for _, prefix := range videoCodecs {
+			video = video || strings.HasPrefix(codec, prefix)
+		}
+	}
+	return audio, video
+}
+
+// IsAudioOnly tells if the variant has audio codecs only in CODECS.
+func (variant Variant) IsAudioOnly() bool {
+	audio, video := codecKinds(variant.Codecs)
+	return audio && !video
+}
+
+// HasAudio tells if the variant has an audio codec in CODECS. Without CODECS it is assumed to have audio.
+func (variant Variant) HasAudio() bool {
+	audio, _ := codecKinds(variant.Codecs)
+	return audio || variant.Codecs == ``
+}
+
+// Rendition is an EXT-X-MEDIA entry of a master playlist. Uri is empty if the rendition is in the variant streams.
+type Rendition struct {
+	Type       string
+	GroupId    string
+	Name       string
+	Language   string
+	Default    bool
+	Uri        string
+	Attributes map[string]string
+}
+
+// ParseRenditions returns the renditions of the master playlist in their order.
+func ParseRenditions(data []byte) []Rendition {
+	renditions := make([]Rendition, 0)
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, `#EXT-X-MEDIA:`) {
+			continue
+		}
+		attributes := ParseAttributes(strings.TrimPrefix(line, `#EXT-X-MEDIA:`))
+		renditions = append(renditions, Rendition{
+			Type:       attributes[`TYPE`],
+			GroupId:    attributes[`GROUP-ID`],
+			Name:       attributes[`NAME`],
+			Language:   attributes[`LANGUAGE`],
+			Default:    attributes[`DEFAULT`] == `YES`,
+			Uri:        attributes[`URI`],
+			Attributes: attributes,
+		})
+	}
+	return renditions
+}
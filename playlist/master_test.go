@@ -0,0 +1,35 @@
+package playlist
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupRedundant(t *testing.T) {
+	data := []byte("#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"aac\"\n" +
+		"a/720.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS=\"hvc1.1.6.L93.B0,mp4a.40.2\",AUDIO=\"aac\"\n" +
+		"a/720-hevc.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"ac3\"\n" +
+		"a/720-ac3.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"aac\"\n" +
+		"https://backup.example.com/a/720.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"aac\"\n" +
+		"a/720.m3u8\n")
+	groups := GroupRedundant(ParseMaster(data))
+	want := [][]string{{`a/720.m3u8`, `https://backup.example.com/a/720.m3u8`}, {`a/720-hevc.m3u8`},
+		{`a/720-ac3.m3u8`}}
+	if len(groups) != len(want) {
+		t.Fatalf("GroupRedundant() = %+v", groups)
+	}
+	for i, group := range groups {
+		uris := make([]string, len(group))
+		for j, variant := range group {
+			uris[j] = variant.Uri
+		}
+		if !reflect.DeepEqual(uris, want[i]) {
+			t.Errorf("group %d = %q, want %q", i, uris, want[i])
+		}
+	}
+}
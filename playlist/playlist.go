@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"regexp"
 	"strconv"
@@ -20,29 +21,84 @@ var (
 	RegexpTargetDuration = regexp.MustCompile(`^#EXT-X-TARGETDURATION:(\d+)$`)
 	RegexpMediaSequence  = regexp.MustCompile(`^#EXT-X-MEDIA-SEQUENCE:(\d+)$`)
 	RegexpExtInf         = regexp.MustCompile(`^#EXTINF:([\d\.]+),(.*)`)
-	RegexpExtXMapUri     = regexp.MustCompile(`^#EXT-X-MAP:URI="(.*)"$`)
+	RegexpExtXMap        = regexp.MustCompile(`^#EXT-X-MAP:(.*)$`)
+	RegexpExtXKey        = regexp.MustCompile(`^#EXT-X-KEY:(.*)$`)
+	RegexpExtXByteRange  = regexp.MustCompile(`^#EXT-X-BYTERANGE:(.*)$`)
 	RegexpUri            = regexp.MustCompile(`^([^\s#].*)`)
 	RegexpEndList        = regexp.MustCompile(`^#EXT-X-ENDLIST$`)
 )
 
+// Map is the media initialization section (EXT-X-MAP) of the segments following it.
+type Map struct {
+	Uri       string
+	ByteRange *ByteRange
+}
+
+// Key is the encryption (EXT-X-KEY) of the segments following it.
+type Key struct {
+	Method string
+	Uri    string
+	Iv     string
+}
+
+// Encrypted tells if the segments are encrypted: the key has a METHOD other than NONE.
+func (key *Key) Encrypted() bool {
+	return key != nil && key.Method != `NONE`
+}
+
+// ByteRange is a sub-range of the resource: Length bytes from Offset.
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+func (byteRange *ByteRange) String() string {
+	return fmt.Sprintf("%d@%d", byteRange.Length, byteRange.Offset)
+}
+
+// Header is the value of HTTP Range header of the sub-range.
+func (byteRange *ByteRange) Header() string {
+	return fmt.Sprintf("bytes=%d-%d", byteRange.Offset, byteRange.Offset+byteRange.Length-1)
+}
+
+// Equal compares maps by URI and byte range.
+func (m *Map) Equal(other *Map) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	if m.Uri != other.Uri {
+		return false
+	}
+	if m.ByteRange == nil || other.ByteRange == nil {
+		return m.ByteRange == other.ByteRange
+	}
+	return *m.ByteRange == *other.ByteRange
+}
+
 type Segment struct {
-	Duration float32
-	Title    string
-	Uri      string
-	IsMap    bool
+	Duration  float32
+	Title     string
+	Uri       string
+	ByteRange *ByteRange // EXT-X-BYTERANGE, nil if the segment is the whole resource
+	Map       *Map
+	Key       *Key // nil if no EXT-X-KEY precedes the segment
+	Sequence  int  // media sequence number
 }
 
 type Playlist struct {
 	Version        int
 	TargetDuration int
 	MediaSequence  int
-	MapUri         string
+	Map            *Map
+	Key            *Key
 	EndList        bool
 
 	segmentsCache          []*Segment
 	segmentsCacheMu        sync.Mutex
 	newSegmentNotification chan *Segment
 	readFinished           bool
+	lastRangeUri           string // the resource and the end of the last segment sub-range
+	lastRangeEnd           int64
 
 	SegmentsCount    int
 	SegmentsDuration float32
@@ -73,15 +129,122 @@ func (p *Playlist) GetSegment() (*Segment, error) {
 	return nil, err
 }
 
-func (p *Playlist) parseExtXMapUri(s string) bool {
-	match := RegexpExtXMapUri.FindStringSubmatch(s)
+// Totals returns the number and the duration of the segments read so far, it is safe to call it while the playlist
+// is being read.
+func (p *Playlist) Totals() (int, float32) {
+	p.segmentsCacheMu.Lock()
+	defer p.segmentsCacheMu.Unlock()
+	return p.SegmentsCount, p.SegmentsDuration
+}
+
+// ParseAttributes parses an attribute list (NAME=value,NAME="quoted, value"). Quotes are removed from the values.
+func ParseAttributes(s string) map[string]string {
+	attributes := make(map[string]string)
+	for s != `` {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ``
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.IndexByte(s, ','); comma >= 0 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ``
+		}
+		attributes[name] = value
+		s = strings.TrimPrefix(s, `,`)
+	}
+	return attributes
+}
+
+// ParseByteRange parses '<n>[@<o>]'. Offset is -1 if it is absent.
+func ParseByteRange(s string) (*ByteRange, error) {
+	byteRange := ByteRange{Offset: -1}
+	length, offset, hasOffset := strings.Cut(s, `@`)
+	n, err := strconv.ParseInt(length, 10, 64)
+	if err != nil {
+		ErrorLog.Printf("Can't parse byte range '%s': %s\n", s, err.Error())
+		return nil, err
+	}
+	byteRange.Length = n
+	if hasOffset {
+		o, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			ErrorLog.Printf("Can't parse byte range '%s': %s\n", s, err.Error())
+			return nil, err
+		}
+		byteRange.Offset = o
+	}
+	return &byteRange, nil
+}
+
+func (p *Playlist) parseExtXMap(s string) bool {
+	match := RegexpExtXMap.FindStringSubmatch(s)
+	if len(match) != 2 {
+		return false
+	}
+	attributes := ParseAttributes(match[1])
+	m := Map{Uri: attributes[`URI`]}
+	if value, ok := attributes[`BYTERANGE`]; ok {
+		byteRange, err := ParseByteRange(value)
+		if err != nil {
+			return false
+		}
+		byteRange.Offset = max(byteRange.Offset, 0)
+		m.ByteRange = byteRange
+	}
+	p.Map = &m
+	return true
+}
+
+func (p *Playlist) parseExtXKey(s string) bool {
+	match := RegexpExtXKey.FindStringSubmatch(s)
 	if len(match) != 2 {
 		return false
 	}
-	p.MapUri = match[1]
+	attributes := ParseAttributes(match[1])
+	p.Key = &Key{Method: attributes[`METHOD`], Uri: attributes[`URI`], Iv: attributes[`IV`]}
 	return true
 }
 
+// parseExtXByteRange sets the sub-range of the segment. The offset is resolved with the URI.
+func parseExtXByteRange(s string, dst *Segment) bool {
+	match := RegexpExtXByteRange.FindStringSubmatch(s)
+	if len(match) != 2 || dst == nil {
+		return false
+	}
+	byteRange, err := ParseByteRange(match[1])
+	if err != nil {
+		return false
+	}
+	dst.ByteRange = byteRange
+	return true
+}
+
+// resolveByteRange sets the absent offset of the segment sub-range: it follows the previous sub-range of the same
+// resource.
+func (p *Playlist) resolveByteRange(segment *Segment) {
+	if segment.ByteRange == nil {
+		return
+	}
+	if segment.ByteRange.Offset < 0 {
+		segment.ByteRange.Offset = 0
+		if segment.Uri == p.lastRangeUri {
+			segment.ByteRange.Offset = p.lastRangeEnd
+		}
+	}
+	p.lastRangeUri, p.lastRangeEnd = segment.Uri, segment.ByteRange.Offset+segment.ByteRange.Length
+}
+
 func readExtm3u(r io.Reader) error {
 	p := make([]byte, len(extm3u))
 	_, err := r.Read(p)
@@ -151,9 +314,6 @@ func Parse(r io.ReadCloser) *Playlist {
 	}
 	go func() {
 		defer r.Close()
-		defer func() {
-			p.readFinished = true
-		}()
 		reader := bufio.NewReader(r)
 		loop := true
 		var segment *Segment
@@ -175,28 +335,30 @@ func Parse(r io.ReadCloser) *Playlist {
 			if parseExtinf(line, &segment) {
 				continue
 			}
+			if parseExtXByteRange(line, segment) {
+				continue
+			}
 			if parseUri(line, segment) {
+				segment.Map = p.Map
+				segment.Key = p.Key
+				p.resolveByteRange(segment)
+				segment.Sequence = p.MediaSequence + p.SegmentsCount
 				p.segmentsCacheMu.Lock()
 				p.segmentsCache = append(p.segmentsCache, segment)
+				p.SegmentsDuration = p.SegmentsDuration + segment.Duration
+				p.SegmentsCount++
 				if p.newSegmentNotification != nil {
 					p.newSegmentNotification <- segment
 					p.newSegmentNotification = nil
 				}
 				p.segmentsCacheMu.Unlock()
-				p.SegmentsDuration = p.SegmentsDuration + segment.Duration
-				p.SegmentsCount++
 				segment = nil
 				continue
 			}
-			if p.parseExtXMapUri(line) {
-				s := Segment{IsMap: true, Uri: p.MapUri}
-				p.segmentsCacheMu.Lock()
-				p.segmentsCache = append(p.segmentsCache, &s)
-				if p.newSegmentNotification != nil {
-					p.newSegmentNotification <- &s
-					p.newSegmentNotification = nil
-				}
-				p.segmentsCacheMu.Unlock()
+			if p.parseExtXMap(line) {
+				continue
+			}
+			if p.parseExtXKey(line) {
 				continue
 			}
 			if parseInt(line, RegexpVersion, &p.Version) {
@@ -213,8 +375,11 @@ func Parse(r io.ReadCloser) *Playlist {
 				continue
 			}
 		}
+		p.segmentsCacheMu.Lock()
+		defer p.segmentsCacheMu.Unlock()
+		p.readFinished = true
 		if p.SegmentsCount == 0 {
-			ErrorLog.Printf("%v: %s\n", p, ErrNoSegments.Error())
+			ErrorLog.Printf("%v: %s\n", &p, ErrNoSegments.Error())
 			p.Error = ErrNoSegments
 		}
 		if p.newSegmentNotification != nil {
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/downloader"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// probeCommand prints the description of the playlist as a table or JSON. It returns the exit code.
+func probeCommand(args []string) int {
+	config := loadConfig(args)
+	if config == nil {
+		return 2
+	}
+	flags := flag.NewFlagSet(`probe`, flag.ExitOnError)
+	configFlag(flags, config)
+	asJson := flags.Bool("json", false, "print JSON")
+	propagateQuery := flags.Bool("propagate-query", config.Http.PropagateQuery, "add playlist URL query parameters (e.g. signed tokens) to segment URLs")
+	baseUrl := flags.String("base-url", "", "resolve URIs against this URL or directory instead of the playlist location")
+	samples := flags.Int("samples", downloader.ProbeSampleSegments, "segments to HEAD to estimate the size (0 - none)")
+	headerOptions := newHeaderFlags(flags, config)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s probe [options] <m3u url>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	requestHeaders, err := headerOptions.requestHeaders(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	d := config.NewDownloader()
+	d.ProbeSamples = *samples
+	d.PropagateQuery = *propagateQuery
+	d.BaseUrl = *baseUrl
+	result, err := d.Probe(flags.Arg(0), requestHeaders)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if *asJson {
+		data, err := json.MarshalIndent(result, ``, `  `)
+		if err != nil {
+			ErrorLog.Println(err.Error())
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+	printProbe(result)
+	return 0
+}
+
+func formatSize(size int64) string {
+	if size <= 0 {
+		return `?`
+	}
+	return fmt.Sprintf("%.1f Mb", float64(size)/1024/1024)
+}
+
+func formatDuration(seconds float32) string {
+	return time.Duration(float64(seconds) * float64(time.Second)).Round(time.Second).String()
+}
+
+func printProbe(result *downloader.ProbeResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "URL\t%s\n", result.Url)
+	if !result.Master {
+		media := result.Media
+		fmt.Fprintf(w, "Type\tmedia\n")
+		fmt.Fprintf(w, "Live\t%t\n", media.Live)
+		if media.PlaylistType != `` {
+			fmt.Fprintf(w, "Playlist type\t%s\n", media.PlaylistType)
+		}
+		fmt.Fprintf(w, "Segments\t%d\n", media.Segments)
+		fmt.Fprintf(w, "Duration\t%s\n", formatDuration(media.Duration))
+		fmt.Fprintf(w, "Target duration\t%ds\n", media.TargetDuration)
+		fmt.Fprintf(w, "Encryption\t%s\n", media.Encryption)
+		fmt.Fprintf(w, "Container\t%s\n", media.Container)
+		fmt.Fprintf(w, "Estimated size\t%s (%d segments sampled)\n", formatSize(media.EstimatedSize), media.Sampled)
+		if media.Error != `` {
+			fmt.Fprintf(w, "Error\t%s\n", media.Error)
+		}
+		return
+	}
+	fmt.Fprintf(w, "Type\tmaster (%d variants, %d renditions)\n\n", len(result.Variants), len(result.Renditions))
+	fmt.Fprintln(w, "BANDWIDTH\tRESOLUTION\tCODECS\tAUDIO\tLIVE\tSEGMENTS\tDURATION\tTARGET\tENCRYPTION\tCONTAINER\tEST. SIZE\tURL")
+	for _, variant := range result.Variants {
+		media := variant.Media
+		if media.Error != `` {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t\t\t\t\t\t\t\t%s (%s)\n", variant.Bandwidth, variant.Resolution,
+				variant.Codecs, variant.Audio, variant.Url, media.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\t%d\t%s\t%ds\t%s\t%s\t%s\t%s\n", variant.Bandwidth, variant.Resolution,
+			variant.Codecs, variant.Audio, media.Live, media.Segments, formatDuration(media.Duration),
+			media.TargetDuration, media.Encryption, media.Container, formatSize(media.EstimatedSize), variant.Url)
+	}
+	if len(result.Renditions) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "TYPE\tGROUP\tNAME\tLANGUAGE\tDEFAULT\tURL")
+	for _, rendition := range result.Renditions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n", rendition.Type, rendition.GroupId, rendition.Name,
+			rendition.Language, rendition.Default, rendition.Url)
+	}
+}
@@ -0,0 +1,103 @@
+package remux
+
+import (
+	"errors"
+)
+
+const AacSamplesPerFrame = 1024
+
+var (
+	ErrBadAdts = errors.New(`bad ADTS header`)
+
+	AacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+)
+
+type AdtsHeader struct {
+	ObjectType    byte
+	SampleRateIdx byte
+	Channels      byte
+	HeaderLength  int
+	FrameLength   int
+}
+
+func (header *AdtsHeader) SampleRate() uint32 {
+	if int(header.SampleRateIdx) >= len(AacSampleRates) {
+		return 0
+	}
+	return AacSampleRates[header.SampleRateIdx]
+}
+
+// AudioSpecificConfig for the esds box.
+func (header *AdtsHeader) AudioSpecificConfig() []byte {
+	return []byte{header.ObjectType<<3 | header.SampleRateIdx>>1, header.SampleRateIdx<<7 | header.Channels<<3}
+}
+
+func ParseAdtsHeader(data []byte) (*AdtsHeader, error) {
+	if len(data) < 7 || data[0] != 0xFF || data[1]&0xF0 != 0xF0 {
+		return nil, ErrBadAdts
+	}
+	header := AdtsHeader{
+		ObjectType:    data[2]>>6 + 1,
+		SampleRateIdx: data[2] >> 2 & 0x0F,
+		Channels:      data[2]&1<<2 | data[3]>>6,
+		HeaderLength:  7,
+		FrameLength:   int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5])>>5,
+	}
+	if data[1]&1 == 0 {
+		header.HeaderLength = 9
+	}
+	if header.FrameLength < header.HeaderLength || header.SampleRate() == 0 {
+		return nil, ErrBadAdts
+	}
+	return &header, nil
+}
+
+// SplitAdts splits ADTS stream into frames (with headers). A trailing incomplete frame is returned as rest.
+func SplitAdts(data []byte) ([][]byte, []byte, error) {
+	frames := make([][]byte, 0)
+	for len(data) > 0 {
+		header, err := ParseAdtsHeader(data)
+		if err != nil {
+			if len(data) < 7 {
+				return frames, data, nil
+			}
+			return frames, nil, err
+		}
+		if header.FrameLength > len(data) {
+			return frames, data, nil
+		}
+		frames = append(frames, data[:header.FrameLength])
+		data = data[header.FrameLength:]
+	}
+	return frames, nil, nil
+}
+
+// aacParser makes a sample of every ADTS frame, timestamps of the frames inside PES are derived from the PES PTS.
+type aacParser struct {
+	sampleRate uint32
+}
+
+func (parser *aacParser) parse(track *Track, pes *PES) ([]*Sample, error) {
+	frames, _, err := SplitAdts(pes.Data)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+	}
+	samples := make([]*Sample, 0, len(frames))
+	for i, frame := range frames {
+		header, _ := ParseAdtsHeader(frame)
+		if track.SampleEntry == nil {
+			parser.sampleRate = header.SampleRate()
+			track.Codec = `mp4a`
+			track.Timescale = parser.sampleRate
+			track.SampleEntry = audioSampleEntry(header.Channels, parser.sampleRate, esds(header.AudioSpecificConfig()))
+		}
+		offset := int64(i) * AacSamplesPerFrame * 90000 / int64(parser.sampleRate)
+		samples = append(samples, &Sample{
+			Data: frame[header.HeaderLength:],
+			Pts:  pes.Pts + offset,
+			Dts:  pes.Pts + offset,
+			Sync: true,
+		})
+	}
+	return samples, nil
+}
@@ -0,0 +1,61 @@
+package remux
+
+import (
+	"bytes"
+	"testing"
+)
+
+// adtsFrame makes an ADTS frame without CRC of the AAC object type, sample rate index and channels.
+func adtsFrame(objectType, sampleRateIdx, channels byte, payload []byte) []byte {
+	length := 7 + len(payload)
+	header := []byte{0xFF, 0xF1, (objectType-1)<<6 | sampleRateIdx<<2 | channels>>2, channels<<6 | byte(length>>11),
+		byte(length >> 3), byte(length)<<5 | 0x1F, 0xFC}
+	return append(header, payload...)
+}
+
+func TestParseAdtsHeader(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		header AdtsHeader
+		rate   uint32
+		asc    []byte
+		ok     bool
+	}{
+		{adtsFrame(2, 4, 2, make([]byte, 100)), AdtsHeader{2, 4, 2, 7, 107}, 44100, []byte{0x12, 0x10}, true},
+		{adtsFrame(2, 3, 1, make([]byte, 10)), AdtsHeader{2, 3, 1, 7, 17}, 48000, []byte{0x11, 0x88}, true},
+		{adtsFrame(4, 6, 6, nil), AdtsHeader{4, 6, 6, 7, 7}, 24000, []byte{0x23, 0x30}, true},
+		// CRC present
+		{append([]byte{0xFF, 0xF0}, adtsFrame(2, 4, 2, make([]byte, 2))[2:]...), AdtsHeader{2, 4, 2, 9, 9}, 44100,
+			[]byte{0x12, 0x10}, true},
+		{adtsFrame(2, 13, 2, nil), AdtsHeader{}, 0, nil, false},
+		{append([]byte{0xFF, 0xE1}, adtsFrame(2, 4, 2, nil)[2:]...), AdtsHeader{}, 0, nil, false},
+		{adtsFrame(2, 4, 2, nil)[:6], AdtsHeader{}, 0, nil, false},
+	}
+	for i, test := range tests {
+		header, err := ParseAdtsHeader(test.data)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: ParseAdtsHeader() error = %v", i, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if *header != test.header || header.SampleRate() != test.rate ||
+			!bytes.Equal(header.AudioSpecificConfig(), test.asc) {
+			t.Errorf("%d: ParseAdtsHeader() = %+v, rate %d, ASC %x", i, *header, header.SampleRate(),
+				header.AudioSpecificConfig())
+		}
+	}
+}
+
+func TestSplitAdts(t *testing.T) {
+	first, second := adtsFrame(2, 3, 2, make([]byte, 20)), adtsFrame(2, 3, 2, make([]byte, 30))
+	frames, rest, err := SplitAdts(append(append(append([]byte{}, first...), second...), second[:10]...))
+	if err != nil || len(frames) != 2 || !bytes.Equal(frames[0], first) || !bytes.Equal(frames[1], second) ||
+		!bytes.Equal(rest, second[:10]) {
+		t.Errorf("SplitAdts() = %d frames, rest %d bytes, %v", len(frames), len(rest), err)
+	}
+	if _, _, err := SplitAdts(append(append([]byte{}, first...), make([]byte, 10)...)); err != ErrBadAdts {
+		t.Errorf("SplitAdts() of garbage = %v, want %v", err, ErrBadAdts)
+	}
+}
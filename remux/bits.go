@@ -0,0 +1,103 @@
+package remux
+
+import (
+	"errors"
+)
+
+var ErrBitstreamEnd = errors.New(`unexpected end of bitstream`)
+
+// bitReader reads RBSP (NAL unit payload with emulation prevention bytes removed) as used in H.264/H.265 headers.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.data)*8 {
+		r.err = ErrBitstreamEnd
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint32(b)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos = r.pos + n
+}
+
+// ue reads unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = ErrBitstreamEnd
+			return 0
+		}
+		zeros++
+	}
+	return (1<<zeros - 1) + r.bits(zeros)
+}
+
+// se reads signed Exp-Golomb code.
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+// unescapeRbsp removes emulation prevention bytes (0x03 in 0x000003).
+func unescapeRbsp(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// splitAnnexB splits an Annex B byte stream into NAL units without start codes.
+func splitAnnexB(data []byte) [][]byte {
+	nalus := make([][]byte, 0)
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, data[start:end])
+			}
+		}
+		i = i + 2
+		start = i + 1
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
@@ -0,0 +1,428 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	tfhdBaseDataOffset    = 0x000001
+	tfhdSampleDescription = 0x000002
+	tfhdDefaultDuration   = 0x000008
+	tfhdDefaultSize       = 0x000010
+	tfhdDefaultFlags      = 0x000020
+	tfhdDefaultBaseIsMoof = 0x020000
+	trunDataOffset        = 0x000001
+	trunFirstSampleFlags  = 0x000004
+	trunSampleDuration    = 0x000100
+	trunSampleSize        = 0x000200
+	trunSampleFlags       = 0x000400
+	trunSampleCto         = 0x000800
+	sampleFlagsIsNonSync  = 0x00010000
+)
+
+var (
+	ErrNotFmp4     = errors.New(`not fragmented MP4 data`)
+	ErrBadBox      = errors.New(`malformed MP4 box`)
+	ErrInitChanged = errors.New(`codec configuration of the track changed`)
+	topLevelBoxes  = map[string]bool{`ftyp`: true, `styp`: true, `sidx`: true, `moov`: true, `moof`: true,
+		`mdat`: true, `free`: true, `skip`: true, `emsg`: true, `prft`: true, `uuid`: true, `meta`: true}
+)
+
+// IsFmp4 reports whether the data starts with a top-level box of fragmented MP4.
+func IsFmp4(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	return topLevelBoxes[string(data[4:8])]
+}
+
+type mp4Box struct {
+	Type    string
+	Size    int
+	Payload []byte
+}
+
+// readBox reads the box header at the start of data. size is 0 if the box lasts to the end of the stream.
+func readBox(data []byte) (boxType string, size int64, header int, err error) {
+	if len(data) < 8 {
+		return ``, 0, 0, ErrBadBox
+	}
+	size = int64(binary.BigEndian.Uint32(data))
+	boxType = string(data[4:8])
+	header = 8
+	if size == 1 {
+		if len(data) < 16 {
+			return ``, 0, 0, ErrBadBox
+		}
+		size = int64(binary.BigEndian.Uint64(data[8:]))
+		header = 16
+	}
+	if size != 0 && size < int64(header) {
+		return ``, 0, 0, errors.Join(ErrBadBox, errors.New(fmt.Sprintf("'%s' of size %d", boxType, size)))
+	}
+	return boxType, size, header, nil
+}
+
+// children parses the boxes the payload consists of.
+func children(payload []byte) ([]mp4Box, error) {
+	boxes := make([]mp4Box, 0)
+	for offset := 0; offset < len(payload); {
+		boxType, size, header, err := readBox(payload[offset:])
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = int64(len(payload) - offset)
+		}
+		if int64(len(payload)-offset) < size {
+			return nil, errors.Join(ErrBadBox, errors.New(fmt.Sprintf("'%s' is truncated", boxType)))
+		}
+		boxes = append(boxes, mp4Box{Type: boxType, Size: int(size),
+			Payload: payload[offset+header : offset+int(size)]})
+		offset = offset + int(size)
+	}
+	return boxes, nil
+}
+
+func child(payload []byte, path ...string) []byte {
+	for _, boxType := range path {
+		boxes, err := children(payload)
+		if err != nil {
+			return nil
+		}
+		found := false
+		for _, b := range boxes {
+			if b.Type == boxType {
+				payload, found = b.Payload, true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return payload
+}
+
+// Fmp4Track is a track of the init segment.
+type Fmp4Track struct {
+	Id          uint32
+	Handler     string
+	Codec       string
+	Timescale   uint32
+	Width       uint32
+	Height      uint32
+	SampleEntry []byte
+
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+	nextDts         int64
+}
+
+func parseTrak(trak []byte) (*Fmp4Track, error) {
+	tkhd := child(trak, `tkhd`)
+	mdhd := child(trak, `mdia`, `mdhd`)
+	hdlr := child(trak, `mdia`, `hdlr`)
+	stsd := child(trak, `mdia`, `minf`, `stbl`, `stsd`)
+	if len(tkhd) < 84 || len(mdhd) < 24 || len(hdlr) < 12 || len(stsd) < 16 {
+		return nil, errors.Join(ErrBadBox, errors.New(`incomplete trak`))
+	}
+	track := Fmp4Track{Handler: string(hdlr[8:12])}
+	if tkhd[0] == 1 {
+		track.Id = binary.BigEndian.Uint32(tkhd[20:])
+	} else {
+		track.Id = binary.BigEndian.Uint32(tkhd[12:])
+	}
+	track.Width = binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16
+	track.Height = binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16
+	if mdhd[0] == 1 {
+		track.Timescale = binary.BigEndian.Uint32(mdhd[20:])
+	} else {
+		track.Timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	entries, err := children(stsd[8:])
+	if err != nil || len(entries) == 0 {
+		return nil, errors.Join(ErrBadBox, errors.New(`no sample entry`))
+	}
+	track.Codec = entries[0].Type
+	track.SampleEntry = append([]byte{}, stsd[8:8+entries[0].Size]...)
+	return &track, nil
+}
+
+// Fmp4Demuxer parses fragmented MP4 written to it: OnInit is called for every init segment (moov) and OnSample for
+// every sample of the moof/mdat fragments. Timestamps of the samples are in the track timescale.
+type Fmp4Demuxer struct {
+	OnInit   func(tracks []*Fmp4Track) error
+	OnSample func(track *Fmp4Track, sample *Sample) error
+
+	buf     []byte
+	pos     int64 // stream position of buf[0]
+	tracks  map[uint32]*Fmp4Track
+	moof    []byte
+	moofPos int64
+	started bool
+}
+
+func (demuxer *Fmp4Demuxer) Write(p []byte) (int, error) {
+	demuxer.buf = append(demuxer.buf, p...)
+	offset := 0
+	for len(demuxer.buf)-offset >= 8 {
+		boxType, size, header, err := readBox(demuxer.buf[offset:])
+		if err != nil {
+			return 0, err
+		}
+		if !demuxer.started && !topLevelBoxes[boxType] {
+			return 0, errors.Join(ErrNotFmp4, errors.New(fmt.Sprintf("'%s' box", boxType)))
+		}
+		demuxer.started = true
+		if size == 0 || int64(len(demuxer.buf)-offset) < size {
+			break // the box isn't complete yet (a box till the end of stream is completed by Flush)
+		}
+		end := offset + int(size)
+		if err := demuxer.box(boxType, demuxer.pos+int64(offset), demuxer.buf[offset:end], header); err != nil {
+			return 0, err
+		}
+		offset = end
+	}
+	demuxer.pos = demuxer.pos + int64(offset)
+	demuxer.buf = append(demuxer.buf[:0], demuxer.buf[offset:]...)
+	return len(p), nil
+}
+
+// Flush handles the remaining data as a box lasting to the end of the stream.
+func (demuxer *Fmp4Demuxer) Flush() error {
+	if len(demuxer.buf) < 8 {
+		return nil
+	}
+	boxType, size, header, err := readBox(demuxer.buf)
+	if err != nil {
+		return err
+	}
+	if size != 0 && size != int64(len(demuxer.buf)) {
+		return errors.Join(ErrBadBox, errors.New(fmt.Sprintf("'%s' is truncated", boxType)))
+	}
+	err = demuxer.box(boxType, demuxer.pos, demuxer.buf, header)
+	demuxer.buf = nil
+	return err
+}
+
+func (demuxer *Fmp4Demuxer) box(boxType string, pos int64, data []byte, header int) error {
+	switch boxType {
+	case `moov`:
+		return demuxer.init(data[header:])
+	case `moof`:
+		demuxer.moof = append(demuxer.moof[:0], data[header:]...)
+		demuxer.moofPos = pos
+	case `mdat`:
+		if demuxer.moof == nil {
+			return nil
+		}
+		err := demuxer.fragment(data, pos)
+		demuxer.moof = nil
+		return err
+	}
+	return nil
+}
+
+func (demuxer *Fmp4Demuxer) init(moov []byte) error {
+	boxes, err := children(moov)
+	if err != nil {
+		return err
+	}
+	tracks := make([]*Fmp4Track, 0)
+	for _, b := range boxes {
+		if b.Type != `trak` {
+			continue
+		}
+		track, err := parseTrak(b.Payload)
+		if err != nil {
+			ErrorLog.Println(err.Error())
+			return err
+		}
+		if previous, ok := demuxer.tracks[track.Id]; ok {
+			track.nextDts = previous.nextDts
+		}
+		tracks = append(tracks, track)
+	}
+	if mvex := child(moov, `mvex`); mvex != nil {
+		boxes, err := children(mvex)
+		if err != nil {
+			return err
+		}
+		for _, b := range boxes {
+			if b.Type != `trex` || len(b.Payload) < 24 {
+				continue
+			}
+			for _, track := range tracks {
+				if track.Id == binary.BigEndian.Uint32(b.Payload[4:]) {
+					track.defaultDuration = binary.BigEndian.Uint32(b.Payload[12:])
+					track.defaultSize = binary.BigEndian.Uint32(b.Payload[16:])
+					track.defaultFlags = binary.BigEndian.Uint32(b.Payload[20:])
+				}
+			}
+		}
+	}
+	demuxer.tracks = make(map[uint32]*Fmp4Track)
+	for _, track := range tracks {
+		demuxer.tracks[track.Id] = track
+	}
+	if demuxer.OnInit != nil {
+		return demuxer.OnInit(tracks)
+	}
+	return nil
+}
+
+// fragment reads the samples of the pending moof from the mdat box at the stream position mdatPos.
+func (demuxer *Fmp4Demuxer) fragment(mdat []byte, mdatPos int64) error {
+	trafs, err := children(demuxer.moof)
+	if err != nil {
+		return err
+	}
+	dataEnd, first := demuxer.moofPos, true
+	for _, traf := range trafs {
+		if traf.Type != `traf` {
+			continue
+		}
+		tfhd := child(traf.Payload, `tfhd`)
+		if len(tfhd) < 8 {
+			return errors.Join(ErrBadBox, errors.New(`no tfhd`))
+		}
+		flags := binary.BigEndian.Uint32(tfhd) & 0xFFFFFF
+		track, ok := demuxer.tracks[binary.BigEndian.Uint32(tfhd[4:])]
+		if !ok {
+			continue
+		}
+		duration, size, sampleFlags := track.defaultDuration, track.defaultSize, track.defaultFlags
+		r := tfhd[8:]
+		base := demuxer.moofPos
+		if !first && flags&tfhdDefaultBaseIsMoof == 0 {
+			base = dataEnd
+		}
+		first = false
+		for _, field := range []struct {
+			flag uint32
+			size int
+			dst  *uint32
+		}{{tfhdBaseDataOffset, 8, nil}, {tfhdSampleDescription, 4, nil}, {tfhdDefaultDuration, 4, &duration},
+			{tfhdDefaultSize, 4, &size}, {tfhdDefaultFlags, 4, &sampleFlags}} {
+			if flags&field.flag == 0 {
+				continue
+			}
+			if len(r) < field.size {
+				return errors.Join(ErrBadBox, errors.New(`short tfhd`))
+			}
+			switch {
+			case field.flag == tfhdBaseDataOffset:
+				base = int64(binary.BigEndian.Uint64(r))
+			case field.dst != nil:
+				*field.dst = binary.BigEndian.Uint32(r)
+			}
+			r = r[field.size:]
+		}
+		if tfdt := child(traf.Payload, `tfdt`); len(tfdt) >= 8 {
+			if tfdt[0] == 1 && len(tfdt) >= 12 {
+				track.nextDts = int64(binary.BigEndian.Uint64(tfdt[4:]))
+			} else {
+				track.nextDts = int64(binary.BigEndian.Uint32(tfdt[4:]))
+			}
+		}
+		boxes, err := children(traf.Payload)
+		if err != nil {
+			return err
+		}
+		pos := base
+		for _, b := range boxes {
+			if b.Type != `trun` {
+				continue
+			}
+			if pos, err = demuxer.trun(track, b.Payload, base, pos, duration, size, sampleFlags, mdat, mdatPos); err != nil {
+				return err
+			}
+		}
+		dataEnd = pos
+	}
+	return nil
+}
+
+func (demuxer *Fmp4Demuxer) trun(track *Fmp4Track, trun []byte, base, pos int64, duration, size, sampleFlags uint32,
+	mdat []byte, mdatPos int64) (int64, error) {
+	if len(trun) < 8 {
+		return 0, errors.Join(ErrBadBox, errors.New(`short trun`))
+	}
+	version := trun[0]
+	flags := binary.BigEndian.Uint32(trun) & 0xFFFFFF
+	count := binary.BigEndian.Uint32(trun[4:])
+	r := trun[8:]
+	if flags&trunDataOffset != 0 {
+		if len(r) < 4 {
+			return 0, errors.Join(ErrBadBox, errors.New(`short trun`))
+		}
+		pos = base + int64(int32(binary.BigEndian.Uint32(r)))
+		r = r[4:]
+	}
+	firstFlags, hasFirstFlags := uint32(0), false
+	if flags&trunFirstSampleFlags != 0 {
+		if len(r) < 4 {
+			return 0, errors.Join(ErrBadBox, errors.New(`short trun`))
+		}
+		firstFlags, hasFirstFlags = binary.BigEndian.Uint32(r), true
+		r = r[4:]
+	}
+	for i := uint32(0); i < count; i++ {
+		sample := Sample{Duration: duration, Size: size, Dts: track.nextDts}
+		currentFlags := sampleFlags
+		cto := int64(0)
+		for _, field := range []uint32{trunSampleDuration, trunSampleSize, trunSampleFlags, trunSampleCto} {
+			if flags&field == 0 {
+				continue
+			}
+			if len(r) < 4 {
+				return 0, errors.Join(ErrBadBox, errors.New(`short trun`))
+			}
+			v := binary.BigEndian.Uint32(r)
+			r = r[4:]
+			switch field {
+			case trunSampleDuration:
+				sample.Duration = v
+			case trunSampleSize:
+				sample.Size = v
+			case trunSampleFlags:
+				currentFlags = v
+			case trunSampleCto:
+				if version == 0 {
+					cto = int64(v)
+				} else {
+					cto = int64(int32(v))
+				}
+			}
+		}
+		if i == 0 && hasFirstFlags {
+			currentFlags = firstFlags
+		}
+		sample.Sync = currentFlags&sampleFlagsIsNonSync == 0
+		sample.Pts = sample.Dts + cto
+		start := pos - mdatPos
+		if start < 0 || start+int64(sample.Size) > int64(len(mdat)) {
+			return 0, errors.Join(ErrBadBox, errors.New(fmt.Sprintf("sample of track %d is out of mdat", track.Id)))
+		}
+		sample.Data = bytes.Clone(mdat[start : start+int64(sample.Size)])
+		pos = pos + int64(sample.Size)
+		track.nextDts = track.nextDts + int64(sample.Duration)
+		if demuxer.OnSample != nil {
+			if err := demuxer.OnSample(track, &sample); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return pos, nil
+}
+
+func NewFmp4Demuxer() *Fmp4Demuxer {
+	return &Fmp4Demuxer{
+		tracks: make(map[uint32]*Fmp4Track),
+	}
+}
@@ -0,0 +1,154 @@
+package remux
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testVideoTrack(sps []byte) *Track {
+	return &Track{Id: 1, Handler: `vide`, Codec: `avc1`, Timescale: VideoTimescale, Width: 320, Height: 240,
+		SampleEntry: visualSampleEntry(`avc1`, 320, 240, box(`avcC`, (&H264Sps{Profile: 66, Level: 30}).avcC(sps,
+			testPps)))}
+}
+
+// fmp4Init makes an init section (ftyp and moov) of the track.
+func fmp4Init(track *Track) []byte {
+	moov := box(`moov`, mvhd(0, 2), track.initTrak(), box(`mvex`, track.trex()))
+	return append(ftyp(`iso6`, `iso6`), moov...)
+}
+
+// fmp4Fragment makes a moof/mdat pair of the samples of the track.
+func fmp4Fragment(track *Track, sequence uint32, baseDts uint64, samples []*Sample) []byte {
+	mdat := make([][]byte, 0, len(samples))
+	for _, sample := range samples {
+		sample.Size = uint32(len(sample.Data))
+		mdat = append(mdat, sample.Data)
+	}
+	track.samples = samples
+	moof := func(offset uint32) []byte {
+		return box(`moof`, fullBox(`mfhd`, 0, 0, u32(sequence)), track.traf(baseDts, offset))
+	}
+	data := moof(uint32(len(moof(0)) + 8))
+	track.samples = nil
+	return append(data, box(`mdat`, mdat...)...)
+}
+
+func testSamples(first byte, count int) []*Sample {
+	samples := make([]*Sample, count)
+	for i := range samples {
+		samples[i] = &Sample{Duration: 3000, Sync: i == 0, Data: bytes.Repeat([]byte{first + byte(i)}, 10+i)}
+	}
+	return samples
+}
+
+func TestFmp4Demuxer(t *testing.T) {
+	track := testVideoTrack(testSps)
+	// the init and the first fragment in one segment, then a segment of a fragment only
+	segments := [][]byte{append(fmp4Init(track), fmp4Fragment(track, 1, 0, testSamples(0x10, 3))...),
+		fmp4Fragment(track, 2, 9000, testSamples(0x20, 2))}
+	inits, samples := make([][]*Fmp4Track, 0), make([]*Sample, 0)
+	demuxer := NewFmp4Demuxer()
+	demuxer.OnInit = func(tracks []*Fmp4Track) error {
+		inits = append(inits, tracks)
+		return nil
+	}
+	demuxer.OnSample = func(track *Fmp4Track, sample *Sample) error {
+		if track.Id != 1 {
+			t.Errorf("sample of track %d", track.Id)
+		}
+		samples = append(samples, sample)
+		return nil
+	}
+	for _, segment := range segments {
+		// in two writes to split the boxes
+		for _, part := range [][]byte{segment[:len(segment)/2], segment[len(segment)/2:]} {
+			if _, err := demuxer.Write(part); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := demuxer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(inits) != 1 || len(inits[0]) != 1 {
+		t.Fatalf("%d init sections", len(inits))
+	}
+	if init := inits[0][0]; init.Handler != `vide` || init.Codec != `avc1` || init.Timescale != VideoTimescale ||
+		init.Width != 320 || init.Height != 240 || !bytes.Equal(init.SampleEntry, track.SampleEntry) {
+		t.Errorf("init track = %+v", *init)
+	}
+	want := append(testSamples(0x10, 3), testSamples(0x20, 2)...)
+	if len(samples) != len(want) {
+		t.Fatalf("%d samples, want %d", len(samples), len(want))
+	}
+	for i, sample := range samples {
+		dts := int64(i) * 3000
+		if sample.Dts != dts || sample.Pts != dts || sample.Duration != 3000 || sample.Sync != want[i].Sync ||
+			!bytes.Equal(sample.Data, want[i].Data) {
+			t.Errorf("sample %d = dts %d, pts %d, duration %d, sync %t, data %x", i, sample.Dts, sample.Pts,
+				sample.Duration, sample.Sync, sample.Data)
+		}
+	}
+}
+
+func TestFmp4DemuxerMediaOnly(t *testing.T) {
+	track := testVideoTrack(testSps)
+	_, err := NewFmp4Demuxer().Write(fmp4Fragment(track, 1, 0, testSamples(0, 1)))
+	if err != nil {
+		t.Errorf("Write() of a fragment without init = %v", err)
+	}
+	if _, err := NewFmp4Demuxer().Write(box(`abcd`, []byte{1, 2, 3})); !errors.Is(err, ErrNotFmp4) {
+		t.Errorf("Write() of an unknown box = %v, want %v", err, ErrNotFmp4)
+	}
+}
+
+// TestRemuxerInitChanged remuxes fragmented MP4 with the init section repeated (e.g. by every segment), and then
+// changed by an EXT-X-MAP switch.
+func TestRemuxerInitChanged(t *testing.T) {
+	track := testVideoTrack(testSps)
+	segments := [][]byte{fmp4Init(track), fmp4Fragment(track, 1, 0, testSamples(0x10, 3)), fmp4Init(track),
+		fmp4Fragment(track, 2, 9000, testSamples(0x20, 3))}
+	file := memoryFile{}
+	remuxer, err := NewRemuxer(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, segment := range segments {
+		if _, err := remuxer.Write(segment); err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+	}
+	if err := remuxer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	boxes, err := children(file.data)
+	if err != nil || len(boxes) != 3 {
+		t.Fatalf("top level boxes: %v, %v", boxes, err)
+	}
+	tracks := readStbl(t, boxes[2].Payload)
+	if len(tracks) != 1 || len(tracks[0].sizes) != 6 {
+		t.Fatalf("tracks: %+v", tracks)
+	}
+	for i, sample := range append(testSamples(0x10, 3), testSamples(0x20, 3)...) {
+		offset := tracks[0].offsets[i]
+		if data := file.data[offset : offset+uint64(tracks[0].sizes[i])]; !bytes.Equal(data, sample.Data) ||
+			tracks[0].durations[i] != 3000 {
+			t.Errorf("sample %d = %x, duration %d", i, data, tracks[0].durations[i])
+		}
+	}
+
+	remuxer, err = NewRemuxer(&memoryFile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, segment := range segments {
+		if _, err := remuxer.Write(segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changed := testVideoTrack(append(bytes.Clone(testSps), 0))
+	if _, err := remuxer.Write(fmp4Init(changed)); !errors.Is(err, ErrInitChanged) {
+		t.Errorf("Write() of the changed init = %v, want %v", err, ErrInitChanged)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/vvampirius/hls-downloader/remux
+
+go 1.22.4
@@ -0,0 +1,182 @@
+package remux
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	h264NalIdr = 5
+	h264NalSps = 7
+	h264NalPps = 8
+	h264NalAud = 9
+)
+
+var ErrBadSps = errors.New(`can't parse SPS`)
+
+type H264Sps struct {
+	Profile         byte
+	Compatibility   byte
+	Level           byte
+	ChromaFormat    uint32
+	BitDepthLuma    uint32
+	BitDepthChroma  uint32
+	Width           uint32
+	Height          uint32
+	highProfileInfo bool
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+func ParseH264Sps(nalu []byte) (*H264Sps, error) {
+	if len(nalu) < 4 {
+		return nil, ErrBadSps
+	}
+	sps := H264Sps{
+		Profile:        nalu[1],
+		Compatibility:  nalu[2],
+		Level:          nalu[3],
+		ChromaFormat:   1,
+		BitDepthLuma:   8,
+		BitDepthChroma: 8,
+	}
+	r := bitReader{data: unescapeRbsp(nalu[4:])}
+	r.ue() // seq_parameter_set_id
+	switch sps.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.highProfileInfo = true
+		sps.ChromaFormat = r.ue()
+		if sps.ChromaFormat == 3 {
+			r.skip(1) // separate_colour_plane_flag
+		}
+		sps.BitDepthLuma = r.ue() + 8
+		sps.BitDepthChroma = r.ue() + 8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			lists := 8
+			if sps.ChromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 1 {
+					if i < 6 {
+						skipScalingList(&r, 16)
+					} else {
+						skipScalingList(&r, 64)
+					}
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.bit() == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return nil, errors.Join(ErrBadSps, r.err)
+	}
+	cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+	switch sps.ChromaFormat {
+	case 1:
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropUnitX = 2
+	}
+	sps.Width = widthInMbs*16 - (cropLeft+cropRight)*cropUnitX
+	sps.Height = (2-frameMbsOnly)*heightInMapUnits*16 - (cropTop+cropBottom)*cropUnitY
+	return &sps, nil
+}
+
+// avcC builds AVCDecoderConfigurationRecord.
+func (sps *H264Sps) avcC(spsNalu, ppsNalu []byte) []byte {
+	b := []byte{1, sps.Profile, sps.Compatibility, sps.Level, 0xFF, 0xE1}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(spsNalu)))
+	b = append(b, spsNalu...)
+	b = append(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ppsNalu)))
+	b = append(b, ppsNalu...)
+	if sps.highProfileInfo {
+		b = append(b, 0xFC|byte(sps.ChromaFormat&3), 0xF8|byte((sps.BitDepthLuma-8)&7),
+			0xF8|byte((sps.BitDepthChroma-8)&7), 0)
+	}
+	return b
+}
+
+// h264Parser turns Annex B access units into AVCC samples and makes the avc1 sample entry from the first SPS/PPS.
+type h264Parser struct {
+	sps, pps []byte
+}
+
+func (parser *h264Parser) parse(track *Track, pes *PES) ([]*Sample, error) {
+	sample := Sample{}
+	data := make([]byte, 0, len(pes.Data)+16)
+	for _, nalu := range splitAnnexB(pes.Data) {
+		switch nalu[0] & 0x1F {
+		case h264NalSps:
+			if parser.sps == nil {
+				parser.sps = append([]byte{}, nalu...)
+			}
+			continue
+		case h264NalPps:
+			if parser.pps == nil {
+				parser.pps = append([]byte{}, nalu...)
+			}
+			continue
+		case h264NalAud:
+			continue
+		case h264NalIdr:
+			sample.Sync = true
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+	if track.SampleEntry == nil && parser.sps != nil && parser.pps != nil {
+		sps, err := ParseH264Sps(parser.sps)
+		if err != nil {
+			ErrorLog.Println(err.Error())
+			return nil, err
+		}
+		track.Width, track.Height = sps.Width, sps.Height
+		track.Codec = `avc1`
+		track.SampleEntry = visualSampleEntry(`avc1`, sps.Width, sps.Height, box(`avcC`, sps.avcC(parser.sps, parser.pps)))
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	sample.Data = data
+	sample.Pts = pes.Pts
+	sample.Dts = pes.Dts
+	return []*Sample{&sample}, nil
+}
@@ -0,0 +1,35 @@
+package remux
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseH264Sps(t *testing.T) {
+	sps, err := ParseH264Sps(testSps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.Profile != 66 || sps.Level != 30 || sps.Width != 320 || sps.Height != 240 || sps.ChromaFormat != 1 {
+		t.Errorf("ParseH264Sps() = %+v", *sps)
+	}
+	if _, err := ParseH264Sps(testSps[:5]); err == nil {
+		t.Error(`ParseH264Sps() of a truncated SPS succeeded`)
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	nalus := splitAnnexB([]byte{0, 0, 0, 1, 9, 0xF0, 0, 0, 1, 0x65, 1, 2, 0, 0, 0, 1, 0x41, 0, 0, 3, 1})
+	want := [][]byte{{9, 0xF0}, {0x65, 1, 2}, {0x41, 0, 0, 3, 1}}
+	if len(nalus) != len(want) {
+		t.Fatalf("splitAnnexB() = %x", nalus)
+	}
+	for i := range want {
+		if !bytes.Equal(nalus[i], want[i]) {
+			t.Errorf("NAL unit %d = %x, want %x", i, nalus[i], want[i])
+		}
+	}
+	if rbsp := unescapeRbsp([]byte{0x41, 0, 0, 3, 1}); !bytes.Equal(rbsp, []byte{0x41, 0, 0, 1}) {
+		t.Errorf("unescapeRbsp() = %x", rbsp)
+	}
+}
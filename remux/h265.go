@@ -0,0 +1,157 @@
+package remux
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	h265NalIrapFirst = 16
+	h265NalIrapLast  = 23
+	h265NalVps       = 32
+	h265NalSps       = 33
+	h265NalPps       = 34
+	h265NalAud       = 35
+)
+
+type H265Sps struct {
+	ProfileTierLevel [12]byte // general_profile_space .. general_level_idc
+	ChromaFormat     uint32
+	BitDepthLuma     uint32
+	BitDepthChroma   uint32
+	Width            uint32
+	Height           uint32
+	TemporalLayers   uint32
+	TemporalIdNested uint32
+}
+
+func ParseH265Sps(nalu []byte) (*H265Sps, error) {
+	if len(nalu) < 3 {
+		return nil, ErrBadSps
+	}
+	rbsp := unescapeRbsp(nalu[2:])
+	r := bitReader{data: rbsp}
+	sps := H265Sps{}
+	r.skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(r.bits(3))
+	sps.TemporalLayers = uint32(maxSubLayersMinus1 + 1)
+	sps.TemporalIdNested = r.bit()
+	if len(rbsp) < 13 {
+		return nil, ErrBadSps
+	}
+	copy(sps.ProfileTierLevel[:], rbsp[1:13])
+	r.skip(96)
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = r.bit() == 1
+		levelPresent[i] = r.bit() == 1
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.skip(2 * (8 - maxSubLayersMinus1))
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+	r.ue() // sps_seq_parameter_set_id
+	sps.ChromaFormat = r.ue()
+	if sps.ChromaFormat == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	sps.Width = r.ue()
+	sps.Height = r.ue()
+	if r.bit() == 1 {
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		subWidth, subHeight := uint32(1), uint32(1)
+		switch sps.ChromaFormat {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		sps.Width = sps.Width - (left+right)*subWidth
+		sps.Height = sps.Height - (top+bottom)*subHeight
+	}
+	sps.BitDepthLuma = r.ue() + 8
+	sps.BitDepthChroma = r.ue() + 8
+	if r.err != nil {
+		return nil, errors.Join(ErrBadSps, r.err)
+	}
+	return &sps, nil
+}
+
+// hvcC builds HEVCDecoderConfigurationRecord.
+func (sps *H265Sps) hvcC(vps, spsNalu, pps []byte) []byte {
+	b := []byte{1}
+	b = append(b, sps.ProfileTierLevel[:]...)
+	b = append(b, 0xF0, 0x00, 0xFC, 0xFC|byte(sps.ChromaFormat&3), 0xF8|byte((sps.BitDepthLuma-8)&7),
+		0xF8|byte((sps.BitDepthChroma-8)&7), 0, 0)
+	b = append(b, byte(sps.TemporalLayers&7)<<3|byte(sps.TemporalIdNested&1)<<2|3)
+	b = append(b, 3)
+	for _, nalu := range [][]byte{vps, spsNalu, pps} {
+		b = append(b, 0x80|nalu[0]>>1&0x3F, 0, 1)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+type h265Parser struct {
+	vps, sps, pps []byte
+}
+
+func (parser *h265Parser) parse(track *Track, pes *PES) ([]*Sample, error) {
+	sample := Sample{}
+	data := make([]byte, 0, len(pes.Data)+16)
+	for _, nalu := range splitAnnexB(pes.Data) {
+		if len(nalu) < 2 {
+			continue
+		}
+		switch nalType := nalu[0] >> 1 & 0x3F; {
+		case nalType == h265NalVps:
+			if parser.vps == nil {
+				parser.vps = append([]byte{}, nalu...)
+			}
+			continue
+		case nalType == h265NalSps:
+			if parser.sps == nil {
+				parser.sps = append([]byte{}, nalu...)
+			}
+			continue
+		case nalType == h265NalPps:
+			if parser.pps == nil {
+				parser.pps = append([]byte{}, nalu...)
+			}
+			continue
+		case nalType == h265NalAud:
+			continue
+		case nalType >= h265NalIrapFirst && nalType <= h265NalIrapLast:
+			sample.Sync = true
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+	if track.SampleEntry == nil && parser.vps != nil && parser.sps != nil && parser.pps != nil {
+		sps, err := ParseH265Sps(parser.sps)
+		if err != nil {
+			ErrorLog.Println(err.Error())
+			return nil, err
+		}
+		track.Width, track.Height = sps.Width, sps.Height
+		track.Codec = `hvc1`
+		track.SampleEntry = visualSampleEntry(`hvc1`, sps.Width, sps.Height,
+			box(`hvcC`, sps.hvcC(parser.vps, parser.sps, parser.pps)))
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	sample.Data = data
+	sample.Pts = pes.Pts
+	sample.Dts = pes.Dts
+	return []*Sample{&sample}, nil
+}
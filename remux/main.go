@@ -0,0 +1,11 @@
+package remux
+
+import (
+	"log"
+	"os"
+)
+
+var (
+	ErrorLog = log.New(os.Stderr, `error#`, log.Lshortfile)
+	DebugLog = log.New(os.Stdout, `debug#`, log.Lshortfile)
+)
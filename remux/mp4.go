@@ -0,0 +1,351 @@
+package remux
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const (
+	MovieTimescale = 1000
+	VideoTimescale = 90000
+)
+
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// Sample is an access unit (video) or a frame (audio). Timestamps are in the track timescale.
+type Sample struct {
+	Pts      int64
+	Dts      int64
+	Duration uint32
+	Sync     bool
+	Data     []byte
+	Size     uint32
+	Offset   uint64
+}
+
+// Track keeps codec configuration and sample tables of a track being written.
+type Track struct {
+	Id          uint32
+	Handler     string // vide or soun
+	Codec       string
+	Timescale   uint32
+	Width       uint32
+	Height      uint32
+	SampleEntry []byte // ready stsd entry, nil until codec configuration is known
+
+	samples  []*Sample
+	pending  *Sample
+	firstPts int64
+	firstDts int64
+	duration uint64
+	hasCto   bool
+}
+
+func (track *Track) Duration() uint64 {
+	return track.duration
+}
+
+func box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size = size + len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, boxType...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func fullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(boxType, append([][]byte{header}, payload...)...)
+}
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func matrix() []byte {
+	b := make([]byte, 0, 36)
+	for _, v := range unityMatrix {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func visualSampleEntry(format string, width, height uint32, config ...[]byte) []byte {
+	b := make([]byte, 6, 78)
+	b = append(b, 0, 1)                // data_reference_index
+	b = append(b, make([]byte, 16)...) // pre_defined, reserved
+	b = binary.BigEndian.AppendUint16(b, uint16(width))
+	b = binary.BigEndian.AppendUint16(b, uint16(height))
+	b = binary.BigEndian.AppendUint32(b, 0x00480000)
+	b = binary.BigEndian.AppendUint32(b, 0x00480000)
+	b = append(b, 0, 0, 0, 0, 0, 1)    // reserved, frame_count
+	b = append(b, make([]byte, 32)...) // compressorname
+	b = append(b, 0, 0x18, 0xFF, 0xFF)
+	return box(format, append([][]byte{b}, config...)...)
+}
+
+func audioSampleEntry(channels byte, sampleRate uint32, config ...[]byte) []byte {
+	b := make([]byte, 6, 28)
+	b = append(b, 0, 1)
+	b = append(b, make([]byte, 8)...)
+	b = append(b, 0, channels, 0, 16, 0, 0, 0, 0)
+	b = binary.BigEndian.AppendUint32(b, sampleRate<<16)
+	return box(`mp4a`, append([][]byte{b}, config...)...)
+}
+
+func descriptor(tag byte, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size = size + len(p)
+	}
+	b := []byte{tag, 0x80 | byte(size>>21&0x7F), 0x80 | byte(size>>14&0x7F), 0x80 | byte(size>>7&0x7F), byte(size & 0x7F)}
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func esds(audioSpecificConfig []byte) []byte {
+	decoderConfig := descriptor(0x04, []byte{0x40, 0x15, 0, 0, 0}, u32(0), u32(0), descriptor(0x05, audioSpecificConfig))
+	return fullBox(`esds`, 0, 0, descriptor(0x03, []byte{0, 1, 0}, decoderConfig, descriptor(0x06, []byte{2})))
+}
+
+func ftyp(major string, compatible ...string) []byte {
+	b := []byte(major)
+	b = append(b, 0, 0, 2, 0)
+	for _, c := range compatible {
+		b = append(b, c...)
+	}
+	return box(`ftyp`, b)
+}
+
+func scale(v uint64, from, to uint32) uint64 {
+	if from == 0 {
+		return 0
+	}
+	return uint64(math.Round(float64(v) * float64(to) / float64(from)))
+}
+
+func mvhd(duration uint64, nextTrackId uint32) []byte {
+	b := make([]byte, 0, 108)
+	b = append(b, u64(0)...) // creation and modification time
+	b = append(b, u32(MovieTimescale)...)
+	b = append(b, u32(uint32(min(duration, math.MaxUint32)))...)
+	b = append(b, 0, 1, 0, 0, 1, 0)
+	b = append(b, make([]byte, 10)...)
+	b = append(b, matrix()...)
+	b = append(b, make([]byte, 24)...)
+	b = append(b, u32(nextTrackId)...)
+	return fullBox(`mvhd`, 0, 0, b)
+}
+
+func (track *Track) tkhd(duration uint64) []byte {
+	b := make([]byte, 0, 84)
+	b = append(b, u64(0)...)
+	b = append(b, u32(track.Id)...)
+	b = append(b, u32(0)...)
+	b = append(b, u32(uint32(min(duration, math.MaxUint32)))...)
+	b = append(b, make([]byte, 12)...) // reserved, layer, alternate_group
+	if track.Handler == `soun` {
+		b = append(b, 1, 0, 0, 0)
+	} else {
+		b = append(b, 0, 0, 0, 0)
+	}
+	b = append(b, matrix()...)
+	b = append(b, u32(track.Width<<16)...)
+	b = append(b, u32(track.Height<<16)...)
+	return fullBox(`tkhd`, 0, 3, b)
+}
+
+func (track *Track) mdhd(duration uint64) []byte {
+	b := append(u64(0), u32(track.Timescale)...)
+	b = append(b, u32(uint32(min(duration, math.MaxUint32)))...)
+	b = append(b, 0x55, 0xC4, 0, 0) // und
+	return fullBox(`mdhd`, 0, 0, b)
+}
+
+func (track *Track) hdlr() []byte {
+	name := `VideoHandler`
+	if track.Handler == `soun` {
+		name = `SoundHandler`
+	}
+	b := append(u32(0), track.Handler...)
+	b = append(b, make([]byte, 12)...)
+	b = append(b, name...)
+	b = append(b, 0)
+	return fullBox(`hdlr`, 0, 0, b)
+}
+
+func (track *Track) minf(stbl []byte) []byte {
+	var mediaHeader []byte
+	if track.Handler == `soun` {
+		mediaHeader = fullBox(`smhd`, 0, 0, u32(0))
+	} else {
+		mediaHeader = fullBox(`vmhd`, 0, 1, make([]byte, 8))
+	}
+	dinf := box(`dinf`, fullBox(`dref`, 0, 0, u32(1), fullBox(`url `, 0, 1)))
+	return box(`minf`, mediaHeader, dinf, stbl)
+}
+
+func (track *Track) stsd() []byte {
+	return fullBox(`stsd`, 0, 0, u32(1), track.SampleEntry)
+}
+
+// stbl of a progressive file: one sample per chunk.
+func (track *Track) stbl() []byte {
+	stts := make([]byte, 0)
+	entries := uint32(0)
+	for i := 0; i < len(track.samples); {
+		j := i
+		for j < len(track.samples) && track.samples[j].Duration == track.samples[i].Duration {
+			j++
+		}
+		stts = append(stts, u32(uint32(j-i))...)
+		stts = append(stts, u32(track.samples[i].Duration)...)
+		entries++
+		i = j
+	}
+	boxes := [][]byte{track.stsd(), fullBox(`stts`, 0, 0, u32(entries), stts)}
+
+	if track.hasCto {
+		ctts := make([]byte, 0)
+		entries = 0
+		for i := 0; i < len(track.samples); {
+			cto := track.samples[i].Pts - track.samples[i].Dts
+			j := i
+			for j < len(track.samples) && track.samples[j].Pts-track.samples[j].Dts == cto {
+				j++
+			}
+			ctts = append(ctts, u32(uint32(j-i))...)
+			ctts = append(ctts, u32(uint32(cto))...)
+			entries++
+			i = j
+		}
+		boxes = append(boxes, fullBox(`ctts`, 0, 0, u32(entries), ctts))
+	}
+
+	if track.Handler == `vide` {
+		stss := make([]byte, 0)
+		entries = 0
+		for i, sample := range track.samples {
+			if sample.Sync {
+				stss = append(stss, u32(uint32(i+1))...)
+				entries++
+			}
+		}
+		if int(entries) != len(track.samples) {
+			boxes = append(boxes, fullBox(`stss`, 0, 0, u32(entries), stss))
+		}
+	}
+
+	boxes = append(boxes, fullBox(`stsc`, 0, 0, u32(1), u32(1), u32(1), u32(1)))
+
+	stsz := make([]byte, 0, len(track.samples)*4)
+	large := false
+	for _, sample := range track.samples {
+		stsz = append(stsz, u32(sample.Size)...)
+		if sample.Offset > math.MaxUint32 {
+			large = true
+		}
+	}
+	boxes = append(boxes, fullBox(`stsz`, 0, 0, u32(0), u32(uint32(len(track.samples))), stsz))
+
+	offsets := make([]byte, 0, len(track.samples)*8)
+	for _, sample := range track.samples {
+		if large {
+			offsets = append(offsets, u64(sample.Offset)...)
+		} else {
+			offsets = append(offsets, u32(uint32(sample.Offset))...)
+		}
+	}
+	if large {
+		boxes = append(boxes, fullBox(`co64`, 0, 0, u32(uint32(len(track.samples))), offsets))
+	} else {
+		boxes = append(boxes, fullBox(`stco`, 0, 0, u32(uint32(len(track.samples))), offsets))
+	}
+	return box(`stbl`, boxes...)
+}
+
+// edts presents the track from startPts till endPts (-1 - till its end), in the track timescale: the track is delayed
+// by an empty edit if it starts later and the composition offset of the first sample is skipped. It also returns the
+// duration of the edits in the movie timescale.
+func (track *Track) edts(startPts, endPts int64) ([]byte, uint64) {
+	b := make([]byte, 0, 24)
+	entries := uint32(0)
+	delay := scale(uint64(max(track.firstPts-startPts, 0)), track.Timescale, MovieTimescale)
+	if delay > 0 {
+		b = append(b, u32(uint32(delay))...)
+		b = append(b, u32(math.MaxUint32)...) // empty edit
+		b = append(b, 0, 1, 0, 0)
+		entries++
+	}
+	mediaStart := max(startPts, track.firstPts)
+	end := track.firstPts + int64(track.duration)
+	if endPts >= 0 && endPts < end {
+		end = endPts
+	}
+	duration := scale(uint64(max(end-mediaStart, 0)), track.Timescale, MovieTimescale)
+	b = append(b, u32(uint32(duration))...)
+	b = append(b, u32(uint32(mediaStart-track.firstDts))...)
+	b = append(b, 0, 1, 0, 0)
+	entries++
+	return box(`edts`, fullBox(`elst`, 0, 0, u32(entries), b)), delay + duration
+}
+
+func (track *Track) trak(startPts, endPts int64) ([]byte, uint64) {
+	edts, duration := track.edts(startPts, endPts)
+	mdia := box(`mdia`, track.mdhd(track.duration), track.hdlr(), track.minf(track.stbl()))
+	return box(`trak`, track.tkhd(duration), edts, mdia), duration
+}
+
+// initTrak is the trak of a fragmented file's init segment: the sample tables are empty.
+func (track *Track) initTrak() []byte {
+	stbl := box(`stbl`, track.stsd(), fullBox(`stts`, 0, 0, u32(0)), fullBox(`stsc`, 0, 0, u32(0)),
+		fullBox(`stsz`, 0, 0, u32(0), u32(0)), fullBox(`stco`, 0, 0, u32(0)))
+	mdia := box(`mdia`, track.mdhd(0), track.hdlr(), track.minf(stbl))
+	return box(`trak`, track.tkhd(0), mdia)
+}
+
+func (track *Track) trex() []byte {
+	return fullBox(`trex`, 0, 0, u32(track.Id), u32(1), u32(0), u32(0), u32(0))
+}
+
+const (
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+// traf of a fragment with the track's samples. dataOffset is the offset of the first sample from the moof start.
+func (track *Track) traf(baseDecodeTime uint64, dataOffset uint32) []byte {
+	tfhd := fullBox(`tfhd`, 0, 0x020000, u32(track.Id))
+	tfdt := fullBox(`tfdt`, 1, 0, u64(baseDecodeTime))
+	b := make([]byte, 0, 4+len(track.samples)*16)
+	b = append(b, u32(uint32(len(track.samples)))...)
+	b = append(b, u32(dataOffset)...)
+	for _, sample := range track.samples {
+		b = append(b, u32(sample.Duration)...)
+		b = append(b, u32(sample.Size)...)
+		if sample.Sync {
+			b = append(b, u32(sampleFlagsSync)...)
+		} else {
+			b = append(b, u32(sampleFlagsNonSync)...)
+		}
+		b = append(b, u32(uint32(sample.Pts-sample.Dts))...)
+	}
+	trun := fullBox(`trun`, 0, 0x000F01, b)
+	return box(`traf`, tfhd, tfdt, trun)
+}
@@ -0,0 +1,550 @@
+package remux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	tsTimestampWrap   = int64(1) << 33
+	discontinuityGap  = 10 * 90000 // a timestamp jump longer than this is a discontinuity, not a gap
+	fragmentAudioTime = 1          // seconds of audio in a fragment of an audio-only stream
+)
+
+var (
+	ErrNoTracks = errors.New(`no supported tracks found`)
+	ErrClosed   = errors.New(`remuxer is closed`)
+)
+
+type demuxer interface {
+	Write(p []byte) (int, error)
+	Flush() error
+}
+
+type esParser interface {
+	parse(track *Track, pes *PES) ([]*Sample, error)
+}
+
+type tsTrack struct {
+	*Track
+	parser esParser
+
+	started  bool
+	inInit   bool  // the track is in the init segment of the fragmented file
+	lastDts  int64 // unwrapped 90 kHz DTS of the previous PES
+	lastStep int64 // DTS difference of the last two PES
+	tsOffset int64 // added to timestamps to hide wraparounds and discontinuities
+}
+
+// Remuxer converts MPEG-TS (H.264, H.265 and AAC streams) or fragmented MP4 written to it into MP4. A progressive
+// file needs io.WriteSeeker: sample data goes to mdat as it comes and moov is written on Close. The fragmented one is
+// written to any io.Writer, a moof/mdat fragment per video GOP. The input format is detected from the first write.
+type Remuxer struct {
+	AudioOnly bool // video tracks are skipped, e.g. to make M4A
+
+	demuxer    demuxer
+	tracks     map[uint16]*tsTrack
+	fmp4Tracks map[uint32]*tsTrack
+	order      []*tsTrack
+	fragmented bool
+	w          io.Writer
+	seeker     io.WriteSeeker
+	mdatStart  int64
+	offset     uint64
+	closed     bool
+	trimStart  int64 // 90 kHz
+	trimEnd    int64 // 90 kHz, -1 - no trimming of the end
+
+	// fragmented
+	initWritten bool
+	sequence    uint32
+	baseDts90   int64
+}
+
+func (remuxer *Remuxer) onPmt(streams map[uint16]byte) error {
+	pids := make([]int, 0, len(streams))
+	for pid := range streams {
+		pids = append(pids, int(pid))
+	}
+	sort.Ints(pids)
+	for _, p := range pids {
+		pid := uint16(p)
+		if _, ok := remuxer.tracks[pid]; ok || remuxer.initWritten {
+			continue
+		}
+		track := tsTrack{Track: &Track{Id: uint32(len(remuxer.order) + 1)}}
+		switch streams[pid] {
+		case StreamTypeH264:
+			track.Handler, track.Timescale, track.parser = `vide`, VideoTimescale, &h264Parser{}
+		case StreamTypeH265:
+			track.Handler, track.Timescale, track.parser = `vide`, VideoTimescale, &h265Parser{}
+		case StreamTypeAAC:
+			track.Handler, track.parser = `soun`, &aacParser{}
+		default:
+			DebugLog.Printf("Stream type 0x%02x of pid %d is not supported, skipping\n", streams[pid], pid)
+			continue
+		}
+		if remuxer.AudioOnly && track.Handler != `soun` {
+			continue
+		}
+		remuxer.tracks[pid] = &track
+		remuxer.order = append(remuxer.order, &track)
+	}
+	return nil
+}
+
+// unwrap makes 33 bit 90 kHz timestamps monotonic across wraparounds and discontinuities.
+func (track *tsTrack) unwrap(ts int64) int64 {
+	ts = ts + track.tsOffset
+	if !track.started {
+		return ts
+	}
+	for ts < track.lastDts-tsTimestampWrap/2 {
+		ts = ts + tsTimestampWrap
+		track.tsOffset = track.tsOffset + tsTimestampWrap
+	}
+	if ts > track.lastDts+tsTimestampWrap/2 && ts >= tsTimestampWrap {
+		return ts - tsTimestampWrap // a late one from before the wraparound
+	}
+	if gap := ts - track.lastDts; gap > discontinuityGap || gap < -discontinuityGap {
+		expected := track.lastDts + track.lastStep
+		DebugLog.Printf("Discontinuity of track %d: %d -> %d\n", track.Id, track.lastDts, ts)
+		track.tsOffset = track.tsOffset + expected - ts
+		ts = expected
+	}
+	return ts
+}
+
+func (remuxer *Remuxer) onPes(pes *PES) error {
+	track, ok := remuxer.tracks[pes.Pid]
+	if !ok || pes.Pts == NoTimestamp {
+		return nil
+	}
+	cto := pes.Pts - pes.Dts
+	if cto < 0 {
+		cto = cto + tsTimestampWrap
+	}
+	pes.Dts = track.unwrap(pes.Dts)
+	pes.Pts = pes.Dts + cto
+	if track.started && pes.Dts <= track.lastDts {
+		return nil
+	}
+	if track.started {
+		track.lastStep = pes.Dts - track.lastDts
+	}
+	track.started = true
+	track.lastDts = pes.Dts
+	samples, err := track.parser.parse(track.Track, pes)
+	if err != nil {
+		return err
+	}
+	for _, sample := range samples {
+		if err := remuxer.addSample(track, sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (remuxer *Remuxer) toTimescale(track *tsTrack, ts90 int64) int64 {
+	return ts90 * int64(track.Timescale) / 90000
+}
+
+func (remuxer *Remuxer) addSample(track *tsTrack, sample *Sample) error {
+	if track.SampleEntry == nil {
+		return nil
+	}
+	if track.pending == nil && len(track.samples) == 0 && track.duration == 0 {
+		if track.Handler == `vide` && !sample.Sync {
+			return nil // can't start decoding before a key frame
+		}
+	}
+	sample.Pts = remuxer.toTimescale(track, sample.Pts)
+	sample.Dts = remuxer.toTimescale(track, sample.Dts)
+	if pending := track.pending; pending != nil {
+		if track.Handler == `soun` {
+			// PES timestamps of audio are rounded, so keep the frames contiguous
+			if expected := pending.Dts + AacSamplesPerFrame; abs(sample.Dts-expected) < AacSamplesPerFrame/2 {
+				sample.Dts, sample.Pts = expected, expected
+			}
+		}
+		duration := sample.Dts - pending.Dts
+		if duration <= 0 {
+			return nil
+		}
+		pending.Duration = uint32(duration)
+		if err := remuxer.commit(track, pending); err != nil {
+			return err
+		}
+	} else if track.duration == 0 && len(track.samples) == 0 {
+		track.firstDts = sample.Dts
+		track.firstPts = sample.Pts
+	}
+	track.pending = sample
+	return nil
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// commit puts the sample (its duration is known now) into the output.
+func (remuxer *Remuxer) commit(track *tsTrack, sample *Sample) error {
+	sample.Size = uint32(len(sample.Data))
+	if sample.Pts != sample.Dts {
+		track.hasCto = true
+	}
+	if remuxer.fragmented {
+		if remuxer.shouldFlush(track, sample) {
+			if err := remuxer.flushFragment(); err != nil {
+				return err
+			}
+		}
+		track.samples = append(track.samples, sample)
+		track.duration = track.duration + uint64(sample.Duration)
+		return nil
+	}
+	if _, err := remuxer.w.Write(sample.Data); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	sample.Offset = remuxer.offset
+	remuxer.offset = remuxer.offset + uint64(sample.Size)
+	sample.Data = nil
+	track.samples = append(track.samples, sample)
+	track.duration = track.duration + uint64(sample.Duration)
+	return nil
+}
+
+func (remuxer *Remuxer) hasVideo() bool {
+	for _, track := range remuxer.order {
+		if track.Handler == `vide` && track.SampleEntry != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (remuxer *Remuxer) shouldFlush(track *tsTrack, sample *Sample) bool {
+	if len(track.samples) == 0 {
+		return false
+	}
+	if track.Handler == `vide` {
+		return sample.Sync
+	}
+	if remuxer.hasVideo() {
+		return false
+	}
+	return sample.Dts-track.samples[0].Dts >= int64(track.Timescale)*fragmentAudioTime
+}
+
+// ready returns the tracks to write: the ones with known codec configuration.
+func (remuxer *Remuxer) ready() []*tsTrack {
+	tracks := make([]*tsTrack, 0, len(remuxer.order))
+	for _, track := range remuxer.order {
+		if track.SampleEntry != nil && (len(track.samples) > 0 || track.duration > 0) {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+func (remuxer *Remuxer) writeInit(tracks []*tsTrack) error {
+	remuxer.baseDts90 = -1
+	traks := make([][]byte, 0, len(tracks))
+	trexs := make([][]byte, 0, len(tracks))
+	for _, track := range tracks {
+		dts90 := track.firstDts * 90000 / int64(track.Timescale)
+		if remuxer.baseDts90 < 0 || dts90 < remuxer.baseDts90 {
+			remuxer.baseDts90 = dts90
+		}
+		traks = append(traks, track.initTrak())
+		trexs = append(trexs, track.trex())
+		track.inInit = true
+	}
+	moov := box(`moov`, append([][]byte{mvhd(0, uint32(len(remuxer.order)+1))}, append(traks,
+		box(`mvex`, trexs...))...)...)
+	if _, err := remuxer.w.Write(append(ftyp(`iso6`, `iso6`, `isom`, `mp41`, `dash`), moov...)); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	remuxer.initWritten = true
+	return nil
+}
+
+// flushFragment writes the samples collected so far as a moof/mdat pair (and the init segment before the first one).
+func (remuxer *Remuxer) flushFragment() error {
+	tracks := remuxer.ready()
+	if len(tracks) == 0 {
+		return nil
+	}
+	if !remuxer.initWritten {
+		if err := remuxer.writeInit(tracks); err != nil {
+			return err
+		}
+	}
+	written := make([]*tsTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if len(track.samples) > 0 && track.inInit {
+			written = append(written, track)
+		}
+	}
+	remuxer.sequence++
+	moof := func(offsets []uint32) []byte {
+		trafs := make([][]byte, 0, len(written))
+		for i, track := range written {
+			base := track.samples[0].Dts - remuxer.baseDts90*int64(track.Timescale)/90000
+			trafs = append(trafs, track.traf(uint64(max(base, 0)), offsets[i]))
+		}
+		return box(`moof`, append([][]byte{fullBox(`mfhd`, 0, 0, u32(remuxer.sequence))}, trafs...)...)
+	}
+	offsets := make([]uint32, len(written))
+	size := uint32(len(moof(offsets)) + 8)
+	mdatSize := 8
+	for i, track := range written {
+		offsets[i] = size
+		for _, sample := range track.samples {
+			size = size + sample.Size
+			mdatSize = mdatSize + int(sample.Size)
+		}
+	}
+	data := moof(offsets)
+	data = append(data, u32(uint32(mdatSize))...)
+	data = append(data, `mdat`...)
+	for _, track := range written {
+		for _, sample := range track.samples {
+			data = append(data, sample.Data...)
+		}
+		track.samples = track.samples[:0]
+	}
+	if _, err := remuxer.w.Write(data); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// onInit makes tracks of the fragmented MP4 input. An init segment can be repeated, but the codec configuration of
+// a track can't change: a progressive file has one sample entry per track.
+func (remuxer *Remuxer) onInit(tracks []*Fmp4Track) error {
+	for _, t := range tracks {
+		if track, ok := remuxer.fmp4Tracks[t.Id]; ok {
+			if !bytes.Equal(track.SampleEntry, t.SampleEntry) {
+				ErrorLog.Printf("%s: track %d\n", ErrInitChanged.Error(), t.Id)
+				return ErrInitChanged
+			}
+			continue
+		}
+		if remuxer.initWritten {
+			continue
+		}
+		if t.Handler != `vide` && t.Handler != `soun` {
+			DebugLog.Printf("Track %d of '%s' handler is not supported, skipping\n", t.Id, t.Handler)
+			continue
+		}
+		if remuxer.AudioOnly && t.Handler != `soun` {
+			continue
+		}
+		track := tsTrack{Track: &Track{
+			Id:          uint32(len(remuxer.order) + 1),
+			Handler:     t.Handler,
+			Codec:       t.Codec,
+			Timescale:   t.Timescale,
+			Width:       t.Width,
+			Height:      t.Height,
+			SampleEntry: t.SampleEntry,
+		}}
+		remuxer.fmp4Tracks[t.Id] = &track
+		remuxer.order = append(remuxer.order, &track)
+	}
+	return nil
+}
+
+// onSample adds a sample of the fragmented MP4 input: its duration is known already.
+func (remuxer *Remuxer) onSample(t *Fmp4Track, sample *Sample) error {
+	track, ok := remuxer.fmp4Tracks[t.Id]
+	if !ok {
+		return nil
+	}
+	if len(track.samples) == 0 && track.duration == 0 {
+		if track.Handler == `vide` && !sample.Sync {
+			return nil
+		}
+		track.firstDts = sample.Dts
+		track.firstPts = sample.Pts
+	}
+	return remuxer.commit(track, sample)
+}
+
+func (remuxer *Remuxer) Write(p []byte) (int, error) {
+	if remuxer.closed {
+		return 0, ErrClosed
+	}
+	if remuxer.demuxer == nil {
+		if IsFmp4(p) {
+			demuxer := NewFmp4Demuxer()
+			demuxer.OnInit = remuxer.onInit
+			demuxer.OnSample = remuxer.onSample
+			remuxer.demuxer = demuxer
+		} else {
+			demuxer := NewTsDemuxer()
+			demuxer.OnPmt = remuxer.onPmt
+			demuxer.OnPes = remuxer.onPes
+			remuxer.demuxer = demuxer
+		}
+	}
+	return remuxer.demuxer.Write(p)
+}
+
+func (remuxer *Remuxer) finishPending() error {
+	for _, track := range remuxer.order {
+		pending := track.pending
+		if pending == nil {
+			continue
+		}
+		track.pending = nil
+		switch {
+		case len(track.samples) > 0:
+			pending.Duration = track.samples[len(track.samples)-1].Duration
+		case track.Handler == `soun`:
+			pending.Duration = AacSamplesPerFrame
+		default:
+			pending.Duration = track.Timescale / 25
+		}
+		if err := remuxer.commit(track, pending); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Trim makes the progressive file present only duration (0 - till the end) from start, relative to the beginning of
+// the stream. The samples are kept, the file is cut by edit lists. The fragmented file is not trimmed.
+func (remuxer *Remuxer) Trim(start, duration time.Duration) {
+	remuxer.trimStart = int64(start * 90000 / time.Second)
+	remuxer.trimEnd = -1
+	if duration > 0 {
+		remuxer.trimEnd = remuxer.trimStart + int64(duration*90000/time.Second)
+	}
+}
+
+// Close writes the remaining samples and finalizes the file. It doesn't close the underlying writer.
+func (remuxer *Remuxer) Close() error {
+	if remuxer.closed {
+		return nil
+	}
+	remuxer.closed = true
+	if remuxer.demuxer == nil {
+		return ErrNoTracks
+	}
+	if err := remuxer.demuxer.Flush(); err != nil {
+		return err
+	}
+	if err := remuxer.finishPending(); err != nil {
+		return err
+	}
+	if remuxer.fragmented {
+		if err := remuxer.flushFragment(); err != nil {
+			return err
+		}
+		if !remuxer.initWritten {
+			return ErrNoTracks
+		}
+		return nil
+	}
+	return remuxer.writeMoov()
+}
+
+func (remuxer *Remuxer) writeMoov() error {
+	tracks := remuxer.ready()
+	if len(tracks) == 0 {
+		return ErrNoTracks
+	}
+	startPts := int64(-1)
+	duration := uint64(0)
+	for _, track := range tracks {
+		pts90 := track.firstPts * 90000 / int64(track.Timescale)
+		if startPts < 0 || pts90 < startPts {
+			startPts = pts90
+		}
+	}
+	endPts := int64(-1)
+	if remuxer.trimEnd >= 0 {
+		endPts = startPts + remuxer.trimEnd
+	}
+	startPts = startPts + remuxer.trimStart
+	traks := make([][]byte, 0, len(tracks))
+	for _, track := range tracks {
+		trackEndPts := int64(-1)
+		if endPts >= 0 {
+			trackEndPts = endPts * int64(track.Timescale) / 90000
+		}
+		trak, trackDuration := track.trak(startPts*int64(track.Timescale)/90000, trackEndPts)
+		traks = append(traks, trak)
+		duration = max(duration, trackDuration)
+	}
+	moov := box(`moov`, append([][]byte{mvhd(duration, uint32(len(remuxer.order)+1))}, traks...)...)
+	if _, err := remuxer.seeker.Seek(remuxer.mdatStart+8, io.SeekStart); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if _, err := remuxer.seeker.Write(u64(remuxer.offset - uint64(remuxer.mdatStart))); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if _, err := remuxer.seeker.Seek(0, io.SeekEnd); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	if _, err := remuxer.seeker.Write(moov); err != nil {
+		ErrorLog.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+func newRemuxer(w io.Writer) *Remuxer {
+	remuxer := Remuxer{
+		tracks:     make(map[uint16]*tsTrack),
+		fmp4Tracks: make(map[uint32]*tsTrack),
+		order:      make([]*tsTrack, 0),
+		w:          w,
+		trimEnd:    -1,
+	}
+	return &remuxer
+}
+
+// NewRemuxer makes a progressive MP4 (moov at the end) remuxer writing to w from its current position.
+func NewRemuxer(w io.WriteSeeker) (*Remuxer, error) {
+	remuxer := newRemuxer(w)
+	remuxer.seeker = w
+	header := ftyp(`isom`, `isom`, `iso2`, `avc1`, `mp41`)
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	remuxer.mdatStart = start + int64(len(header))
+	header = append(header, u32(1)...)
+	header = append(header, `mdat`...)
+	header = append(header, u64(0)...)
+	if _, err := w.Write(header); err != nil {
+		ErrorLog.Println(err.Error())
+		return nil, err
+	}
+	remuxer.offset = uint64(start) + uint64(len(header))
+	return remuxer, nil
+}
+
+// NewFragmentedRemuxer makes a fragmented MP4 remuxer, suitable for pipes.
+func NewFragmentedRemuxer(w io.Writer) *Remuxer {
+	remuxer := newRemuxer(w)
+	remuxer.fragmented = true
+	return remuxer
+}
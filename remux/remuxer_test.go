@@ -0,0 +1,212 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// memoryFile is an in-memory io.WriteSeeker.
+type memoryFile struct {
+	data []byte
+	pos  int
+}
+
+func (file *memoryFile) Write(p []byte) (int, error) {
+	if end := file.pos + len(p); end > len(file.data) {
+		file.data = append(file.data, make([]byte, end-len(file.data))...)
+	}
+	file.pos = file.pos + copy(file.data[file.pos:], p)
+	return len(p), nil
+}
+
+func (file *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset = offset + int64(file.pos)
+	case io.SeekEnd:
+		offset = offset + int64(len(file.data))
+	}
+	if offset < 0 {
+		return 0, errors.New(`negative position`)
+	}
+	file.pos = int(offset)
+	return offset, nil
+}
+
+func TestUnwrap(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []int64
+		out  []int64
+	}{
+		{`monotonic`, []int64{1000, 4000, 7000}, []int64{1000, 4000, 7000}},
+		{`wrap`, []int64{tsTimestampWrap - 3000, 0, 3000}, []int64{tsTimestampWrap - 3000, tsTimestampWrap,
+			tsTimestampWrap + 3000}},
+		{`late across wrap`, []int64{tsTimestampWrap - 3000, 3000, tsTimestampWrap - 1000, 6000}, []int64{
+			tsTimestampWrap - 3000, tsTimestampWrap + 3000, tsTimestampWrap - 1000, tsTimestampWrap + 6000}},
+		{`discontinuity`, []int64{90000, 93000, 900000000, 900003000}, []int64{90000, 93000, 96000, 99000}},
+	}
+	for _, test := range tests {
+		track := tsTrack{Track: &Track{}}
+		for i, ts := range test.in {
+			unwrapped := track.unwrap(ts)
+			if unwrapped != test.out[i] {
+				t.Errorf("%s: unwrap(%d) = %d, want %d", test.name, ts, unwrapped, test.out[i])
+			}
+			// as onPes does, which drops the late ones
+			if track.started && unwrapped <= track.lastDts {
+				continue
+			}
+			if track.started {
+				track.lastStep = unwrapped - track.lastDts
+			}
+			track.started, track.lastDts = true, unwrapped
+		}
+	}
+}
+
+type testTrack struct {
+	handler   string
+	durations []uint32
+	cto       []uint32
+	sizes     []uint32
+	offsets   []uint64
+}
+
+// readStbl reads the sample tables of the progressive file's tracks, expanding stts and ctts to a value per sample.
+func readStbl(t *testing.T, moov []byte) []testTrack {
+	boxes, err := children(moov)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := make([]testTrack, 0)
+	for _, b := range boxes {
+		if b.Type != `trak` {
+			continue
+		}
+		track := testTrack{handler: string(child(b.Payload, `mdia`, `hdlr`)[8:12])}
+		stbl := child(b.Payload, `mdia`, `minf`, `stbl`)
+		entries := func(boxType string, size int) [][]byte {
+			payload := child(stbl, boxType)
+			if payload == nil {
+				return nil
+			}
+			values := make([][]byte, 0)
+			start := 8
+			if boxType == `stsz` {
+				start = 12
+			}
+			for i := start; i+size <= len(payload); i += size {
+				values = append(values, payload[i:i+size])
+			}
+			return values
+		}
+		for _, entry := range entries(`stts`, 8) {
+			for i := uint32(0); i < binary.BigEndian.Uint32(entry); i++ {
+				track.durations = append(track.durations, binary.BigEndian.Uint32(entry[4:]))
+			}
+		}
+		for _, entry := range entries(`ctts`, 8) {
+			for i := uint32(0); i < binary.BigEndian.Uint32(entry); i++ {
+				track.cto = append(track.cto, binary.BigEndian.Uint32(entry[4:]))
+			}
+		}
+		for _, entry := range entries(`stsz`, 4) {
+			track.sizes = append(track.sizes, binary.BigEndian.Uint32(entry))
+		}
+		for _, entry := range entries(`stco`, 4) {
+			track.offsets = append(track.offsets, uint64(binary.BigEndian.Uint32(entry)))
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+// TestRemuxerSampleTables remuxes H.264 and AAC across the 33 bit timestamp wraparound and checks that the sample
+// tables match the mdat layout.
+func TestRemuxerSampleTables(t *testing.T) {
+	start := tsTimestampWrap - 4*3000
+	stream := append(tsPat(), tsPmt(testVideoPid, StreamTypeH264, testAudioPid, StreamTypeAAC)...)
+	videoSamples, audioSamples := make([][]byte, 0), make([][]byte, 0)
+	for i := 0; i < 8; i++ {
+		nalu := append([]byte{0x41}, bytes.Repeat([]byte{byte(i)}, 50+i*10)...)
+		frame := annexB([]byte{9, 0xF0}, nalu)
+		if i%4 == 0 {
+			nalu[0] = 0x65
+			frame = annexB([]byte{9, 0xF0}, testSps, testPps, nalu)
+		}
+		videoSamples = append(videoSamples, append(binary.BigEndian.AppendUint32(nil, uint32(len(nalu))), nalu...))
+		dts := start + int64(i)*3000
+		stream = append(stream, tsPes(testVideoPid, 0xE0, (dts+3000)%tsTimestampWrap, dts%tsTimestampWrap, frame)...)
+		// two AAC frames of 1024 samples at 48 kHz per PES: 3840 ticks of 90 kHz
+		audio := make([]byte, 0)
+		for j := 0; j < 2; j++ {
+			payload := bytes.Repeat([]byte{byte(0x80 + i*2 + j)}, 20+j)
+			audioSamples = append(audioSamples, payload)
+			audio = append(audio, adtsFrame(2, 3, 2, payload)...)
+		}
+		pts := (start + int64(i)*3840) % tsTimestampWrap
+		stream = append(stream, tsPes(testAudioPid, 0xC0, pts, pts, audio)...)
+	}
+	file := memoryFile{}
+	remuxer, err := NewRemuxer(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remuxer.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := remuxer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	boxes, err := children(file.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boxes) != 3 || boxes[0].Type != `ftyp` || boxes[1].Type != `mdat` || boxes[2].Type != `moov` {
+		t.Fatalf("top level boxes: %v", boxes)
+	}
+	mdatStart := uint64(boxes[0].Size + 16)
+	mdatEnd := uint64(boxes[0].Size + boxes[1].Size)
+	tracks := readStbl(t, boxes[2].Payload)
+	if len(tracks) != 2 || tracks[0].handler != `vide` || tracks[1].handler != `soun` {
+		t.Fatalf("tracks: %+v", tracks)
+	}
+	total := uint64(0)
+	for i, want := range [][][]byte{videoSamples, audioSamples} {
+		track := tracks[i]
+		if len(track.durations) != len(want) || len(track.sizes) != len(want) || len(track.offsets) != len(want) {
+			t.Fatalf("%s: %d durations, %d sizes, %d offsets for %d samples", track.handler, len(track.durations),
+				len(track.sizes), len(track.offsets), len(want))
+		}
+		for j, sample := range want {
+			offset, size := track.offsets[j], uint64(track.sizes[j])
+			if offset < mdatStart || offset+size > mdatEnd {
+				t.Fatalf("%s: sample %d at %d+%d is out of mdat %d-%d", track.handler, j, offset, size, mdatStart,
+					mdatEnd)
+			}
+			if !bytes.Equal(file.data[offset:offset+size], sample) {
+				t.Errorf("%s: sample %d = %x, want %x", track.handler, j, file.data[offset:offset+size], sample)
+			}
+			total = total + size
+		}
+	}
+	if total != mdatEnd-mdatStart {
+		t.Errorf("samples take %d bytes of %d of mdat", total, mdatEnd-mdatStart)
+	}
+	for j, duration := range tracks[0].durations {
+		if duration != 3000 || tracks[0].cto[j] != 3000 {
+			t.Errorf("video sample %d: duration %d, composition offset %d, want 3000, 3000", j, duration,
+				tracks[0].cto[j])
+		}
+	}
+	for j, duration := range tracks[1].durations {
+		if duration != AacSamplesPerFrame {
+			t.Errorf("audio sample %d: duration %d, want %d", j, duration, AacSamplesPerFrame)
+		}
+	}
+}
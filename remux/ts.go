@@ -0,0 +1,210 @@
+package remux
+
+import (
+	"errors"
+)
+
+const (
+	TsPacketSize = 188
+
+	StreamTypeAAC  = 0x0F
+	StreamTypeH264 = 0x1B
+	StreamTypeH265 = 0x24
+
+	NoTimestamp = int64(-1)
+)
+
+var ErrNotTs = errors.New(`not MPEG-TS data`)
+
+// PES is a reassembled packetized elementary stream packet. Timestamps are in 90 kHz units, NoTimestamp if absent.
+type PES struct {
+	Pid        uint16
+	StreamType byte
+	Pts        int64
+	Dts        int64
+	Data       []byte
+}
+
+type tsStream struct {
+	streamType byte
+	data       []byte
+	started    bool
+}
+
+// TsDemuxer parses MPEG-TS written to it and calls OnPes for every complete PES of a stream listed in the PMT.
+type TsDemuxer struct {
+	OnPes   func(pes *PES) error
+	OnPmt   func(streams map[uint16]byte) error
+	buf     []byte
+	pmtPid  int
+	streams map[uint16]*tsStream
+	synced  bool
+}
+
+func (demuxer *TsDemuxer) Write(p []byte) (int, error) {
+	demuxer.buf = append(demuxer.buf, p...)
+	offset := 0
+	for len(demuxer.buf)-offset >= TsPacketSize {
+		if demuxer.buf[offset] != 0x47 {
+			if !demuxer.synced {
+				return 0, ErrNotTs
+			}
+			offset++ // lost sync, looking for the next packet
+			continue
+		}
+		demuxer.synced = true
+		if err := demuxer.packet(demuxer.buf[offset : offset+TsPacketSize]); err != nil {
+			return 0, err
+		}
+		offset = offset + TsPacketSize
+	}
+	demuxer.buf = append(demuxer.buf[:0], demuxer.buf[offset:]...)
+	return len(p), nil
+}
+
+// Flush emits PES packets that are still being accumulated (at the end of the stream).
+func (demuxer *TsDemuxer) Flush() error {
+	for pid, stream := range demuxer.streams {
+		if err := demuxer.emit(pid, stream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (demuxer *TsDemuxer) packet(packet []byte) error {
+	pusi := packet[1]&0x40 != 0
+	pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+	afc := packet[3] >> 4 & 3
+	if afc&1 == 0 {
+		return nil
+	}
+	payload := packet[4:]
+	if afc&2 != 0 {
+		if int(payload[0])+1 > len(payload) {
+			return nil
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+	switch {
+	case pid == 0:
+		if pusi {
+			demuxer.pat(payload)
+		}
+	case int(pid) == demuxer.pmtPid:
+		if pusi {
+			return demuxer.pmt(payload)
+		}
+	default:
+		stream, ok := demuxer.streams[pid]
+		if !ok {
+			return nil
+		}
+		if pusi {
+			if err := demuxer.emit(pid, stream); err != nil {
+				return err
+			}
+			stream.started = true
+		}
+		if stream.started {
+			stream.data = append(stream.data, payload...)
+		}
+	}
+	return nil
+}
+
+// section returns a PSI section (assuming it fits into a single packet) without the trailing CRC.
+func section(payload []byte) []byte {
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	s := payload[1+int(payload[0]):]
+	if len(s) < 3 {
+		return nil
+	}
+	length := int(s[1]&0x0F)<<8 | int(s[2])
+	if length < 4 || 3+length > len(s) {
+		return nil
+	}
+	return s[:3+length-4]
+}
+
+func (demuxer *TsDemuxer) pat(payload []byte) {
+	s := section(payload)
+	if len(s) < 8 || s[0] != 0 {
+		return
+	}
+	for i := 8; i+4 <= len(s); i += 4 {
+		program := uint16(s[i])<<8 | uint16(s[i+1])
+		if program == 0 {
+			continue
+		}
+		demuxer.pmtPid = int(s[i+2]&0x1F)<<8 | int(s[i+3])
+		return
+	}
+}
+
+func (demuxer *TsDemuxer) pmt(payload []byte) error {
+	s := section(payload)
+	if len(s) < 12 || s[0] != 2 {
+		return nil
+	}
+	streams := make(map[uint16]byte)
+	programInfoLength := int(s[10]&0x0F)<<8 | int(s[11])
+	for i := 12 + programInfoLength; i+5 <= len(s); {
+		pid := uint16(s[i+1]&0x1F)<<8 | uint16(s[i+2])
+		streams[pid] = s[i]
+		i = i + 5 + (int(s[i+3]&0x0F)<<8 | int(s[i+4]))
+	}
+	for pid, streamType := range streams {
+		if _, ok := demuxer.streams[pid]; !ok {
+			demuxer.streams[pid] = &tsStream{streamType: streamType}
+		}
+	}
+	if demuxer.OnPmt != nil {
+		return demuxer.OnPmt(streams)
+	}
+	return nil
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&7)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func (demuxer *TsDemuxer) emit(pid uint16, stream *tsStream) error {
+	data := stream.data
+	stream.data = nil
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil
+	}
+	pes := PES{
+		Pid:        pid,
+		StreamType: stream.streamType,
+		Pts:        NoTimestamp,
+		Dts:        NoTimestamp,
+	}
+	flags := data[7] >> 6
+	headerLength := int(data[8])
+	if 9+headerLength > len(data) {
+		return nil
+	}
+	if flags&2 != 0 && headerLength >= 5 {
+		pes.Pts = parseTimestamp(data[9:])
+		pes.Dts = pes.Pts
+	}
+	if flags == 3 && headerLength >= 10 {
+		pes.Dts = parseTimestamp(data[14:])
+	}
+	pes.Data = data[9+headerLength:]
+	if demuxer.OnPes == nil {
+		return nil
+	}
+	return demuxer.OnPes(&pes)
+}
+
+func NewTsDemuxer() *TsDemuxer {
+	return &TsDemuxer{
+		pmtPid:  -1,
+		streams: make(map[uint16]*tsStream),
+	}
+}
@@ -0,0 +1,148 @@
+package remux
+
+import (
+	"bytes"
+	"testing"
+)
+
+const (
+	testPmtPid   = 0x1000
+	testVideoPid = 0x100
+	testAudioPid = 0x101
+)
+
+// tsPackets splits the payload into packets of the pid, the last one is padded by adaptation field stuffing.
+func tsPackets(pid uint16, payload []byte) []byte {
+	packets := make([]byte, 0)
+	for first := true; first || len(payload) > 0; first = false {
+		header := []byte{0x47, byte(pid >> 8 & 0x1F), byte(pid), 0x10}
+		if first {
+			header[1] = header[1] | 0x40
+		}
+		n := min(len(payload), TsPacketSize-4)
+		if n < TsPacketSize-4 {
+			header[3] = 0x30
+			stuffing := TsPacketSize - 4 - n - 1
+			header = append(header, byte(stuffing))
+			if stuffing > 0 {
+				header = append(header, 0)
+				header = append(header, bytes.Repeat([]byte{0xFF}, stuffing-1)...)
+			}
+		}
+		packets = append(packets, header...)
+		packets = append(packets, payload[:n]...)
+		payload = payload[n:]
+	}
+	return packets
+}
+
+// psi makes the payload of a PSI section with a pointer field and a dummy CRC.
+func psi(tableId byte, id uint16, body []byte) []byte {
+	length := 5 + len(body) + 4
+	s := []byte{0, tableId, 0xB0 | byte(length>>8), byte(length), byte(id >> 8), byte(id), 0xC1, 0, 0}
+	s = append(s, body...)
+	return append(s, 0, 0, 0, 0)
+}
+
+func tsPat() []byte {
+	return tsPackets(0, psi(0, 1, []byte{0, 1, 0xE0 | testPmtPid>>8, testPmtPid & 0xFF}))
+}
+
+// tsPmt lists the streams as pid, stream type pairs.
+func tsPmt(streams ...uint16) []byte {
+	body := []byte{0xE0 | testVideoPid>>8, testVideoPid & 0xFF, 0xF0, 0}
+	for i := 0; i+1 < len(streams); i += 2 {
+		body = append(body, byte(streams[i+1]), 0xE0|byte(streams[i]>>8), byte(streams[i]), 0xF0, 0)
+	}
+	return tsPackets(testPmtPid, psi(2, 1, body))
+}
+
+func pesTimestamp(prefix byte, ts int64) []byte {
+	return []byte{prefix<<4 | byte(ts>>29)&0x0E | 1, byte(ts >> 22), byte(ts>>14) | 1, byte(ts >> 7), byte(ts<<1) | 1}
+}
+
+// tsPes makes the packets of a PES, without DTS if it equals PTS.
+func tsPes(pid uint16, streamId byte, pts, dts int64, data []byte) []byte {
+	pes := []byte{0, 0, 1, streamId, 0, 0, 0x80, 0x80, 5}
+	if dts != pts {
+		pes[7], pes[8] = 0xC0, 10
+		pes = append(pes, pesTimestamp(3, pts)...)
+		pes = append(pes, pesTimestamp(1, dts)...)
+	} else {
+		pes = append(pes, pesTimestamp(2, pts)...)
+	}
+	return tsPackets(pid, append(pes, data...))
+}
+
+// testSps is a baseline 320x240 SPS, testPps is a PPS.
+var (
+	testSps = []byte{0x67, 66, 0xC0, 30, 0xDA, 0x05, 0x07, 0xE4}
+	testPps = []byte{0x68, 0xCE, 0x38, 0x80}
+)
+
+// annexB joins NAL units with start codes.
+func annexB(nalus ...[]byte) []byte {
+	data := make([]byte, 0)
+	for _, nalu := range nalus {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nalu...)
+	}
+	return data
+}
+
+func TestTsDemuxer(t *testing.T) {
+	frame := annexB([]byte{9, 0xF0}, testSps, testPps, append([]byte{0x65}, bytes.Repeat([]byte{0xAB}, 400)...))
+	stream := append(tsPat(), tsPmt(testVideoPid, StreamTypeH264, testAudioPid, 0x06)...)
+	stream = append(stream, tsPes(testVideoPid, 0xE0, 93003, 90000, frame)...)
+	stream = append(stream, tsPes(testVideoPid, 0xE0, 96003, 96003, []byte{0, 0, 1, 0x41, 1})...)
+	var pmt map[uint16]byte
+	pes := make([]*PES, 0)
+	demuxer := NewTsDemuxer()
+	demuxer.OnPmt = func(streams map[uint16]byte) error {
+		pmt = streams
+		return nil
+	}
+	demuxer.OnPes = func(p *PES) error {
+		pes = append(pes, p)
+		return nil
+	}
+	// odd writes check packets split between them
+	for len(stream) > 0 {
+		n := min(len(stream), 100)
+		if _, err := demuxer.Write(stream[:n]); err != nil {
+			t.Fatal(err)
+		}
+		stream = stream[n:]
+	}
+	if err := demuxer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pmt) != 2 || pmt[testVideoPid] != StreamTypeH264 || pmt[testAudioPid] != 0x06 {
+		t.Errorf("PMT streams = %v", pmt)
+	}
+	if len(pes) != 2 {
+		t.Fatalf("%d PES, want 2", len(pes))
+	}
+	if p := pes[0]; p.Pid != testVideoPid || p.StreamType != StreamTypeH264 || p.Pts != 93003 || p.Dts != 90000 ||
+		!bytes.Equal(p.Data, frame) {
+		t.Errorf("first PES = pid %d, type 0x%02x, pts %d, dts %d, %d bytes", p.Pid, p.StreamType, p.Pts, p.Dts,
+			len(p.Data))
+	}
+	if p := pes[1]; p.Pts != 96003 || p.Dts != 96003 || !bytes.Equal(p.Data, []byte{0, 0, 1, 0x41, 1}) {
+		t.Errorf("second PES = pts %d, dts %d, data %x", p.Pts, p.Dts, p.Data)
+	}
+}
+
+func TestTsDemuxerNotTs(t *testing.T) {
+	if _, err := NewTsDemuxer().Write(make([]byte, TsPacketSize)); err != ErrNotTs {
+		t.Errorf("Write() = %v, want %v", err, ErrNotTs)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for _, ts := range []int64{0, 90000, 1<<32 + 12345, tsTimestampWrap - 1} {
+		if parsed := parseTimestamp(pesTimestamp(2, ts)); parsed != ts {
+			t.Errorf("parseTimestamp() = %d, want %d", parsed, ts)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/vvampirius/hls-downloader/downloader"
+	"os"
+	"strings"
+)
+
+// verifyCommand re-hashes the outputs of the manifests and compares them with the recorded hashes. The arguments are
+// manifests or outputs (their manifests are next to them). It returns the exit code.
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet(`verify`, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify <output or manifest>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	code := 0
+	for _, arg := range flags.Args() {
+		filename := arg
+		if !strings.HasSuffix(filename, downloader.ManifestExt) {
+			filename = downloader.ManifestFor(filename)
+		}
+		manifest, err := downloader.VerifyManifest(filename)
+		if err != nil {
+			fmt.Printf("FAILED\t%s\t%s\n", arg, err.Error())
+			code = 1
+			continue
+		}
+		fmt.Printf("OK\t%s\t%s\t%d segments\n", arg, manifest.OutputSha256, len(manifest.Segments))
+	}
+	return code
+}
@@ -0,0 +1,169 @@
+package webvtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	mpegtsClock = 90000
+	mpegtsWrap  = int64(1) << 33 // timestamps are 33 bit
+)
+
+var (
+	regexpSrtTag      = regexp.MustCompile(`</?([a-zA-Z]+)[^>]*>|<\d[^>]*>`)
+	srtEntityReplacer = strings.NewReplacer(`&amp;`, `&`, `&lt;`, `<`, `&gt;`, `>`, `&nbsp;`, "\u00a0",
+		`&lrm;`, "\u200e", `&rlm;`, "\u200f")
+)
+
+// Merger joins the WebVTT segments of a subtitle rendition into one timeline starting at the output start.
+//
+// A segment with X-TIMESTAMP-MAP is placed by its MPEG-TS timestamp relative to Origin, the timestamp of the first
+// sample of the output. If Origin is unknown (NoTimestamp), the map of the first segment is taken as the start of
+// the playlist, as for segments without a map, whose cue times are in the playlist timeline; Start (the playlist
+// time the output starts at) is subtracted then. Cues ending before the output start are dropped, as are the ones
+// starting after Duration (0 - no limit) and the ones repeated by adjacent segments.
+type Merger struct {
+	Origin   int64
+	Start    time.Duration
+	Duration time.Duration
+
+	header    []string
+	blocks    []string
+	cues      []Cue
+	mapOrigin int64 // Origin taken from the first map
+	seen      map[Cue]bool
+}
+
+// mpegtsDiff is a - b of 33 bit timestamps, the shorter way round the wrap.
+func mpegtsDiff(a, b int64) time.Duration {
+	diff := ((a-b)%mpegtsWrap + mpegtsWrap) % mpegtsWrap
+	if diff >= mpegtsWrap/2 {
+		diff = diff - mpegtsWrap
+	}
+	return time.Duration(diff) * time.Second / mpegtsClock
+}
+
+// Add parses the segment and adds its cues.
+func (merger *Merger) Add(data []byte) error {
+	document, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	if merger.header == nil {
+		merger.header, merger.blocks = document.Header, document.Blocks
+	}
+	shift := -merger.Start
+	if timestampMap := document.TimestampMap; timestampMap != nil {
+		origin := merger.Origin
+		if origin == NoTimestamp {
+			if merger.mapOrigin == NoTimestamp {
+				merger.mapOrigin = timestampMap.Mpegts - int64(timestampMap.Local*mpegtsClock/time.Second)
+			}
+			origin = merger.mapOrigin
+		} else {
+			shift = 0
+		}
+		shift = shift + mpegtsDiff(timestampMap.Mpegts, origin) - timestampMap.Local
+	}
+	for _, cue := range document.Cues {
+		cue.Start, cue.End = cue.Start+shift, cue.End+shift
+		if cue.End <= 0 || cue.End < cue.Start || (merger.Duration > 0 && cue.Start >= merger.Duration) {
+			continue
+		}
+		cue.Start = max(cue.Start, 0)
+		key := cue
+		key.Id = ``
+		if merger.seen[key] {
+			continue
+		}
+		merger.seen[key] = true
+		merger.cues = append(merger.cues, cue)
+	}
+	return nil
+}
+
+// Cues returns the merged cues in the order of their start.
+func (merger *Merger) Cues() []Cue {
+	sort.SliceStable(merger.cues, func(i, j int) bool {
+		return merger.cues[i].Start < merger.cues[j].Start
+	})
+	return merger.cues
+}
+
+// WriteVtt writes the merged WebVTT file: the header and STYLE/REGION blocks of the first segment and the cues.
+func (merger *Merger) WriteVtt(w io.Writer) error {
+	output := bufio.NewWriter(w)
+	fmt.Fprintln(output, `WEBVTT`)
+	for _, line := range merger.header {
+		fmt.Fprintln(output, line)
+	}
+	for _, block := range merger.blocks {
+		fmt.Fprintf(output, "\n%s\n", block)
+	}
+	for _, cue := range merger.Cues() {
+		fmt.Fprintln(output)
+		if cue.Id != `` {
+			fmt.Fprintln(output, cue.Id)
+		}
+		timing := FormatTimestamp(cue.Start, `.`) + ` --> ` + FormatTimestamp(cue.End, `.`)
+		if cue.Settings != `` {
+			timing = timing + ` ` + cue.Settings
+		}
+		fmt.Fprintln(output, timing)
+		fmt.Fprintln(output, cue.Text)
+	}
+	return output.Flush()
+}
+
+// SrtText converts the cue text to SRT: only b, i and u tags are kept and the entities are unescaped.
+func SrtText(text string) string {
+	text = regexpSrtTag.ReplaceAllStringFunc(text, func(tag string) string {
+		match := regexpSrtTag.FindStringSubmatch(tag)
+		switch name := strings.ToLower(match[1]); name {
+		case `b`, `i`, `u`:
+			if strings.HasPrefix(tag, `</`) {
+				return `</` + name + `>`
+			}
+			return `<` + name + `>`
+		}
+		return ``
+	})
+	return srtEntityReplacer.Replace(text)
+}
+
+// WriteSrt writes the merged cues as SubRip. Cue settings, styles and regions have no SRT equivalent and are lost.
+func (merger *Merger) WriteSrt(w io.Writer) error {
+	output := bufio.NewWriter(w)
+	n := 0
+	for _, cue := range merger.Cues() {
+		text := strings.Trim(SrtText(cue.Text), "\n")
+		if strings.TrimSpace(text) == `` {
+			continue
+		}
+		n++
+		if n > 1 {
+			fmt.Fprintln(output)
+		}
+		fmt.Fprintln(output, n)
+		fmt.Fprintf(output, "%s --> %s\n", FormatTimestamp(cue.Start, `,`), FormatTimestamp(cue.End, `,`))
+		fmt.Fprintln(output, text)
+	}
+	return output.Flush()
+}
+
+func NewMerger(origin int64, start, duration time.Duration) *Merger {
+	return &Merger{
+		Origin:    origin,
+		Start:     start,
+		Duration:  duration,
+		cues:      make([]Cue, 0),
+		mapOrigin: NoTimestamp,
+		seen:      make(map[Cue]bool),
+	}
+}
@@ -0,0 +1,114 @@
+package webvtt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// vtt makes a segment with the X-TIMESTAMP-MAP value (empty - none) and the cues of 'start --> end' and text lines.
+func vtt(timestampMap string, cues ...string) []byte {
+	data := "WEBVTT\n"
+	if timestampMap != `` {
+		data = data + "X-TIMESTAMP-MAP=" + timestampMap + "\n"
+	}
+	for i := 0; i+1 < len(cues); i += 2 {
+		data = data + "\n" + cues[i] + "\n" + cues[i+1] + "\n"
+	}
+	return []byte(data)
+}
+
+type testCue struct {
+	start, end time.Duration
+	text       string
+}
+
+func TestMerger(t *testing.T) {
+	s := time.Second
+	tests := []struct {
+		name     string
+		origin   int64
+		start    time.Duration
+		duration time.Duration
+		segments [][]byte
+		cues     []testCue
+	}{
+		{`mpegts wrap`, mpegtsWrap - 90000, 0, 0, [][]byte{
+			vtt(`MPEGTS:8589844592,LOCAL:00:00:00.000`, `00:00:00.500 --> 00:00:01.500`, `before`),
+			// 10 seconds after the wraparound, 11 after the origin
+			vtt(`MPEGTS:900000,LOCAL:00:00:00.000`, `00:00:01.000 --> 00:00:02.000`, `after`),
+		}, []testCue{{s / 2, 3 * s / 2, `before`}, {12 * s, 13 * s, `after`}}},
+		{`map local time`, 900000, 0, 0, [][]byte{
+			vtt(`MPEGTS:1080000,LOCAL:00:00:10.000`, `00:00:10.000 --> 00:00:11.000`, `two`),
+		}, []testCue{{2 * s, 3 * s, `two`}}},
+		{`no map`, 900000, 10 * s, 0, [][]byte{
+			vtt(``, `00:00:05.000 --> 00:00:08.000`, `dropped`, `00:00:09.000 --> 00:00:11.000`, `trimmed`,
+				`00:00:15.000 --> 00:00:17.000`, `kept`),
+		}, []testCue{{0, s, `trimmed`}, {5 * s, 7 * s, `kept`}}},
+		{`unknown origin`, NoTimestamp, 4 * s, 0, [][]byte{
+			vtt(`MPEGTS:900000,LOCAL:00:00:00.000`, `00:00:05.000 --> 00:00:06.000`, `first`),
+			vtt(`MPEGTS:1440000,LOCAL:00:00:00.000`, `00:00:00.000 --> 00:00:01.000`, `second`),
+		}, []testCue{{s, 2 * s, `first`}, {2 * s, 3 * s, `second`}}},
+		{`duration`, 0, 0, 6 * s, [][]byte{
+			vtt(`MPEGTS:0,LOCAL:00:00:00.000`, `00:00:05.000 --> 00:00:07.000`, `kept`, `00:00:06.000 --> 00:00:07.000`,
+				`dropped`),
+		}, []testCue{{5 * s, 7 * s, `kept`}}},
+		{`repeated`, 0, 0, 0, [][]byte{
+			vtt(`MPEGTS:0,LOCAL:00:00:00.000`, `00:00:05.000 --> 00:00:07.000`, `long`),
+			vtt(`MPEGTS:540000,LOCAL:00:00:00.000`, `00:00:00.000 --> 00:00:01.000`, `short`,
+				`00:00:05.000 --> 00:00:07.000`, `other`),
+			vtt(`MPEGTS:540000,LOCAL:00:00:06.000`, `00:00:05.000 --> 00:00:07.000`, `long`),
+		}, []testCue{{5 * s, 7 * s, `long`}, {6 * s, 7 * s, `short`}, {11 * s, 13 * s, `other`}}},
+	}
+	for _, test := range tests {
+		merger := NewMerger(test.origin, test.start, test.duration)
+		for _, segment := range test.segments {
+			if err := merger.Add(segment); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		cues := merger.Cues()
+		if len(cues) != len(test.cues) {
+			t.Errorf("%s: cues = %+v, want %+v", test.name, cues, test.cues)
+			continue
+		}
+		for i, cue := range cues {
+			if want := test.cues[i]; cue.Start != want.start || cue.End != want.end || cue.Text != want.text {
+				t.Errorf("%s: cue %d = %s --> %s %q, want %s --> %s %q", test.name, i, cue.Start, cue.End, cue.Text,
+					want.start, want.end, want.text)
+			}
+		}
+	}
+}
+
+func TestMergerWrite(t *testing.T) {
+	merger := NewMerger(0, 0, 0)
+	segment := []byte("WEBVTT\nKind: captions\n\nSTYLE\n::cue { color: red }\n\n" +
+		"intro\n00:00:01.000 --> 00:00:02.500 align:start\n<v Bob><b>Hello</b> &amp; <c.red>bye</c></v>\n\n" +
+		"00:01:00.000 --> 00:01:01.000\n<i>Two</i>\nlines\n\n" +
+		"00:02:00.000 --> 00:02:01.000\n<ruby>x</ruby>\n")
+	if err := merger.Add(segment); err != nil {
+		t.Fatal(err)
+	}
+	output := bytes.Buffer{}
+	if err := merger.WriteVtt(&output); err != nil {
+		t.Fatal(err)
+	}
+	want := "WEBVTT\nKind: captions\n\nSTYLE\n::cue { color: red }\n\n" +
+		"intro\n00:00:01.000 --> 00:00:02.500 align:start\n<v Bob><b>Hello</b> &amp; <c.red>bye</c></v>\n\n" +
+		"00:01:00.000 --> 00:01:01.000\n<i>Two</i>\nlines\n\n" +
+		"00:02:00.000 --> 00:02:01.000\n<ruby>x</ruby>\n"
+	if output.String() != want {
+		t.Errorf("WriteVtt() = %q, want %q", output.String(), want)
+	}
+	output.Reset()
+	if err := merger.WriteSrt(&output); err != nil {
+		t.Fatal(err)
+	}
+	want = "1\n00:00:01,000 --> 00:00:02,500\n<b>Hello</b> & bye\n\n" +
+		"2\n00:01:00,000 --> 00:01:01,000\n<i>Two</i>\nlines\n\n" +
+		"3\n00:02:00,000 --> 00:02:01,000\nx\n"
+	if output.String() != want {
+		t.Errorf("WriteSrt() = %q, want %q", output.String(), want)
+	}
+}
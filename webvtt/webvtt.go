@@ -0,0 +1,170 @@
+package webvtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NoTimestamp is an absent MPEG-TS timestamp.
+const NoTimestamp = int64(-1)
+
+var (
+	ErrNotWebVtt    = errors.New(`not WebVTT data`)
+	ErrBadTimestamp = errors.New(`bad WebVTT timestamp`)
+	ErrBadTiming    = errors.New(`bad WebVTT cue timing`)
+
+	RegexpTimestamp = regexp.MustCompile(`^(?:(\d+):)?(\d{2}):(\d{2})[.,](\d{3})$`)
+)
+
+// Cue is a subtitle with its timing line settings (position, align, ...).
+type Cue struct {
+	Id       string
+	Start    time.Duration
+	End      time.Duration
+	Settings string
+	Text     string
+}
+
+// TimestampMap is X-TIMESTAMP-MAP of HLS: the cue time Local corresponds to the MPEG-TS timestamp Mpegts (90 kHz).
+type TimestampMap struct {
+	Mpegts int64
+	Local  time.Duration
+}
+
+// Document is a parsed WebVTT file. NOTE blocks are dropped.
+type Document struct {
+	Header       []string // the lines after WEBVTT except X-TIMESTAMP-MAP
+	Blocks       []string // STYLE and REGION blocks
+	TimestampMap *TimestampMap
+	Cues         []Cue
+}
+
+// ParseTimestamp parses [hh:]mm:ss.ttt. A comma instead of the dot (as in SRT) is accepted.
+func ParseTimestamp(s string) (time.Duration, error) {
+	match := RegexpTimestamp.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, errors.Join(ErrBadTimestamp, errors.New(s))
+	}
+	hours := 0
+	if match[1] != `` {
+		hours, _ = strconv.Atoi(match[1])
+	}
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.Atoi(match[3])
+	milliseconds, _ := strconv.Atoi(match[4])
+	if minutes > 59 || seconds > 59 {
+		return 0, errors.Join(ErrBadTimestamp, errors.New(s))
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second + time.Duration(milliseconds)*time.Millisecond, nil
+}
+
+// FormatTimestamp formats hh:mm:ss.ttt with the separator of milliseconds ('.' in WebVTT, ',' in SRT).
+func FormatTimestamp(d time.Duration, separator string) string {
+	d = max(d, 0).Round(time.Millisecond)
+	hours := d / time.Hour
+	minutes := d % time.Hour / time.Minute
+	seconds := d % time.Minute / time.Second
+	milliseconds := d % time.Second / time.Millisecond
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", hours, minutes, seconds, separator, milliseconds)
+}
+
+// ParseTimestampMap parses the value of X-TIMESTAMP-MAP, e.g. 'MPEGTS:900000,LOCAL:00:00:00.000'.
+func ParseTimestampMap(s string) (*TimestampMap, error) {
+	timestampMap := TimestampMap{}
+	for _, field := range strings.Split(s, `,`) {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), `:`)
+		switch name {
+		case `MPEGTS`:
+			mpegts, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errors.Join(ErrBadTimestamp, errors.New(fmt.Sprintf("X-TIMESTAMP-MAP=%s", s)))
+			}
+			timestampMap.Mpegts = mpegts
+		case `LOCAL`:
+			local, err := ParseTimestamp(value)
+			if err != nil {
+				return nil, err
+			}
+			timestampMap.Local = local
+		}
+	}
+	return &timestampMap, nil
+}
+
+// parseTiming parses 'start --> end [settings]'.
+func parseTiming(line string) (time.Duration, time.Duration, string, error) {
+	start, rest, found := strings.Cut(line, `-->`)
+	if !found {
+		return 0, 0, ``, errors.Join(ErrBadTiming, errors.New(line))
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return 0, 0, ``, errors.Join(ErrBadTiming, errors.New(line))
+	}
+	startTime, err := ParseTimestamp(start)
+	if err != nil {
+		return 0, 0, ``, err
+	}
+	endTime, err := ParseTimestamp(fields[0])
+	if err != nil {
+		return 0, 0, ``, err
+	}
+	return startTime, endTime, strings.Join(fields[1:], ` `), nil
+}
+
+// Parse parses the WebVTT file. Blocks that are neither cues nor STYLE/REGION ones are skipped.
+func Parse(data []byte) (*Document, error) {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	text := strings.ReplaceAll(strings.ReplaceAll(string(data), "\r\n", "\n"), "\r", "\n")
+	blocks := strings.Split(text, "\n\n")
+	header := strings.Split(blocks[0], "\n")
+	if header[0] != `WEBVTT` && !strings.HasPrefix(header[0], `WEBVTT `) && !strings.HasPrefix(header[0], "WEBVTT\t") {
+		return nil, ErrNotWebVtt
+	}
+	document := Document{Header: make([]string, 0), Blocks: make([]string, 0), Cues: make([]Cue, 0)}
+	for _, line := range header[1:] {
+		if value, found := strings.CutPrefix(line, `X-TIMESTAMP-MAP=`); found {
+			timestampMap, err := ParseTimestampMap(value)
+			if err != nil {
+				return nil, err
+			}
+			document.TimestampMap = timestampMap
+			continue
+		}
+		document.Header = append(document.Header, line)
+	}
+	for _, block := range blocks[1:] {
+		block = strings.Trim(block, "\n")
+		if block == `` {
+			continue
+		}
+		lines := strings.Split(block, "\n")
+		switch {
+		case lines[0] == `NOTE` || strings.HasPrefix(lines[0], `NOTE `) || strings.HasPrefix(lines[0], "NOTE\t"):
+			continue
+		case (lines[0] == `STYLE` || lines[0] == `REGION`) && len(document.Cues) == 0:
+			document.Blocks = append(document.Blocks, block)
+			continue
+		}
+		cue := Cue{}
+		if !strings.Contains(lines[0], `-->`) {
+			if len(lines) < 2 || !strings.Contains(lines[1], `-->`) {
+				continue
+			}
+			cue.Id, lines = lines[0], lines[1:]
+		}
+		var err error
+		if cue.Start, cue.End, cue.Settings, err = parseTiming(lines[0]); err != nil {
+			continue
+		}
+		cue.Text = strings.Join(lines[1:], "\n")
+		document.Cues = append(document.Cues, cue)
+	}
+	return &document, nil
+}
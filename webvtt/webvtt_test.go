@@ -0,0 +1,63 @@
+package webvtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		s  string
+		d  time.Duration
+		ok bool
+	}{
+		{`00:01.500`, 1500 * time.Millisecond, true},
+		{`01:02:03.004`, time.Hour + 2*time.Minute + 3*time.Second + 4*time.Millisecond, true},
+		{`100:00:00,000`, 100 * time.Hour, true},
+		{` 00:00:10.000 `, 10 * time.Second, true},
+		{`00:60.000`, 0, false},
+		{`1:00.000`, 0, false},
+		{`00:00:01`, 0, false},
+	}
+	for _, test := range tests {
+		d, err := ParseTimestamp(test.s)
+		if (err == nil) != test.ok || d != test.d {
+			t.Errorf("ParseTimestamp(%q) = %s, %v; want %s, ok %t", test.s, d, err, test.d, test.ok)
+		}
+	}
+	if s := FormatTimestamp(time.Hour+2*time.Minute+3*time.Second+4*time.Millisecond, `,`); s != `01:02:03,004` {
+		t.Errorf("FormatTimestamp() = %s", s)
+	}
+}
+
+func TestParse(t *testing.T) {
+	document, err := Parse([]byte("\xEF\xBB\xBFWEBVTT\r\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:01.000\r\n" +
+		"Kind: captions\r\n\r\nSTYLE\r\n::cue { color: red }\r\n\r\nNOTE a comment\r\n\r\n" +
+		"1\r\n00:00:01.000 --> 00:00:02.500 align:start\r\nHello\r\nworld\r\n\r\n" +
+		"00:03.000 --> 00:04.000\r\n<i>Bye</i>\r\n\r\nbroken\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := document.TimestampMap; m == nil || m.Mpegts != 900000 || m.Local != time.Second {
+		t.Errorf("TimestampMap = %+v", m)
+	}
+	if len(document.Header) != 1 || document.Header[0] != `Kind: captions` {
+		t.Errorf("Header = %q", document.Header)
+	}
+	if len(document.Blocks) != 1 || document.Blocks[0] != "STYLE\n::cue { color: red }" {
+		t.Errorf("Blocks = %q", document.Blocks)
+	}
+	want := []Cue{{`1`, time.Second, 2500 * time.Millisecond, `align:start`, "Hello\nworld"},
+		{``, 3 * time.Second, 4 * time.Second, ``, `<i>Bye</i>`}}
+	if len(document.Cues) != len(want) {
+		t.Fatalf("Cues = %+v", document.Cues)
+	}
+	for i, cue := range document.Cues {
+		if cue != want[i] {
+			t.Errorf("cue %d = %+v, want %+v", i, cue, want[i])
+		}
+	}
+	if _, err := Parse([]byte("1\n00:00:01.000 --> 00:00:02.000\nHello\n")); err != ErrNotWebVtt {
+		t.Errorf("Parse() of SRT = %v, want %v", err, ErrNotWebVtt)
+	}
+}